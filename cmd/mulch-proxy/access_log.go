@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// AccessLogger writes one access log file per VM, with rotation
+type AccessLogger struct {
+	dataPath string
+	format   string
+	files    map[string]*accessLogFile
+	mutex    sync.Mutex
+	log      *Log
+}
+
+type accessLogFile struct {
+	file *os.File
+	size int64
+}
+
+// NewAccessLogger creates a new AccessLogger (log directory is created
+// if needed)
+func NewAccessLogger(dataPath string, format string, log *Log) (*AccessLogger, error) {
+	err := os.MkdirAll(dataPath+"/"+common.AccessLogDir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessLogger{
+		dataPath: dataPath,
+		format:   format,
+		files:    make(map[string]*accessLogFile),
+		log:      log,
+	}, nil
+}
+
+// must be called with the mutex locked
+func (al *AccessLogger) open(vmName string) (*accessLogFile, error) {
+	f, err := os.OpenFile(common.AccessLogFilename(al.dataPath, vmName, 0), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	alf := &accessLogFile{
+		file: f,
+		size: stat.Size(),
+	}
+	al.files[vmName] = alf
+	return alf, nil
+}
+
+// must be called with the mutex locked
+func (al *AccessLogger) rotate(vmName string) (*accessLogFile, error) {
+	al.files[vmName].file.Close()
+	delete(al.files, vmName)
+
+	os.Remove(common.AccessLogFilename(al.dataPath, vmName, common.AccessLogMaxFiles-1))
+	for n := common.AccessLogMaxFiles - 2; n >= 0; n-- {
+		src := common.AccessLogFilename(al.dataPath, vmName, n)
+		if _, err := os.Stat(src); err == nil {
+			err = os.Rename(src, common.AccessLogFilename(al.dataPath, vmName, n+1))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return al.open(vmName)
+}
+
+// Add writes an entry to the access log of the VM. Errors are only
+// logged, the request is already served.
+func (al *AccessLogger) Add(vmID string, entry *common.AccessLogEntry) {
+	// domain VMName is a VM ID (name-rX), we log by name (all revisions)
+	vmName, _, _ := strings.Cut(vmID, "-")
+
+	var line []byte
+	switch al.format {
+	case common.AccessLogFormatJSON:
+		data, err := json.Marshal(entry)
+		if err != nil {
+			al.log.Errorf("access log: %s", err)
+			return
+		}
+		line = append(data, '\n')
+	default:
+		line = []byte(accessLogCombinedLine(entry))
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	var err error
+	alf, exists := al.files[vmName]
+	if !exists {
+		alf, err = al.open(vmName)
+		if err != nil {
+			al.log.Errorf("access log: %s", err)
+			return
+		}
+	}
+
+	if alf.size+int64(len(line)) > common.AccessLogMaxSize {
+		alf, err = al.rotate(vmName)
+		if err != nil {
+			al.log.Errorf("access log rotation: %s", err)
+			return
+		}
+	}
+
+	n, err := alf.file.Write(line)
+	alf.size += int64(n)
+	if err != nil {
+		al.log.Errorf("access log: %s", err)
+	}
+}
+
+// Apache/nginx "combined" format, with host, duration and upstream added
+func accessLogCombinedLine(entry *common.AccessLogEntry) string {
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %s %.3f %s\n",
+		entry.IP,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method,
+		accessLogEscape(entry.Path),
+		entry.Proto,
+		entry.Status,
+		entry.Size,
+		accessLogEscape(entry.Referer),
+		accessLogEscape(entry.UserAgent),
+		entry.Host,
+		entry.Duration,
+		accessLogDash(entry.Upstream),
+	)
+}
+
+func accessLogEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return accessLogDash(value)
+}
+
+func accessLogDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// returns the client IP: when the request comes from our parent (or a
+// trusted proxy), the client IP is given by headers
+func accessLogClientIP(req *http.Request, fromParent bool) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	if !fromParent {
+		return ip
+	}
+
+	if realIP := req.Header.Get("X-Real-Ip"); realIP != "" {
+		return realIP
+	}
+
+	// last entry was added by the trusted proxy itself
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+
+	return ip
+}
+
+// newAccessLogEntry must be called before the request is modified by
+// the proxy (headers, RemoteAddr, …)
+func newAccessLogEntry(req *http.Request, host string, fromParent bool, start time.Time) *common.AccessLogEntry {
+	return &common.AccessLogEntry{
+		Time:      start,
+		IP:        accessLogClientIP(req, fromParent),
+		Host:      host,
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+}
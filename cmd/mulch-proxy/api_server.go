@@ -58,6 +58,22 @@ func (srv *APIServer) registerRoutes() {
 		srv.Log.Errorf("%d: %s", http.StatusMethodNotAllowed, errMsg)
 		http.Error(w, errMsg, http.StatusMethodNotAllowed)
 	})
+
+	srv.Muxer.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !srv.checkPSK(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.Method == "POST" {
+			_ = srv.registerMetricsController(w, r)
+			return
+		}
+
+		errMsg := fmt.Sprintf("Method %s not allowed for route /metrics", r.Method)
+		srv.Log.Errorf("%d: %s", http.StatusMethodNotAllowed, errMsg)
+		http.Error(w, errMsg, http.StatusMethodNotAllowed)
+	})
 }
 
 func (srv *APIServer) checkPSK(request *http.Request) bool {
@@ -151,6 +167,29 @@ func (srv *APIServer) registerDomainsController(response http.ResponseWriter, re
 	return nil
 }
 
+func (srv *APIServer) registerMetricsController(response http.ResponseWriter, request *http.Request) error {
+	var data common.ProxyChainMetrics
+
+	err := json.NewDecoder(request.Body).Decode(&data)
+	if err != nil {
+		srv.Log.Error(err.Error())
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	srv.ProxyServer.Metrics.SetChildMetrics(&data)
+
+	response.Header().Set("Content-Type", "application/json")
+	dataJSON, err := json.Marshal("OK")
+	if err != nil {
+		srv.Log.Error(err.Error())
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	response.Write([]byte(dataJSON))
+	return nil
+}
+
 func (srv *APIServer) checkDomainsController(response http.ResponseWriter, request *http.Request) error {
 	var data common.ProxyChainDomains
 
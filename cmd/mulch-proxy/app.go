@@ -97,27 +97,38 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 		}
 	}()
 
+	var accessLogger *AccessLogger
+	if app.Config.AccessLogFormat != "" {
+		accessLogger, err = NewAccessLogger(app.Config.DataPath, app.Config.AccessLogFormat, app.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	app.ProxyServer = NewProxyServer(&ProxyServerParams{
-		DirCache:              cacheDir,
-		Email:                 app.Config.AcmeEmail,
-		ListenHTTP:            app.Config.HTTPAddress,
-		ListenHTTPS:           app.Config.HTTPSAddress,
-		DirectoryURL:          app.Config.AcmeURL,
-		DomainDB:              ddb,
-		ExtraCertsDB:          extraCertsDB,
-		ErrorHTMLTemplateFile: path.Clean(app.Config.configPath + "/templates/error_page.html"),
-		MulchdHTTPSDomain:     app.Config.ListenHTTPSDomain,
-		ChainMode:             app.Config.ChainMode,
-		ChainPSK:              app.Config.ChainPSK,
-		ChainDomain:           chainDomain,
-		ForceXForwardedFor:    app.Config.ForceXForwardedFor,
-		TrustedProxies:        app.Config.TrustedProxies,
-		HaveTrustedProxies:    app.Config.HaveTrustedProxies,
-		Log:                   app.Log,
-		RequestList:           NewRequestList(debug),
-		RateControllers:       rateControllers,
-		Trace:                 trace,
-		Debug:                 debug,
+		DirCache:                    cacheDir,
+		Email:                       app.Config.AcmeEmail,
+		ListenHTTP:                  app.Config.HTTPAddress,
+		ListenHTTPS:                 app.Config.HTTPSAddress,
+		DirectoryURL:                app.Config.AcmeURL,
+		DomainDB:                    ddb,
+		ExtraCertsDB:                extraCertsDB,
+		ErrorHTMLTemplateFile:       path.Clean(app.Config.configPath + "/templates/error_page.html"),
+		MaintenanceHTMLTemplateFile: path.Clean(app.Config.configPath + "/templates/maintenance_page.html"),
+		ParkingHTMLFile:             app.Config.ParkingPage,
+		MulchdHTTPSDomain:           app.Config.ListenHTTPSDomain,
+		ChainMode:                   app.Config.ChainMode,
+		ChainPSK:                    app.Config.ChainPSK,
+		ChainDomain:                 chainDomain,
+		ForceXForwardedFor:          app.Config.ForceXForwardedFor,
+		TrustedProxies:              app.Config.TrustedProxies,
+		HaveTrustedProxies:          app.Config.HaveTrustedProxies,
+		Log:                         app.Log,
+		RequestList:                 NewRequestList(debug),
+		RateControllers:             rateControllers,
+		AccessLogger:                accessLogger,
+		Trace:                       trace,
+		Debug:                       debug,
 	})
 
 	app.ProxyServer.RefreshReverseProxies()
@@ -151,6 +162,17 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 		InstallWatchdog(ddb, app.Config.ChainParentURL, app.Log)
 	}
 
+	if app.Config.ChainMode == ChainModeChild {
+		app.SchedulePushParentMetrics()
+	}
+
+	if app.Config.MetricsListen != "" {
+		go func() {
+			err := app.ProxyServer.ServeMetrics(app.Config.MetricsListen)
+			app.Log.Errorf("metrics server: %s", err)
+		}()
+	}
+
 	return app, nil
 }
 
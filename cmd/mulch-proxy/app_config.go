@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/OnitiFR/mulch/common"
 )
 
 // Reverse Proxy Chaining modes
@@ -62,6 +63,15 @@ type AppConfig struct {
 	TrustedProxies     map[string]bool
 	HaveTrustedProxies bool
 
+	// Listen address for the metrics endpoint (empty = disabled)
+	MetricsListen string
+
+	// Access log format (empty = disabled)
+	AccessLogFormat string
+
+	// Page for unknown hosts (empty = error 500)
+	ParkingPage string
+
 	// Rate controller configuration (if any)
 	RateControllerConfigs map[string]*RateControllerConfig
 
@@ -86,6 +96,12 @@ type tomlAppConfig struct {
 
 	TrustedProxies []string `toml:"proxy_trusted_proxies"`
 
+	MetricsListen string `toml:"proxy_metrics_listen"`
+
+	AccessLogFormat string `toml:"proxy_access_log"`
+
+	ParkingPage string `toml:"proxy_parking_page"`
+
 	RateControllers []tomlConfigRate `toml:"proxy_rate"`
 }
 
@@ -148,6 +164,24 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig.HTTPSAddress = tConfig.HTTPSAddress
 
 	appConfig.ListenHTTPSDomain = tConfig.ListenHTTPSDomain
+	appConfig.MetricsListen = tConfig.MetricsListen
+
+	switch tConfig.AccessLogFormat {
+	case "", common.AccessLogFormatCombined, common.AccessLogFormatJSON:
+		appConfig.AccessLogFormat = tConfig.AccessLogFormat
+	default:
+		return nil, fmt.Errorf("unknown proxy_access_log value '%s'", tConfig.AccessLogFormat)
+	}
+
+	if tConfig.ParkingPage != "" {
+		appConfig.ParkingPage = tConfig.ParkingPage
+		if !path.IsAbs(appConfig.ParkingPage) {
+			appConfig.ParkingPage = path.Clean(configPath + "/" + appConfig.ParkingPage)
+		}
+		if !common.PathExist(appConfig.ParkingPage) {
+			return nil, fmt.Errorf("proxy_parking_page: file '%s' not found", appConfig.ParkingPage)
+		}
+	}
 
 	switch tConfig.ChainMode {
 	case "":
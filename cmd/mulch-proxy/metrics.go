@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// ChildMetricsPushInterval is the interval between child-to-parent
+// metrics pushes (see ProxyChainMetrics)
+const ChildMetricsPushInterval = 1 * time.Minute
+
+// metrics of a child are ignored if not refreshed for this duration
+const childMetricsMaxAge = 5 * ChildMetricsPushInterval
+
+// local metrics source label
+const metricsSourceLocal = "local"
+
+// ProxyMetrics stores per-domain traffic metrics (and metrics pushed by
+// our children, if we're a parent proxy)
+type ProxyMetrics struct {
+	domains  map[string]*common.ProxyDomainMetrics
+	children map[string]*proxyChildMetrics
+	mutex    sync.Mutex
+}
+
+type proxyChildMetrics struct {
+	received time.Time
+	domains  []*common.ProxyDomainMetrics
+}
+
+// NewProxyMetrics creates a new ProxyMetrics
+func NewProxyMetrics() *ProxyMetrics {
+	return &ProxyMetrics{
+		domains:  make(map[string]*common.ProxyDomainMetrics),
+		children: make(map[string]*proxyChildMetrics),
+	}
+}
+
+// must be called with the mutex locked
+func (pm *ProxyMetrics) get(domain *common.Domain) *common.ProxyDomainMetrics {
+	dm, exists := pm.domains[domain.Name]
+	if !exists {
+		dm = &common.ProxyDomainMetrics{
+			Domain:        domain.Name,
+			StatusClasses: make(map[string]uint64),
+			LatencyCounts: make([]uint64, len(common.ProxyLatencyBuckets)+1),
+		}
+		pm.domains[domain.Name] = dm
+	}
+	// VM may change (domain moved to another VM)
+	dm.VMName = domain.VMName
+	return dm
+}
+
+// AddRequest records a finished request
+func (pm *ProxyMetrics) AddRequest(domain *common.Domain, status int, bytesIn uint64, bytesOut uint64, latency time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	dm := pm.get(domain)
+	dm.Requests++
+	dm.StatusClasses[strconv.Itoa(status/100)+"xx"]++
+	dm.BytesIn += bytesIn
+	dm.BytesOut += bytesOut
+
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(common.ProxyLatencyBuckets, seconds)
+	dm.LatencyCounts[bucket]++
+	dm.LatencySum += seconds
+}
+
+// AddUpstreamError records an error while contacting the VM (or child proxy)
+func (pm *ProxyMetrics) AddUpstreamError(domain *common.Domain) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.get(domain).UpstreamErrors++
+}
+
+// AddRateLimited records a request rejected by a RateController
+func (pm *ProxyMetrics) AddRateLimited(domain *common.Domain) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.get(domain).RateLimited++
+}
+
+// GetDomains returns a copy of local domain metrics
+func (pm *ProxyMetrics) GetDomains() []*common.ProxyDomainMetrics {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	res := make([]*common.ProxyDomainMetrics, 0, len(pm.domains))
+	for _, dm := range pm.domains {
+		dup := *dm
+		dup.StatusClasses = make(map[string]uint64, len(dm.StatusClasses))
+		for class, count := range dm.StatusClasses {
+			dup.StatusClasses[class] = count
+		}
+		dup.LatencyCounts = append([]uint64(nil), dm.LatencyCounts...)
+		res = append(res, &dup)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Domain < res[j].Domain
+	})
+	return res
+}
+
+// SetChildMetrics stores metrics pushed by a child proxy
+func (pm *ProxyMetrics) SetChildMetrics(data *common.ProxyChainMetrics) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.children[data.ForwardTo] = &proxyChildMetrics{
+		received: time.Now(),
+		domains:  data.Domains,
+	}
+}
+
+// Write metrics using Prometheus text format
+func (pm *ProxyMetrics) Write(w io.Writer, rateControllers map[string]*RateController) error {
+	sources := map[string][]*common.ProxyDomainMetrics{
+		metricsSourceLocal: pm.GetDomains(),
+	}
+
+	pm.mutex.Lock()
+	for forwardTo, child := range pm.children {
+		if time.Since(child.received) > childMetricsMaxAge {
+			delete(pm.children, forwardTo)
+			continue
+		}
+		sources[forwardTo] = child.domains
+	}
+	pm.mutex.Unlock()
+
+	sourceNames := make([]string, 0, len(sources))
+	for name := range sources {
+		sourceNames = append(sourceNames, name)
+	}
+	sort.Strings(sourceNames)
+
+	mw := common.NewMetricsWriter(w)
+
+	// all samples of a metric must be consecutive, hence the repeated loops
+	each := func(cb func(dm *common.ProxyDomainMetrics, labels []string)) {
+		for _, source := range sourceNames {
+			for _, dm := range sources[source] {
+				cb(dm, []string{"source", source, "domain", dm.Domain, "vm", dm.VMName})
+			}
+		}
+	}
+
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		mw.Counter("mulch_proxy_requests_total", "Number of requests", float64(dm.Requests), labels...)
+	})
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		classes := make([]string, 0, len(dm.StatusClasses))
+		for class := range dm.StatusClasses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			mw.Counter("mulch_proxy_responses_total", "Number of responses by status class", float64(dm.StatusClasses[class]), append(labels, "class", class)...)
+		}
+	})
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		mw.Counter("mulch_proxy_received_bytes_total", "Request bodies size", float64(dm.BytesIn), labels...)
+	})
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		mw.Counter("mulch_proxy_sent_bytes_total", "Response bodies size", float64(dm.BytesOut), labels...)
+	})
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		mw.Counter("mulch_proxy_upstream_errors_total", "Number of errors while contacting the upstream server", float64(dm.UpstreamErrors), labels...)
+	})
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		mw.Counter("mulch_proxy_rate_limited_total", "Number of requests rejected by rate control (429)", float64(dm.RateLimited), labels...)
+	})
+	each(func(dm *common.ProxyDomainMetrics, labels []string) {
+		mw.Histogram("mulch_proxy_request_duration_seconds", "Request latency", common.ProxyLatencyBuckets, dm.LatencyCounts, dm.LatencySum, labels...)
+	})
+
+	profiles := make([]string, 0, len(rateControllers))
+	for name := range rateControllers {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	for _, name := range profiles {
+		mw.Counter("mulch_proxy_rate_profile_rejected_total", "Number of requests rejected by rate control profile (429)", float64(rateControllers[name].TooManyRequests()), "profile", name)
+	}
+
+	return mw.Err()
+}
+
+// metricsResponseWriter captures status code and response size
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  uint64
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += uint64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach Flusher and Hijacker
+// (needed for streaming and websockets)
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// metricsReadCounter counts request body size
+type metricsReadCounter struct {
+	io.ReadCloser
+	bytes uint64
+}
+
+func (r *metricsReadCounter) Read(data []byte) (int, error) {
+	n, err := r.ReadCloser.Read(data)
+	r.bytes += uint64(n)
+	return n, err
+}
+
+// ServeMetrics runs the metrics HTTP listener (foreground)
+func (proxy *ProxyServer) ServeMetrics(listen string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := proxy.Metrics.Write(w, proxy.RateControllers)
+		if err != nil {
+			proxy.Log.Errorf("metrics: %s", err)
+		}
+	})
+
+	proxy.Log.Infof("metrics server on %s", listen)
+	return http.ListenAndServe(listen, mux)
+}
+
+// push our metrics to our parent proxy
+func (app *App) pushParentMetrics() error {
+	data := common.ProxyChainMetrics{
+		Domains:   app.ProxyServer.Metrics.GetDomains(),
+		ForwardTo: app.Config.ChainChildURL.String(),
+	}
+
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{
+		Timeout: time.Duration(10 * time.Second),
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		app.Config.ChainParentURL.String()+"/metrics",
+		bytes.NewBuffer(dataJSON),
+	)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(PSKHeaderName, app.Config.ChainPSK)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("parent returned error %d", res.StatusCode)
+	}
+	return nil
+}
+
+// SchedulePushParentMetrics sends our metrics to our parent proxy
+// periodically
+func (app *App) SchedulePushParentMetrics() {
+	go func() {
+		for {
+			time.Sleep(ChildMetricsPushInterval)
+			err := app.pushParentMetrics()
+			if err != nil {
+				app.Log.Warningf("unable to push metrics to parent: %s", err)
+			}
+		}
+	}()
+}
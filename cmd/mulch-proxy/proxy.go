@@ -27,12 +27,18 @@ const (
 	ProtoHTTPS = "https"
 )
 
+// MaintenanceRetryAfter is the Retry-After header value (in seconds) of
+// the maintenance page
+const MaintenanceRetryAfter = 120
+
 // ProxyServer describe a Mulch proxy server
 type ProxyServer struct {
 	DomainDB        *DomainDatabase
 	Log             *Log
 	RequestList     *RequestList
 	RateControllers map[string]*RateController
+	Metrics         *ProxyMetrics
+	AccessLogger    *AccessLogger
 	HTTP            *http.Server
 	HTTPS           *http.Server
 	config          *ProxyServerParams
@@ -40,26 +46,29 @@ type ProxyServer struct {
 
 // ProxyServerParams is needed to create a ProxyServer
 type ProxyServerParams struct {
-	DirCache              string
-	Email                 string
-	ListenHTTP            string
-	ListenHTTPS           string
-	DirectoryURL          string
-	DomainDB              *DomainDatabase
-	ExtraCertsDB          *ExtraCertsDB
-	ErrorHTMLTemplateFile string
-	MulchdHTTPSDomain     string // (for mulchd)
-	ChainMode             int
-	ChainPSK              string
-	ChainDomain           string
-	ForceXForwardedFor    bool
-	HaveTrustedProxies    bool
-	TrustedProxies        map[string]bool
-	Log                   *Log
-	RequestList           *RequestList
-	RateControllers       map[string]*RateController
-	Trace                 bool
-	Debug                 bool
+	DirCache                    string
+	Email                       string
+	ListenHTTP                  string
+	ListenHTTPS                 string
+	DirectoryURL                string
+	DomainDB                    *DomainDatabase
+	ExtraCertsDB                *ExtraCertsDB
+	ErrorHTMLTemplateFile       string
+	MaintenanceHTMLTemplateFile string
+	ParkingHTMLFile             string
+	MulchdHTTPSDomain           string // (for mulchd)
+	ChainMode                   int
+	ChainPSK                    string
+	ChainDomain                 string
+	ForceXForwardedFor          bool
+	HaveTrustedProxies          bool
+	TrustedProxies              map[string]bool
+	Log                         *Log
+	RequestList                 *RequestList
+	RateControllers             map[string]*RateController
+	AccessLogger                *AccessLogger
+	Trace                       bool
+	Debug                       bool
 }
 
 var contextKeyID interface{} = 1
@@ -80,7 +89,8 @@ func (rt *errorHandlingRoundTripper) RoundTrip(req *http.Request) (*http.Respons
 	res, err := tr.RoundTrip(req)
 	if err != nil {
 		rt.ProxyServer.Log.Errorf("%s: %s", rt.Domain.Name, err)
-		body, errG := rt.ProxyServer.genErrorPage(502, err.Error())
+		rt.ProxyServer.Metrics.AddUpstreamError(rt.Domain)
+		body, errG := rt.ProxyServer.genErrorPage(rt.Domain, 502, err.Error())
 		if errG != nil {
 			rt.ProxyServer.Log.Errorf("Error with the error page: %s", errG)
 		}
@@ -102,6 +112,8 @@ func NewProxyServer(config *ProxyServerParams) *ProxyServer {
 		Log:             config.Log,
 		RequestList:     config.RequestList,
 		RateControllers: config.RateControllers,
+		Metrics:         NewProxyMetrics(),
+		AccessLogger:    config.AccessLogger,
 		config:          config,
 	}
 
@@ -156,7 +168,12 @@ func NewProxyServer(config *ProxyServerParams) *ProxyServer {
 	return &proxy
 }
 
-func (proxy *ProxyServer) genErrorPage(code int, message string) (string, error) {
+// custom error page of the domain (if any), or the generic error page
+func (proxy *ProxyServer) genErrorPage(domain *common.Domain, code int, message string) (string, error) {
+	if body, ok := proxy.getCustomErrorPage(domain, code); ok {
+		return body, nil
+	}
+
 	htmlBytes, err := os.ReadFile(proxy.config.ErrorHTMLTemplateFile)
 	if err != nil {
 		return err.Error(), err
@@ -172,6 +189,60 @@ func (proxy *ProxyServer) genErrorPage(code int, message string) (string, error)
 	return expanded, nil
 }
 
+// custom error pages are served "as is", they're usually provided by the
+// VM owner (see error_pages VM setting)
+func (proxy *ProxyServer) getCustomErrorPage(domain *common.Domain, code int) (string, bool) {
+	if domain == nil {
+		return "", false
+	}
+
+	filename, exists := domain.ErrorPages[code]
+	if !exists {
+		return "", false
+	}
+
+	htmlBytes, err := os.ReadFile(filename)
+	if err != nil {
+		proxy.Log.Errorf("Error with the %d custom error page of %s: %s", code, domain.Name, err)
+		return "", false
+	}
+	return string(htmlBytes), true
+}
+
+// maintenance page (custom 503 error page of the domain, if any), with
+// the error page as a fallback
+func (proxy *ProxyServer) genMaintenancePage(domain *common.Domain, host string) (string, error) {
+	if body, ok := proxy.getCustomErrorPage(domain, http.StatusServiceUnavailable); ok {
+		return body, nil
+	}
+
+	htmlBytes, err := os.ReadFile(proxy.config.MaintenanceHTMLTemplateFile)
+	if err != nil {
+		body, _ := proxy.genErrorPage(nil, http.StatusServiceUnavailable, "maintenance")
+		return body, err
+	}
+	html := string(htmlBytes)
+
+	variables := make(map[string]interface{})
+	variables["DOMAIN"] = host
+
+	expanded := common.StringExpandVariables(html, variables)
+
+	return expanded, nil
+}
+
+// parking page, for unknown hosts
+func (proxy *ProxyServer) serveParkingPage(res http.ResponseWriter) {
+	htmlBytes, err := os.ReadFile(proxy.config.ParkingHTMLFile)
+	if err != nil {
+		proxy.Log.Errorf("Error with the parking page: %s", err)
+		htmlBytes = []byte(http.StatusText(http.StatusNotFound))
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(http.StatusNotFound)
+	res.Write(htmlBytes)
+}
+
 func (proxy *ProxyServer) hostPolicy(ctx context.Context, host string) error {
 	if host == proxy.config.MulchdHTTPSDomain && proxy.config.MulchdHTTPSDomain != "" {
 		// proxy.Log.Trace("hostPolicy OK for MulchdHTTPSDomain")
@@ -288,8 +359,12 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 	}
 
 	domain, err := proxy.DomainDB.GetByName(host)
+	if err != nil && proxy.config.ParkingHTMLFile != "" {
+		proxy.serveParkingPage(res)
+		return
+	}
 	if err != nil {
-		body, errG := proxy.genErrorPage(500, err.Error())
+		body, errG := proxy.genErrorPage(nil, 500, err.Error())
 		if errG != nil {
 			proxy.Log.Errorf("Error with the error page: %s", errG)
 		}
@@ -299,6 +374,30 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	start := time.Now()
+	metricsRes := &metricsResponseWriter{ResponseWriter: res, status: http.StatusOK}
+	metricsBody := &metricsReadCounter{ReadCloser: req.Body}
+	res = metricsRes
+	req.Body = metricsBody
+
+	// chained domains are logged by the child proxy
+	var accessLogEntry *common.AccessLogEntry
+	if proxy.AccessLogger != nil && !domain.Chained && domain.VMName != "" {
+		accessLogEntry = newAccessLogEntry(req, host, fromParent, start)
+	}
+
+	defer func() {
+		duration := time.Since(start)
+		proxy.Metrics.AddRequest(domain, metricsRes.status, metricsBody.bytes, metricsRes.bytes, duration)
+
+		if accessLogEntry != nil {
+			accessLogEntry.Status = metricsRes.status
+			accessLogEntry.Size = metricsRes.bytes
+			accessLogEntry.Duration = duration.Seconds()
+			proxy.AccessLogger.Add(domain.VMName, accessLogEntry)
+		}
+	}()
+
 	// rate limiting
 	if !fromParent {
 		rc, ok := proxy.RateControllers[domain.RateProfile]
@@ -315,11 +414,12 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 			}
 
 			if !allowed {
-				body, errG := proxy.genErrorPage(429, "Too many requests")
+				body, errG := proxy.genErrorPage(domain, 429, "Too many requests")
 				if errG != nil {
 					proxy.Log.Errorf("Error with the error page: %s", errG)
 				}
 				proxy.Log.Errorf("Error 429 {%d} (%s) for %s", id, reason, req.Host)
+				proxy.Metrics.AddRateLimited(domain)
 				res.WriteHeader(429)
 				res.Write([]byte(body))
 				return
@@ -357,7 +457,24 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	// VM is down, rebuilding or in maintenance mode
+	if domain.Maintenance {
+		body, errG := proxy.genMaintenancePage(domain, host)
+		if errG != nil {
+			proxy.Log.Errorf("Error with the maintenance page: %s", errG)
+		}
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.Header().Set("Retry-After", strconv.Itoa(MaintenanceRetryAfter))
+		res.Header().Set("Cache-Control", "no-store")
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte(body))
+		return
+	}
+
 	// now, do our proxy job
+	if accessLogEntry != nil {
+		accessLogEntry.Upstream = domain.TargetURL
+	}
 	proxy.serveReverseProxy(domain, proto, res, req, fromParent)
 
 }
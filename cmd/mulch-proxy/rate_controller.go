@@ -54,6 +54,11 @@ func NewRateController(config RateControllerConfig) *RateController {
 	}
 }
 
+// TooManyRequests returns the number of rejected requests (429)
+func (rc *RateController) TooManyRequests() uint64 {
+	return atomic.LoadUint64(&rc.tooManyRequestsCounter)
+}
+
 func (rc *RateController) IsActive() bool {
 	return rc.config.ConcurrentMaxRequests > 0 || rc.config.RateEnable
 }
@@ -0,0 +1,19 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// alertCmd represents the "alert" command
+var alertCmd = &cobra.Command{
+	Use:   "alert",
+	Short: "Manage alerts",
+	Long: `Alerts are sent by mulchd for background events (auto-rebuild
+failures, unhealthy VMs, …) using alert scripts and alert channels
+(see [[alert]] in mulchd.toml).
+`,
+}
+
+func init() {
+	rootCmd.AddCommand(alertCmd)
+}
@@ -0,0 +1,35 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// alertTestCmd represents the "alert test" command
+var alertTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Send a test alert",
+	Long: `Send a test alert to all alert channels, including alert scripts,
+ignoring routing rules, deduplication and throttling.
+
+Examples:
+  mulch alert test
+  mulch alert test --channel ops_mail --severity critical
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		channel, _ := cmd.Flags().GetString("channel")
+		severity, _ := cmd.Flags().GetString("severity")
+		call := client.GlobalAPI.NewCall("POST", "/alert/test", map[string]string{
+			"channel":  channel,
+			"severity": severity,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	alertCmd.AddCommand(alertTestCmd)
+	alertTestCmd.Flags().String("channel", "", "only this channel (\"scripts\" for alert scripts)")
+	alertTestCmd.Flags().String("severity", "info", "severity (info, warning, critical)")
+}
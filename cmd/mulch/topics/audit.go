@@ -0,0 +1,105 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/spf13/cobra"
+)
+
+var auditFlagFailed bool
+
+// auditCmd represents the "audit" command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Show API calls audit log",
+	Long: `Show authenticated API calls: API key, method, path, main
+parameters (action, revision, force), result and duration.
+
+Examples:
+  mulch audit --since 3d
+  mulch audit --key john@example.com --failed
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, _ []string) {
+		key, _ := cmd.Flags().GetString("key")
+		since, _ := cmd.Flags().GetString("since")
+		auditFlagFailed, _ = cmd.Flags().GetBool("failed")
+
+		sinceDuration, err := client.ParseDuration(since)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if sinceDuration == 0 {
+			log.Fatal("invalid since duration")
+		}
+
+		call := client.GlobalAPI.NewCall("GET", "/audit", map[string]string{
+			"key":   key,
+			"since": client.DurationAsSecondsString(sinceDuration),
+		})
+		call.JSONCallback = auditCB
+		call.Do()
+	},
+}
+
+func auditCB(reader io.Reader, _ http.Header) {
+	var data []common.APIAuditEntry
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	strData := [][]string{}
+	for _, line := range data {
+		if auditFlagFailed && line.Success {
+			continue
+		}
+
+		var params []string
+		for name, val := range line.Params {
+			params = append(params, name+"="+val)
+		}
+		sort.Strings(params)
+
+		result := "OK"
+		if !line.Success {
+			result = "FAILED (" + strconv.Itoa(line.Status) + ")"
+		}
+
+		strData = append(strData, []string{
+			line.Time.Format("2006-01-02 15:04:05"),
+			line.Key,
+			line.IP,
+			line.Method + " " + line.Path,
+			strings.Join(params, " "),
+			result,
+			line.Duration.Truncate(time.Millisecond).String(),
+		})
+	}
+
+	if len(strData) == 0 {
+		fmt.Printf("No result.\n")
+		return
+	}
+
+	headers := []string{"Date", "Key", "IP", "Call", "Params", "Result", "Duration"}
+	client.RenderTable(headers, strData)
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.Flags().StringP("key", "k", "", "only show calls from this API key (comment)")
+	auditCmd.Flags().String("since", "24h", "show calls since this duration (ex: 3h, 2d)")
+	auditCmd.Flags().BoolP("failed", "f", false, "only show failed calls")
+}
@@ -120,11 +120,11 @@ __internal_migrate() {
 
 __mulch_custom_func() {
     case ${last_command} in
-        mulch_vm_create)
+        mulch_vm_create | mulch_vm_check)
             __internal_list_toml_files
             return
             ;;
-        mulch_ssh | mulch_vm_backup | mulch_vm_config | mulch_vm_delete | mulch_vm_infos | mulch_vm_lock | mulch_vm_rebuild | mulch_vm_redefine | mulch_vm_start | mulch_vm_stop | mulch_vm_unlock | mulch_vm_activate | mulch_vm_deactivate | mulch_log | mulch_vm_console | mulch_vm_restart | mulch_vm_load | mulch_trust_forward | mulch_trust_list | mulch_trust_remove)
+        mulch_ssh | mulch_vm_backup | mulch_vm_config | mulch_vm_delete | mulch_vm_infos | mulch_vm_lock | mulch_vm_rebuild | mulch_vm_redefine | mulch_vm_start | mulch_vm_stop | mulch_vm_unlock | mulch_vm_activate | mulch_vm_deactivate | mulch_log | mulch_vm_console | mulch_vm_restart | mulch_vm_load | mulch_vm_history | mulch_vm_access-log | mulch_vm_stats | mulch_vm_maintenance | mulch_vm_clone | mulch_trust_forward | mulch_trust_list | mulch_trust_remove)
             __internal_list_vms
             return
             ;;
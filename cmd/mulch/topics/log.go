@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/OnitiFR/mulch/cmd/mulch/client"
 	"github.com/OnitiFR/mulch/common"
@@ -13,6 +14,8 @@ import (
 )
 
 const logCmdDefaultLines = 40
+const logCmdSearchDefaultLines = 5000
+const logCmdSearchDefaultSince = "24h"
 
 var logCmdWithTarget = false
 var logCmdTimestamp common.MessageTimestamp
@@ -27,21 +30,37 @@ the client. You can choose a specific target ("vm").
 Message timestamps are always displayed with this command.
 (--time is forced, in other words.)
 
+Older logs are stored on the server disk, use --since, --until
+or --type to search them (full date is then displayed).
+
 Examples:
   mulch log -f
   mulch log my_vm
-  mulch log --trace`,
+  mulch log --trace
+  mulch log --vm shop --since 2d --type ERROR,FAILURE`,
 	Args:    cobra.MaximumNArgs(1),
 	Aliases: []string{"logs"},
 	Run: func(cmd *cobra.Command, args []string) {
 
 		follow, _ := cmd.Flags().GetBool("follow")
 		lines, _ := cmd.Flags().GetInt("lines")
+		vm, _ := cmd.Flags().GetString("vm")
+		since, _ := cmd.Flags().GetString("since")
+		until, _ := cmd.Flags().GetString("until")
+		types, _ := cmd.Flags().GetString("type")
+
 		target := common.MessageAllTargets
 		if len(args) > 0 {
 			target = args[0]
 			logCmdWithTarget = true
 		}
+		if vm != "" {
+			if len(args) > 0 {
+				log.Fatal("--vm and target argument are mutually exclusive")
+			}
+			target = vm
+			logCmdWithTarget = true
+		}
 
 		// force time as a minimum
 		logCmdTimestamp = client.GlobalConfig.Time
@@ -49,12 +68,54 @@ Examples:
 			logCmdTimestamp = common.MessagePrintTime
 		}
 
-		call := client.GlobalAPI.NewCall("GET", "/log/history", map[string]string{
-			"target": target,
-			"lines":  strconv.Itoa(lines),
-		})
-		call.JSONCallback = logCmdHistoryCB
-		call.Do()
+		search := since != "" || until != "" || types != ""
+
+		if search {
+			if since == "" {
+				since = logCmdSearchDefaultSince
+			}
+			sinceDuration, err := client.ParseDuration(since)
+			if err != nil {
+				log.Fatalf("--since: %s", err)
+			}
+			if sinceDuration == 0 {
+				log.Fatal("--since: invalid duration")
+			}
+			untilDuration, err := client.ParseDuration(until)
+			if err != nil {
+				log.Fatalf("--until: %s", err)
+			}
+
+			if !cmd.Flags().Lookup("lines").Changed {
+				lines = logCmdSearchDefaultLines
+			}
+
+			// a search may span multiple days
+			if logCmdTimestamp < common.MessagePrintDateTime {
+				logCmdTimestamp = common.MessagePrintDateTime
+			}
+
+			params := map[string]string{
+				"target": target,
+				"lines":  strconv.Itoa(lines),
+				"since":  client.DurationAsSecondsString(sinceDuration),
+				"types":  strings.ToUpper(types),
+			}
+			if until != "" {
+				params["until"] = client.DurationAsSecondsString(untilDuration)
+			}
+
+			call := client.GlobalAPI.NewCall("GET", "/log/search", params)
+			call.JSONCallback = logCmdHistoryCB
+			call.Do()
+		} else {
+			call := client.GlobalAPI.NewCall("GET", "/log/history", map[string]string{
+				"target": target,
+				"lines":  strconv.Itoa(lines),
+			})
+			call.JSONCallback = logCmdHistoryCB
+			call.Do()
+		}
 
 		if follow {
 			call2 := client.GlobalAPI.NewCall("GET", "/log", map[string]string{
@@ -84,4 +145,8 @@ func init() {
 	rootCmd.AddCommand(logCmd)
 	logCmd.Flags().IntP("lines", "n", logCmdDefaultLines, "display n lines")
 	logCmd.Flags().BoolP("follow", "f", false, "follow live log")
+	logCmd.Flags().String("vm", "", "only show logs of this VM (same as target argument)")
+	logCmd.Flags().String("since", "", "search stored logs since this duration (ex: 3h, 2d)")
+	logCmd.Flags().String("until", "", "search stored logs until this duration (ex: 1d)")
+	logCmd.Flags().String("type", "", "only show these message types (ex: ERROR,FAILURE)")
 }
@@ -0,0 +1,18 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// opCmd represents the "op" command
+var opCmd = &cobra.Command{
+	Use:   "op",
+	Short: "Running operations",
+	Long: `List and cancel operations running on the server (backups, rebuilds,
+migrations, …)
+`,
+}
+
+func init() {
+	rootCmd.AddCommand(opCmd)
+}
@@ -0,0 +1,30 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// opCancelCmd represents the "op cancel" command
+var opCancelCmd = &cobra.Command{
+	Use:   "cancel <id>",
+	Short: "Cancel a running operation",
+	Long: `Cancel a running operation (see 'op list' for IDs).
+
+Only backups, restores, rebuilds, VM creations (including clones and
+seed builds) and migrations can be canceled. The operation is aborted on its
+next step, and its usual rollback is done (backup disk detached,
+new VM deleted, …). See the VM log to follow the cancellation.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/operation/"+args[0], map[string]string{
+			"action": "cancel",
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	opCmd.AddCommand(opCancelCmd)
+}
@@ -0,0 +1,68 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/spf13/cobra"
+)
+
+// opListCmd represents the "op list" command
+var opListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List running operations",
+	// Long: ``,
+	Args: cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		call := client.GlobalAPI.NewCall("GET", "/operation", map[string]string{})
+		call.JSONCallback = opListCB
+		call.Do()
+	},
+}
+
+func opListCB(reader io.Reader, _ http.Header) {
+	var data []common.APIOperation
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No running operation.\n")
+		return
+	}
+
+	strData := [][]string{}
+	for _, line := range data {
+		status := "-"
+		if line.Cancellable {
+			status = "cancellable"
+		}
+		if line.CanceledBy != "" {
+			status = "canceled by " + line.CanceledBy
+		}
+
+		strData = append(strData, []string{
+			line.ID,
+			line.Origin,
+			line.Action,
+			line.Ressource + " " + line.RessourceName,
+			time.Since(line.StartTime).Truncate(time.Second).String(),
+			status,
+		})
+	}
+
+	headers := []string{"ID", "Origin", "Action", "Ressource", "Since", "Status"}
+	client.RenderTable(headers, strData)
+}
+
+func init() {
+	opCmd.AddCommand(opListCmd)
+}
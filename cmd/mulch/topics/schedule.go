@@ -0,0 +1,17 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// scheduleCmd represents the "schedule" command
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Auto-rebuild scheduling",
+	Long: `Show and control VM auto-rebuilds (see auto_rebuild VM setting).
+`,
+}
+
+func init() {
+	rootCmd.AddCommand(scheduleCmd)
+}
@@ -0,0 +1,74 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// scheduleListCmd represents the "schedule list" command
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List next planned auto-rebuilds",
+	// Long: ``,
+	Args: cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		call := client.GlobalAPI.NewCall("GET", "/schedule", map[string]string{})
+		call.JSONCallback = scheduleListCB
+		call.Do()
+	},
+}
+
+func scheduleListCB(reader io.Reader, _ http.Header) {
+	var data common.APISchedule
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if !data.PausedUntil.IsZero() {
+		yellow := color.New(color.FgHiYellow).SprintFunc()
+		fmt.Println(yellow(fmt.Sprintf("auto-rebuilds are paused until %s", data.PausedUntil.Format("2006-01-02 15:04"))))
+	}
+
+	if len(data.Entries) == 0 {
+		fmt.Printf("Currently, no VM has an auto_rebuild setting.\n")
+		return
+	}
+
+	strData := [][]string{}
+	for _, line := range data.Entries {
+		next := "-"
+		if !line.Next.IsZero() {
+			next = line.Next.Format("2006-01-02 15:04")
+			if line.Next.Before(time.Now()) {
+				next += " (overdue)"
+			}
+		}
+
+		strData = append(strData, []string{
+			line.VMName,
+			line.Schedule,
+			line.LastRebuild.Format("2006-01-02 15:04"),
+			next,
+			line.Status,
+		})
+	}
+
+	headers := []string{"VM", "Schedule", "Last Rebuild", "Next Run", "Status"}
+	client.RenderTable(headers, strData)
+	fmt.Printf("max concurrent rebuilds: %d\n", data.MaxConcurrent)
+}
+
+func init() {
+	scheduleCmd.AddCommand(scheduleListCmd)
+}
@@ -0,0 +1,43 @@
+package topics
+
+import (
+	"log"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// schedulePauseCmd represents the "schedule pause" command
+var schedulePauseCmd = &cobra.Command{
+	Use:   "pause <duration>",
+	Short: "Pause all auto-rebuilds",
+	Long: `Pause VM auto-rebuilds for a given duration (running rebuilds are
+not affected)
+
+Allowed units:  h, d, y (hours, days, years)
+Allowed values: any positive integer
+
+Give an empty string (or 0) to remove the pause.
+
+Examples:
+	mulch schedule pause 12h
+	mulch schedule pause 0
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		dur, err := client.ParseDuration(args[0])
+		if err != nil {
+			log.Fatalf("unable to parse duration: %s", err)
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/schedule", map[string]string{
+			"action":   "pause",
+			"duration": client.DurationAsSecondsString(dur),
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	scheduleCmd.AddCommand(schedulePauseCmd)
+}
@@ -125,7 +125,8 @@ func statusDisplay(reader io.Reader, headers http.Header) {
 	fmt.Printf("Operations: %d\n", len(data.Operations))
 	for _, op := range data.Operations {
 		since := referenceTime.Sub(op.StartTime)
-		fmt.Printf(" - from %s: %s %s %s (%s)\n",
+		fmt.Printf(" - [%s] from %s: %s %s %s (%s)\n",
+			op.ID,
 			op.Origin,
 			op.Action,
 			op.Ressource,
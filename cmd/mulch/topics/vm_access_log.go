@@ -0,0 +1,45 @@
+package topics
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/spf13/cobra"
+)
+
+// vmAccessLogCmd represents the "vm access-log" command
+var vmAccessLogCmd = &cobra.Command{
+	Use:   "access-log <vm-name>",
+	Short: "Show VM HTTP access log",
+	Long: `Show HTTP requests served by mulch-proxy for this VM (all domains).
+
+The proxy_access_log setting must be enabled on the server. The format
+(combined or JSON) is also defined by the server.
+
+Use -f to wait for new requests (Ctrl+C to stop).
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		follow, _ := cmd.Flags().GetBool("follow")
+		lines, _ := cmd.Flags().GetInt("lines")
+
+		params := map[string]string{
+			"lines": strconv.Itoa(lines),
+		}
+		if follow {
+			params["follow"] = common.TrueStr
+		}
+
+		call := client.GlobalAPI.NewCall("GET", "/vm/access-log/"+args[0], params)
+		call.DestStream = os.Stdout
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmAccessLogCmd)
+	vmAccessLogCmd.Flags().BoolP("follow", "f", false, "wait for new requests")
+	vmAccessLogCmd.Flags().IntP("lines", "n", 100, "number of lines to show")
+}
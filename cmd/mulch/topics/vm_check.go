@@ -0,0 +1,103 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// vmCheckCmd represents the "vm check" command
+var vmCheckCmd = &cobra.Command{
+	Use:   "check <config.toml>",
+	Short: "Check a VM config file without creating anything",
+	Long: `Check a VM config file on the server, without creating anything.
+
+All problems are reported (scripts, secrets, seed, domain and
+port conflicts, storage…), not only the first one. Exit status is 1
+if the config has at least one error, so this command can be used in
+CI pipelines. See also 'vm create --dry-run'.
+
+Example:
+  mulch vm check shop.toml --var branch=dev
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		newRevision, _ := cmd.Flags().GetBool("new-revision")
+		vars, _ := cmd.Flags().GetStringArray("var")
+		vmCheckConfig(args[0], newRevision, vars)
+	},
+}
+
+func vmCheckConfig(filename string, newRevision bool, vars []string) {
+	call := client.GlobalAPI.NewCall("POST", "/vm/validate", map[string]string{
+		"allow_new_revision": strconv.FormatBool(newRevision),
+		"vars":               strings.Join(vars, "\n"),
+	})
+	err := call.AddFile("config", filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	call.JSONCallback = vmCheckCB
+	call.Do()
+}
+
+func vmCheckCB(reader io.Reader, _ http.Header) {
+	var data common.APIVMValidation
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	name := data.Name
+	if name == "" {
+		name = data.Filename
+	}
+
+	if len(data.Problems) > 0 {
+		red := color.New(color.FgHiRed).SprintFunc()
+		yellow := color.New(color.FgHiYellow).SprintFunc()
+
+		strData := [][]string{}
+		for _, line := range data.Problems {
+			severity := yellow(line.Severity)
+			if line.Severity == common.APIVMValidationError {
+				severity = red(line.Severity)
+			}
+			setting := line.Setting
+			if setting == "" {
+				setting = "-"
+			}
+			strData = append(strData, []string{
+				severity,
+				setting,
+				line.Message,
+			})
+		}
+
+		headers := []string{"Severity", "Setting", "Message"}
+		client.RenderTable(headers, strData)
+	}
+
+	if !data.Valid {
+		fmt.Printf("%s: invalid config\n", name)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: config is valid\n", name)
+}
+
+func init() {
+	vmCmd.AddCommand(vmCheckCmd)
+	vmCheckCmd.Flags().BoolP("new-revision", "n", false, "allow a new revision with the same name")
+	vmCheckCmd.Flags().StringArray("var", []string{}, "set a config variable (key=value, repeatable)")
+}
@@ -0,0 +1,49 @@
+package topics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmCloneCmd represents the "vm clone" command
+var vmCloneCmd = &cobra.Command{
+	Use:   "clone <vm-name> <new-vm-name>",
+	Short: "Clone a VM under a new name",
+	Long: `Create a new VM from a live VM: a transient backup of the source VM
+is created and restored in the new VM.
+
+The config of the source VM is used, with a new name. Domains are replaced
+by --domain ones (none by default, since they would conflict with the
+source VM), and redirects are removed. Ports are kept, unless --port is used.
+
+Example:
+  mulch vm clone prod-shop staging-shop -d staging.shop.example.com
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		domains, _ := cmd.Flags().GetStringSlice("domain")
+		ports, _ := cmd.Flags().GetStringSlice("port")
+		keepPorts := !cmd.Flags().Changed("port")
+
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":     "clone",
+			"revision":   revision,
+			"clone_name": args[1],
+			"domains":    strings.Join(domains, ","),
+			"ports":      strings.Join(ports, ","),
+			"keep_ports": strconv.FormatBool(keepPorts),
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmCloneCmd)
+	vmCloneCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmCloneCmd.Flags().StringSliceP("domain", "d", []string{}, "domain for the new VM (repeatable)")
+	vmCloneCmd.Flags().StringSliceP("port", "p", []string{}, "port for the new VM (repeatable, replaces source ports)")
+}
@@ -3,6 +3,7 @@ package topics
 import (
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/OnitiFR/mulch/cmd/mulch/client"
 	"github.com/spf13/cobra"
@@ -18,16 +19,39 @@ See sample-vm.toml for an example, or get config from an existing
 VM using 'vm config'.
 
 You can restore data in this new VM from an existing backup (-r) or
-from another VM (-R).
+from another running VM (-R), using a transient backup. This can also be
+declared in the config file, with restore_backup = "vm:source-vm".
+
+Config file can use variables, like ${USER} (your API key), ${name} (VM
+name) or any variable given with --var, in strings. Default values can be
+declared in the file:
+  variables = { branch = "main" }
+  name = "${USER}-shop"
+  domains = ["${name}.example.com"]
+
+With --dry-run, the config is only checked (see 'vm check').
+
+Example:
+  mulch vm create shop.toml --var branch=dev
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		restore, _ := cmd.Flags().GetString("restore")
-		restoreVM, _ := cmd.Flags().GetString("restore-vm")
+		restoreVM, _ := cmd.Flags().GetString("restore-from-vm")
+		if restoreVM == "" {
+			restoreVM, _ = cmd.Flags().GetString("restore-vm")
+		}
 		newRevision, _ := cmd.Flags().GetBool("new-revision")
 		inactive, _ := cmd.Flags().GetBool("inactive")
 		keepOnFailure, _ := cmd.Flags().GetBool("keep-on-failure")
 		lock, _ := cmd.Flags().GetBool("lock")
+		vars, _ := cmd.Flags().GetStringArray("var")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		if dryRun {
+			vmCheckConfig(args[0], newRevision, vars)
+			return
+		}
 
 		call := client.GlobalAPI.NewCall("POST", "/vm", map[string]string{
 			"restore":            restore,
@@ -36,6 +60,7 @@ from another VM (-R).
 			"inactive":           strconv.FormatBool(inactive),
 			"keep_on_failure":    strconv.FormatBool(keepOnFailure),
 			"lock":               strconv.FormatBool(lock),
+			"vars":               strings.Join(vars, "\n"),
 		})
 		err := call.AddFile("config", args[0])
 		if err != nil {
@@ -51,11 +76,16 @@ func init() {
 	vmCreateCmd.Flags().StringP("restore", "r", "", "restore from a backup")
 	vmCreateCmd.MarkFlagCustom("restore", "__internal_list_backups")
 
-	vmCreateCmd.Flags().StringP("restore-vm", "R", "", "restore from a running VM")
-	vmCreateCmd.MarkFlagCustom("restore-vm", "__internal_list_vms")
+	vmCreateCmd.Flags().StringP("restore-from-vm", "R", "", "restore from a running VM")
+	vmCreateCmd.MarkFlagCustom("restore-from-vm", "__internal_list_vms")
+
+	vmCreateCmd.Flags().String("restore-vm", "", "restore from a running VM")
+	vmCreateCmd.Flags().MarkDeprecated("restore-vm", "use --restore-from-vm instead")
 
 	vmCreateCmd.Flags().BoolP("new-revision", "n", false, "allow a new revision with the same name")
 	vmCreateCmd.Flags().BoolP("inactive", "i", false, "do not set this instance as active")
 	vmCreateCmd.Flags().BoolP("keep-on-failure", "k", false, "keep VM on script failure (useful for debug)")
 	vmCreateCmd.Flags().BoolP("lock", "l", false, "lock VM after creation")
+	vmCreateCmd.Flags().StringArray("var", []string{}, "set a config variable (key=value, repeatable)")
+	vmCreateCmd.Flags().Bool("dry-run", false, "only check config, do not create anything")
 }
@@ -0,0 +1,85 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/spf13/cobra"
+)
+
+// vmHistoryCmd represents the "vm history" command
+var vmHistoryCmd = &cobra.Command{
+	Use:   "history <vm-name>",
+	Short: "Show VM lifecycle history",
+	Long: `Show lifecycle events of a VM (all revisions): creation, rebuilds,
+backups, restores, redefines, migrations, locks, and failures, with
+the API key that triggered them.
+
+History is kept when the VM is deleted.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("GET", "/vm/history/"+args[0], map[string]string{})
+		call.JSONCallback = vmHistoryCB
+		call.Do()
+	},
+}
+
+func vmHistoryCB(reader io.Reader, _ http.Header) {
+	var data []common.APIVMHistoryEvent
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No history for this VM.\n")
+		return
+	}
+
+	strData := [][]string{}
+	for _, line := range data {
+		revision := "-"
+		if line.Revision >= 0 {
+			revision = strconv.Itoa(line.Revision)
+		}
+
+		duration := ""
+		if line.Duration > 0 {
+			duration = line.Duration.Truncate(time.Second).String()
+		}
+		if line.Downtime > 0 {
+			duration += " (down " + line.Downtime.Truncate(time.Second).String() + ")"
+		}
+
+		status := "OK"
+		if line.Error != "" {
+			status = "FAILED: " + line.Error
+		}
+
+		strData = append(strData, []string{
+			line.Time.Format("2006-01-02 15:04"),
+			revision,
+			line.Type,
+			line.Author,
+			line.Message,
+			duration,
+			status,
+		})
+	}
+
+	headers := []string{"Date", "Rev", "Event", "Author", "Details", "Duration", "Status"}
+	client.RenderTable(headers, strData)
+}
+
+func init() {
+	vmCmd.AddCommand(vmHistoryCmd)
+}
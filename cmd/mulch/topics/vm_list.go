@@ -76,16 +76,27 @@ func vmListCB(reader io.Reader, _ http.Header) {
 				name = grey(name)
 			}
 
+			health := line.Health
+			switch line.Health {
+			case "healthy":
+				health = green(line.Health)
+			case "unhealthy":
+				health = red(line.Health)
+			case "":
+				health = "-"
+			}
+
 			strData = append(strData, []string{
 				name,
 				strconv.Itoa(line.Revision),
 				state,
+				health,
 				locked,
 				yellow(line.WIP),
 			})
 		}
 
-		headers := []string{"Name", "Rev", "State", "Locked", "Operation"}
+		headers := []string{"Name", "Rev", "State", "Health", "Locked", "Operation"}
 		client.RenderTable(headers, strData)
 	}
 }
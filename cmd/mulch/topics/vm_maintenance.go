@@ -0,0 +1,36 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmMaintenanceCmd represents the "vm maintenance" command
+var vmMaintenanceCmd = &cobra.Command{
+	Use:   "maintenance <vm-name> on|off",
+	Short: "Enable or disable VM maintenance mode",
+	Long: `Enable or disable maintenance mode of a VM (by its name). While in
+maintenance mode, mulch-proxy serves a maintenance page (503) for all VM
+domains.
+
+Maintenance mode is also automatic when the VM is stopped, rebuilt
+or migrated.
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":   "maintenance",
+			"state":    args[1],
+			"revision": revision,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmMaintenanceCmd)
+	vmMaintenanceCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -14,12 +14,14 @@ var vmMigrateCmd = &cobra.Command{
 	Long: `Migrate a VM from this mulchd instance to another one ("destination").
 
 Any pre-existing active VM will be deactivated in favor of the migrated VM.
-Lock status will be preserved.
+Lock status will be preserved. Data disks are copied to the destination,
+the source VM is stopped during this copy.
 
 WARNING: --keep-source-active is for special cases:
 - maintains service during migration
 - source VM data may change AFTER migration backup, you may lose data
 - won't work with a common frontal mulch-proxy (both VM can't be active at the same time)
+- not available for VMs with data disks
 `,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
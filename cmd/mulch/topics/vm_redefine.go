@@ -3,6 +3,7 @@ package topics
 import (
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/OnitiFR/mulch/cmd/mulch/client"
 	"github.com/spf13/cobra"
@@ -17,6 +18,13 @@ var vmRedefineCmd = &cobra.Command{
 The VM will use its new configuration on next rebuild, with a few exceptions:
   * domain names and ports are immediately updated
   * environment variables and secrets only require a VM restart
+  * cpu_count and ram_size are applied live, up to cpu_count_max and
+    ram_size_max, and need a VM restart above those limits
+  * disk_size increase is applied live (root partition and filesystem
+    are grown), a decrease requires a rebuild
+
+A report of changes is shown, with how each one is applied. Use --plan
+to only show this report, without redefining anything.
 
 WARNING: consider this command dangerous! Your new backup scripts may
 not match your old content, for instance.
@@ -25,6 +33,8 @@ Remember: you can get current VM configuration file using "vm config <vm-name>",
 it's an easy way to get and modify config before VM redefinition.
 
 When VM name is omitted, it will be read from the config file.
+
+Config variables are expanded as with "vm create" (see --var).
 `,
 	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -38,6 +48,9 @@ When VM name is omitted, it will be read from the config file.
 				log.Fatal(err)
 			}
 			vmName = NewVMConfigFromFile.Name
+			if strings.Contains(vmName, "${") {
+				log.Fatal("VM name uses variables, please give it explicitly")
+			}
 		} else {
 			vmName = args[0]
 			configFilename = args[1]
@@ -45,11 +58,15 @@ When VM name is omitted, it will be read from the config file.
 
 		force, _ := cmd.Flags().GetBool("force")
 		revision, _ := cmd.Flags().GetString("revision")
+		vars, _ := cmd.Flags().GetStringArray("var")
+		plan, _ := cmd.Flags().GetBool("plan")
 
 		call := client.GlobalAPI.NewCall("POST", "/vm/"+vmName, map[string]string{
 			"action":   "redefine",
 			"force":    strconv.FormatBool(force),
 			"revision": revision,
+			"vars":     strings.Join(vars, "\n"),
+			"plan":     strconv.FormatBool(plan),
 		})
 		err := call.AddFile("config", configFilename)
 		if err != nil {
@@ -63,4 +80,6 @@ func init() {
 	vmCmd.AddCommand(vmRedefineCmd)
 	vmRedefineCmd.Flags().BoolP("force", "f", false, "force redefine on a locked VM")
 	vmRedefineCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmRedefineCmd.Flags().StringArray("var", []string{}, "set a config variable (key=value, repeatable)")
+	vmRedefineCmd.Flags().Bool("plan", false, "show changes, do not redefine anything")
 }
@@ -24,6 +24,7 @@ Some examples:
   mulch vm search 'has_tag("wp-cli")'
   mulch vm search 'has_script("prepare", "deb-lamp.sh")'
   mulch vm search 'init_date < "2022-12-30"'
+  mulch vm search 'health != "" && !healthy()'
 
 List of variables:
  - name (string)
@@ -38,6 +39,7 @@ List of variables:
  - ram_gb (float)
  - disk_gb (float)
  - hostname (string)
+ - health (string, healthy/unhealthy/unknown, empty if no healthcheck)
 
 List of functions:
  - like(string) bool
@@ -46,6 +48,7 @@ List of functions:
  - has_script(string, string) bool (arg1: install|prepare|backup|restore, arg2: script base name)
  - has_action(string) bool
  - has_tag(string) bool
+ - healthy() bool
 
 `,
 	Args: cobra.ExactArgs(1),
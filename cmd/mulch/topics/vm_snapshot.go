@@ -0,0 +1,21 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// vmSnapshotCmd represents the 'vm snapshot' command
+var vmSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "VM snapshots management",
+	Long: `Manage VM snapshots.
+
+Snapshots are instant and crash-consistent rollback points of the VM disk
+(and memory, if the VM is running), stored by libvirt inside the VM disk.
+They are lost when the VM is rebuilt or deleted, they're not backups!
+`,
+}
+
+func init() {
+	vmCmd.AddCommand(vmSnapshotCmd)
+}
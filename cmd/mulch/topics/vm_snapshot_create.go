@@ -0,0 +1,37 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmSnapshotCreateCmd represents the "vm snapshot create" command
+var vmSnapshotCreateCmd = &cobra.Command{
+	Use:   "create <vm-name> [snapshot-name]",
+	Short: "Create a VM snapshot",
+	Long: `Create a snapshot of a VM (by its name). If no snapshot name
+is given, one will be generated.
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		snapshotName := ""
+		if len(args) > 1 {
+			snapshotName = args[1]
+		}
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":          "snapshot",
+			"snapshot_action": "create",
+			"snapshot_name":   snapshotName,
+			"revision":        revision,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmSnapshotCmd.AddCommand(vmSnapshotCreateCmd)
+	vmSnapshotCreateCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -0,0 +1,37 @@
+package topics
+
+import (
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmSnapshotDeleteCmd represents the "vm snapshot delete" command
+var vmSnapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <vm-name> <snapshot-name>",
+	Short: "Delete a VM snapshot",
+	Long: `Delete a VM snapshot.
+
+See 'vm snapshot list' for snapshot names.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		force, _ := cmd.Flags().GetBool("force")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":          "snapshot",
+			"snapshot_action": "delete",
+			"snapshot_name":   args[1],
+			"revision":        revision,
+			"force":           strconv.FormatBool(force),
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmSnapshotCmd.AddCommand(vmSnapshotDeleteCmd)
+	vmSnapshotDeleteCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmSnapshotDeleteCmd.Flags().BoolP("force", "f", false, "force snapshot deletion on a locked VM")
+}
@@ -0,0 +1,66 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/spf13/cobra"
+)
+
+// vmSnapshotListCmd represents the "vm snapshot list" command
+var vmSnapshotListCmd = &cobra.Command{
+	Use:   "list <vm-name>",
+	Short: "List VM snapshots",
+	// Long: ``,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("GET", "/vm/snapshots/"+args[0], map[string]string{
+			"revision": revision,
+		})
+		call.JSONCallback = vmSnapshotListCB
+		call.Do()
+	},
+}
+
+func vmSnapshotListCB(reader io.Reader, _ http.Header) {
+	var data common.APIVMSnapshotListEntries
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No result. You may use 'mulch vm snapshot create'.\n")
+		return
+	}
+
+	strData := [][]string{}
+	for _, line := range data {
+		current := ""
+		if line.Current {
+			current = "*"
+		}
+		strData = append(strData, []string{
+			line.Name,
+			line.Created.Format("2006-01-02 15:04"),
+			line.State,
+			line.Description,
+			current,
+		})
+	}
+
+	headers := []string{"Name", "Created", "State", "Description", "Current"}
+	client.RenderTable(headers, strData)
+}
+
+func init() {
+	vmSnapshotCmd.AddCommand(vmSnapshotListCmd)
+	vmSnapshotListCmd.Flags().StringP("revision", "r", "", "revision number")
+}
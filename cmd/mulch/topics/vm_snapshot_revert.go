@@ -0,0 +1,38 @@
+package topics
+
+import (
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmSnapshotRevertCmd represents the "vm snapshot revert" command
+var vmSnapshotRevertCmd = &cobra.Command{
+	Use:   "revert <vm-name> <snapshot-name>",
+	Short: "Revert a VM to a snapshot",
+	Long: `Revert a VM to a snapshot. All changes made since the snapshot
+are lost, and the VM is back in the state it was (running or not).
+
+See 'vm snapshot list' for snapshot names.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		force, _ := cmd.Flags().GetBool("force")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":          "snapshot",
+			"snapshot_action": "revert",
+			"snapshot_name":   args[1],
+			"revision":        revision,
+			"force":           strconv.FormatBool(force),
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmSnapshotCmd.AddCommand(vmSnapshotRevertCmd)
+	vmSnapshotRevertCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmSnapshotRevertCmd.Flags().BoolP("force", "f", false, "force revert of a locked VM")
+}
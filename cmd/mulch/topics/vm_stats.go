@@ -0,0 +1,164 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/cobra"
+)
+
+var vmStatsFlagSort string
+
+// vmStatsCmd represents the "vm stats" command
+var vmStatsCmd = &cobra.Command{
+	Use:   "stats [vm-name]",
+	Short: "Show VM resource usage history",
+	Long: `Show CPU, memory, disk I/O and network I/O history of a VM, sampled
+every minute by mulchd while the VM is running (samples are kept 31 days).
+
+CPU is a percentage of the VM allocated CPUs, memory usage is reported by
+the guest (balloon driver) when available. Disk and network values are
+average rates per second.
+
+Without VM name, show a summary for all VMs (top list).
+
+Examples:
+  mulch vm stats myvm --since 7d
+  mulch vm stats --since 1h --sort mem
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		since, _ := cmd.Flags().GetString("since")
+		points, _ := cmd.Flags().GetInt("points")
+		vmStatsFlagSort, _ = cmd.Flags().GetString("sort")
+
+		sinceDuration, err := client.ParseDuration(since)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if sinceDuration == 0 {
+			log.Fatal("invalid since duration")
+		}
+
+		if len(args) == 0 {
+			switch vmStatsFlagSort {
+			case "cpu", "mem", "disk", "net":
+			default:
+				log.Fatalf("invalid sort value '%s' (cpu, mem, disk, net)", vmStatsFlagSort)
+			}
+
+			call := client.GlobalAPI.NewCall("GET", "/vm/stats", map[string]string{
+				"since": client.DurationAsSecondsString(sinceDuration),
+			})
+			call.JSONCallback = vmStatsListCB
+			call.Do()
+			return
+		}
+
+		call := client.GlobalAPI.NewCall("GET", "/vm/stats/"+args[0], map[string]string{
+			"since":  client.DurationAsSecondsString(sinceDuration),
+			"points": strconv.Itoa(points),
+		})
+		call.JSONCallback = vmStatsCB
+		call.Do()
+	},
+}
+
+func vmStatsRow(first string, point *common.APIVMStatsPoint) []string {
+	mem := func(val uint64) string {
+		if point.MemTotal == 0 {
+			return datasize.ByteSize(val).HR()
+		}
+		return fmt.Sprintf("%s (%d%%)", datasize.ByteSize(val).HR(), val*100/point.MemTotal)
+	}
+	rate := func(val float64) string {
+		return datasize.ByteSize(val).HR() + "/s"
+	}
+
+	return []string{
+		first,
+		fmt.Sprintf("%.1f%%", point.CPUAvg),
+		fmt.Sprintf("%.1f%%", point.CPUMax),
+		mem(point.MemUsedAvg),
+		mem(point.MemUsedMax),
+		rate(point.DiskReadAvg),
+		rate(point.DiskWriteAvg),
+		rate(point.NetRxAvg),
+		rate(point.NetTxAvg),
+	}
+}
+
+func vmStatsCB(reader io.Reader, _ http.Header) {
+	var data common.APIVMStats
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if data.Summary.Samples == 0 {
+		fmt.Printf("No stats for this VM during this period.\n")
+		return
+	}
+
+	strData := [][]string{}
+	for _, point := range data.Points {
+		strData = append(strData, vmStatsRow(point.Time.Format("2006-01-02 15:04"), &point))
+	}
+	strData = append(strData, vmStatsRow("(whole period)", &data.Summary))
+
+	headers := []string{"Date", "CPU avg", "CPU max", "Mem avg", "Mem max", "Disk read", "Disk write", "Net RX", "Net TX"}
+	client.RenderTable(headers, strData)
+}
+
+func vmStatsListCB(reader io.Reader, _ http.Header) {
+	var data []common.APIVMStats
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No stats during this period.\n")
+		return
+	}
+
+	value := func(stats common.APIVMStats) float64 {
+		switch vmStatsFlagSort {
+		case "mem":
+			return float64(stats.Summary.MemUsedAvg)
+		case "disk":
+			return stats.Summary.DiskReadAvg + stats.Summary.DiskWriteAvg
+		case "net":
+			return stats.Summary.NetRxAvg + stats.Summary.NetTxAvg
+		}
+		return stats.Summary.CPUAvg
+	}
+	sort.SliceStable(data, func(i, j int) bool {
+		return value(data[i]) > value(data[j])
+	})
+
+	strData := [][]string{}
+	for _, stats := range data {
+		strData = append(strData, vmStatsRow(stats.VMName, &stats.Summary))
+	}
+
+	headers := []string{"VM", "CPU avg", "CPU max", "Mem avg", "Mem max", "Disk read", "Disk write", "Net RX", "Net TX"}
+	client.RenderTable(headers, strData)
+}
+
+func init() {
+	vmCmd.AddCommand(vmStatsCmd)
+	vmStatsCmd.Flags().String("since", "24h", "show stats since this duration (ex: 3h, 7d)")
+	vmStatsCmd.Flags().IntP("points", "p", 24, "number of detailed lines (0 for summary only)")
+	vmStatsCmd.Flags().String("sort", "cpu", "sort VMs by cpu, mem, disk or net (without VM name)")
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+)
+
+// TestAlertController sends a test alert to all channels (or only one)
+func TestAlertController(req *server.Request) {
+	req.StartStream()
+
+	channel := req.HTTP.FormValue("channel")
+	severity := req.HTTP.FormValue("severity")
+
+	if severity == "" {
+		severity = server.AlertSeverityInfo
+	}
+
+	alertType := server.AlertTypeGood
+	switch severity {
+	case server.AlertSeverityInfo:
+	case server.AlertSeverityWarning, server.AlertSeverityCritical:
+		alertType = server.AlertTypeBad
+	default:
+		req.Stream.Failuref("invalid severity '%s' (info, warning, critical)", severity)
+		return
+	}
+
+	alert := &server.Alert{
+		Type:     alertType,
+		Severity: severity,
+		Subject:  "Test",
+		Content:  fmt.Sprintf("This is a test alert, sent by %s", req.APIKey.Comment),
+	}
+
+	results, err := req.App.AlertSender.Test(alert, channel)
+	if err != nil {
+		req.Stream.Failuref("%s (channels: %s)", err, strings.Join(req.App.AlertSender.Channels(), ", "))
+		return
+	}
+
+	failures := 0
+	for _, result := range results {
+		if result.Err != nil {
+			req.Stream.Errorf("%s: %s", result.Channel, result.Err)
+			failures++
+		} else {
+			req.Stream.Infof("%s: OK", result.Channel)
+		}
+	}
+
+	if failures > 0 {
+		req.Stream.Failuref("%d/%d channel(s) failed", failures, len(results))
+		return
+	}
+	req.Stream.Successf("test alert sent to %d channel(s)", len(results))
+}
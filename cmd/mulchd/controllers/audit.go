@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+// ListAuditController lists API calls from the audit log
+func ListAuditController(req *server.Request) {
+	key := req.HTTP.FormValue("key")
+	sinceStr := req.HTTP.FormValue("since")
+
+	since, err := strconv.Atoi(sinceStr)
+	if err != nil || since < 1 {
+		msg := "invalid 'since' value"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	entries, err := req.App.AuditLog.Search(key, time.Now().Add(-time.Duration(since)*time.Second))
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	data := []common.APIAuditEntry{}
+	for _, entry := range entries {
+		data = append(data, entry.ToAPI())
+	}
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
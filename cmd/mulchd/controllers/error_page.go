@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+)
+
+// ErrorPageController receives a custom error page from a VM (multipart
+// form, see push_error_page in cloud-init) (internal server only)
+func ErrorPageController(req *server.Request) {
+	instanceID := req.HTTP.FormValue("instance_id")
+
+	if instanceID == "" {
+		http.Error(req.Response, "missing instance_id", 400)
+		return
+	}
+
+	entry, err := req.App.VMDB.GetEntryBySecretUUID(instanceID)
+	if err != nil {
+		http.Error(req.Response, "unknown instance_id", 404)
+		return
+	}
+
+	status, err := strconv.Atoi(req.HTTP.FormValue("status"))
+	if err != nil {
+		http.Error(req.Response, "invalid status", 400)
+		return
+	}
+
+	file, _, err := req.HTTP.FormFile("page")
+	if err != nil {
+		http.Error(req.Response, "missing page", 400)
+		return
+	}
+	defer file.Close()
+
+	err = server.VMErrorPageSave(entry.VM, entry.Name, status, file, req.App)
+	if err != nil {
+		req.App.Log.Errorf("error page for %s: %s", entry.Name, err)
+		http.Error(req.Response, err.Error(), 400)
+		return
+	}
+
+	// VM may still be in the greenhouse, it's harmless
+	err = req.App.VMDB.Update()
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	req.App.Log.Infof("error page %d received for %s", status, entry.Name)
+	req.Println("OK")
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/OnitiFR/mulch/cmd/mulchd/server"
 )
@@ -44,3 +46,65 @@ func GetLogHistoryController(req *server.Request) {
 		http.Error(req.Response, err.Error(), 500)
 	}
 }
+
+// SearchLogController searches messages in the log store (see LogStore)
+func SearchLogController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	target := req.HTTP.FormValue("target")
+	linesStr := req.HTTP.FormValue("lines")
+	sinceStr := req.HTTP.FormValue("since")
+	untilStr := req.HTTP.FormValue("until")
+	typesStr := req.HTTP.FormValue("types")
+
+	lines, err := strconv.Atoi(linesStr)
+	if err != nil || lines < 1 || lines > server.LogStoreSearchMaxLines {
+		msg := "invalid 'lines' value"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	since, err := strconv.Atoi(sinceStr)
+	if err != nil || since < 1 {
+		msg := "invalid 'since' value"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	filter := &server.LogStoreFilter{
+		Target: target,
+		Since:  time.Now().Add(-time.Duration(since) * time.Second),
+		Lines:  lines,
+	}
+
+	if untilStr != "" {
+		until, err := strconv.Atoi(untilStr)
+		if err != nil || until < 0 {
+			msg := "invalid 'until' value"
+			req.App.Log.Error(msg)
+			http.Error(req.Response, msg, 400)
+			return
+		}
+		filter.Until = time.Now().Add(-time.Duration(until) * time.Second)
+	}
+
+	if typesStr != "" {
+		filter.Types = strings.Split(typesStr, ",")
+	}
+
+	messages, err := req.App.LogStore.Search(filter)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(messages)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+)
+
+// GetMetricsController returns Prometheus metrics. The route has no
+// protocol check, so it can be scraped by Prometheus, using a key with
+// the "GET /metrics" right (ex: key=xxx as a scrape param)
+func GetMetricsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	err := req.App.WriteMetrics(req.Response)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+// ListOperationsController lists running operations
+func ListOperationsController(req *server.Request) {
+	data := []common.APIOperation{}
+
+	for _, operation := range req.App.Operations.GetAll() {
+		data = append(data, operation.ToAPI())
+	}
+
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].StartTime.Before(data[j].StartTime)
+	})
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// ActionOperationController handles actions on an operation (cancel)
+func ActionOperationController(req *server.Request) {
+	req.StartStream()
+
+	id := req.SubPath
+	action := req.HTTP.FormValue("action")
+
+	switch action {
+	case "cancel":
+		err := req.App.Operations.Cancel(id, req.APIKey.Comment)
+		if err != nil {
+			req.Stream.Failuref("unable to cancel: %s", err)
+			return
+		}
+		req.App.Log.Warningf("operation %s canceled by %s", id, req.APIKey.Comment)
+		req.Stream.Successf("operation %s is being canceled, see its logs", id)
+	default:
+		req.Stream.Failuref("missing or invalid action ('%s')", action)
+	}
+}
@@ -53,6 +53,7 @@ func PhoneController(req *server.Request) {
 
 			log := server.NewLog(vm.Config.Name, req.App.Hub, req.App.LogHistory)
 			log.Infof("phoning VM is %s - %s", entry.Name, ip)
+			req.App.VMStateDB.PhoneCall(entry.Name)
 
 			if vm.AssignedIPv4 != "" && vm.AssignedIPv4 != ip {
 				log.Errorf("vm %s does not use it's assigned IP! (is '%s', should be '%s')", entry.Name, ip, vm.AssignedIPv4)
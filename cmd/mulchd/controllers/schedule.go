@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+// GetScheduleController lists VM auto-rebuild schedules
+func GetScheduleController(req *server.Request) {
+	data := common.APISchedule{
+		PausedUntil:   req.App.AutoRebuild.PausedUntil(),
+		MaxConcurrent: req.App.Config.AutoRebuildMaxConcurrent,
+		Entries:       []common.APIScheduleEntry{},
+	}
+
+	for _, entry := range req.App.AutoRebuild.GetEntries() {
+		data.Entries = append(data.Entries, common.APIScheduleEntry{
+			VMName:      entry.VMName.ID(),
+			Schedule:    entry.Schedule.Spec,
+			LastRebuild: entry.LastRebuild,
+			Next:        entry.Next,
+			Status:      entry.Status,
+		})
+	}
+
+	sort.Slice(data.Entries, func(i, j int) bool {
+		return data.Entries[i].VMName < data.Entries[j].VMName
+	})
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// ActionScheduleController handles auto-rebuild scheduler actions
+func ActionScheduleController(req *server.Request) {
+	req.StartStream()
+
+	action := req.HTTP.FormValue("action")
+
+	switch action {
+	case "pause":
+		err := schedulePause(req)
+		if err != nil {
+			req.Stream.Failuref("pause failed: %s", err)
+		} else if req.App.AutoRebuild.IsPaused() {
+			req.Stream.Successf("auto-rebuilds paused until %s", req.App.AutoRebuild.PausedUntil().Format("2006-01-02 15:04"))
+		} else {
+			req.Stream.Successf("auto-rebuilds resumed")
+		}
+	default:
+		req.Stream.Failuref("missing or invalid action ('%s')", action)
+		return
+	}
+}
+
+// schedulePause will pause auto-rebuilds for a given duration
+func schedulePause(req *server.Request) error {
+	durationStr := req.HTTP.FormValue("duration")
+
+	seconds, err := strconv.Atoi(durationStr)
+	if err != nil {
+		return fmt.Errorf("unable to parse duration value")
+	}
+	expire := time.Duration(seconds) * time.Second
+
+	return req.App.AutoRebuild.Pause(time.Now().Add(expire))
+}
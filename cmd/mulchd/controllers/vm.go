@@ -1,18 +1,22 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/OnitiFR/mulch/cmd/mulchd/server"
 	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -57,22 +61,99 @@ func getEntryFromRequest(vmName string, req *server.Request) (*server.VMDatabase
 	return entry, nil
 }
 
-// VMControllerConfigCheck will validate TOML sent in the 'config' request field
-// and check if VM is a duplicate
-func VMControllerConfigCheck(req *server.Request) (*server.VMConfig, string, error) {
+// vmConfigContentFromRequest reads the TOML sent in the 'config' request
+// field and its variables ('vars' field)
+func vmConfigContentFromRequest(req *server.Request) (string, string, map[string]string, error) {
 	configFile, header, err := req.HTTP.FormFile("config")
 	if err != nil {
-		return nil, "", fmt.Errorf("'config' file field: %s", err)
+		return "", "", nil, fmt.Errorf("'config' file field: %s", err)
 	}
 	defer configFile.Close()
 
-	filename := header.Filename
+	content, err := io.ReadAll(configFile)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("'config' file field: %s", err)
+	}
+
+	vars, err := server.VMConfigParseVariables(req.HTTP.FormValue("vars"))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return string(content), header.Filename, vars, nil
+}
 
-	conf, err := server.NewVMConfigFromTomlReader(configFile, req.App)
+// vmConfigFromRequest reads the TOML sent in the 'config' request field
+// and decodes it, expanding its variables ('vars' field)
+func vmConfigFromRequest(req *server.Request) (*server.VMConfig, string, error) {
+	content, filename, vars, err := vmConfigContentFromRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conf, err := server.NewVMConfigFromTomlReader(strings.NewReader(content), req.APIKey.Comment, vars, req.App)
 	if err != nil {
 		return nil, "", fmt.Errorf("decoding config: %s", err)
 	}
 
+	return conf, filename, nil
+}
+
+// ValidateVMController checks the TOML sent in the 'config' request field,
+// without creating anything, and returns all problems found
+func ValidateVMController(req *server.Request) {
+	data := common.APIVMValidation{
+		Problems: []common.APIVMValidationProblem{},
+	}
+
+	content, filename, vars, err := vmConfigContentFromRequest(req)
+	data.Filename = filename
+
+	var problems server.VMConfigProblems
+	if err != nil {
+		problems.Add("", err.Error())
+	} else {
+		allowNewRevision := req.HTTP.FormValue("allow_new_revision") == common.TrueStr
+		var conf *server.VMConfig
+		conf, problems = server.VMConfigValidate(content, req.APIKey.Comment, vars, allowNewRevision, req.App)
+		if conf != nil {
+			data.Name = conf.Name
+			if req.APIKey.IsAllowed("CREATE", "/vm/"+conf.Name, req.HTTP) == false {
+				problems.Add("name", "not allowed to create this VM (needs CREATE right)")
+			}
+		}
+	}
+
+	for _, problem := range problems {
+		severity := common.APIVMValidationError
+		if problem.Warning {
+			severity = common.APIVMValidationWarning
+		}
+		data.Problems = append(data.Problems, common.APIVMValidationProblem{
+			Setting:  problem.Setting,
+			Message:  problem.Message,
+			Severity: severity,
+		})
+	}
+	data.Valid = !problems.HasErrors()
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// VMControllerConfigCheck will validate TOML sent in the 'config' request field
+// and check if VM is a duplicate
+func VMControllerConfigCheck(req *server.Request) (*server.VMConfig, string, error) {
+	conf, filename, err := vmConfigFromRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+
 	allowNewRevision := req.HTTP.FormValue("allow_new_revision")
 
 	if req.App.VMDB.GetCountForName(conf.Name) > 0 && allowNewRevision != common.TrueStr {
@@ -185,12 +266,17 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 		return nil, errors.New(msg)
 	}
 
-	operation := req.App.Operations.Add(&server.Operation{
+	op := &server.Operation{
 		Origin:        req.APIKey.Comment,
 		Action:        "create",
 		Ressource:     "vm",
 		RessourceName: conf.Name,
-	})
+	}
+	operation, err := req.App.Operations.AddVM(op, conf.Name)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return nil, err
+	}
 	defer req.App.Operations.Remove(operation)
 
 	req.SetTarget(conf.Name)
@@ -201,32 +287,24 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 		req.Stream.Infof("will restore VM from '%s'", restore)
 	}
 
-	// restore from a new backup
+	// blank restore (migration): data disks will be imported later
+	if restore == server.BackupBlankRestore {
+		conf.DataDisksDeferred = true
+	}
+
+	// restore from a new backup of a running VM (see NewVM)
 	if restoreVM != "" {
-		entry, err := req.App.VMDB.GetActiveEntryByName(restoreVM)
-		if err != nil {
-			msg := fmt.Sprintf("Cannot find VM to backup: %s", err)
-			req.Stream.Failure(msg)
-			return nil, errors.New(msg)
-		}
-		backup, err := server.VMBackup(entry.Name, req.APIKey.Comment, req.App, req.Stream, server.BackupCompressDisable, server.BackupNoExpiration)
-		if err != nil {
-			msg := fmt.Sprintf("Cannot backup %s: %s", restoreVM, err)
-			req.Stream.Failure(msg)
-			return nil, errors.New(msg)
-		}
-		defer func() {
-			err := deleteBackup(backup, req)
-			if err != nil {
-				req.App.Log.Errorf("cannot delete transient backup: %s", err)
-			}
-		}()
-		conf.RestoreBackup = backup
+		conf.RestoreBackup = server.VMRestoreFromVMPrefix + restoreVM
+	}
+
+	if srcName, ok := server.VMRestoreSourceVM(conf.RestoreBackup); ok {
+		req.Stream.Infof("will restore VM from a new backup of '%s'", srcName)
 	}
 
 	before := time.Now()
-	vm, vmName, err := server.NewVM(conf, active, allowScriptFailure, req.APIKey.Comment, req.App, req.Stream)
+	vm, vmName, err := server.NewVM(op.Context(), conf, active, allowScriptFailure, req.APIKey.Comment, req.App, req.Stream)
 	if err != nil {
+		req.App.VMHistory.Add(server.NewVMName(conf.Name, server.RevisionNone), server.NewVMHistoryEvent(server.VMEventCreate, req.APIKey.Comment, err, "creation failed"))
 		msg := fmt.Sprintf("Cannot create VM: %s", err)
 		req.Stream.Failure(msg)
 		return nil, errors.New(msg)
@@ -242,6 +320,13 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 
 	after := time.Now()
 
+	event := server.NewVMHistoryEvent(server.VMEventCreate, req.APIKey.Comment, nil, "created from seed %s", conf.Seed)
+	if conf.RestoreBackup != "" {
+		event.Message += ", restored from " + conf.RestoreBackup
+	}
+	event.Duration = after.Sub(before)
+	req.App.VMHistory.Add(vmName, event)
+
 	req.Stream.Successf("VM %s created successfully (%s)", vmName, after.Sub(before))
 	return vm, nil
 }
@@ -330,6 +415,7 @@ func ListVMsController(req *server.Request) {
 				WIP:       string(vm.WIP),
 				SuperUser: vm.App.Config.MulchSuperUser,
 				AppUser:   vm.Config.AppUser,
+				Health:    vmHealthState(req.App, vmName, active),
 			})
 		}
 
@@ -381,13 +467,24 @@ func ActionVMController(req *server.Request) {
 		operationAction = "do:" + req.HTTP.FormValue("do_action")
 	}
 
-	operation := req.App.Operations.Add(&server.Operation{
+	if action == "snapshot" {
+		operationAction = "snapshot:" + req.HTTP.FormValue("snapshot_action")
+	}
+
+	op := &server.Operation{
 		Origin:        req.APIKey.Comment,
 		Action:        operationAction,
 		Ressource:     "vm",
 		RessourceName: entry.Name.ID(),
-	})
+	}
+	operation, err := req.App.Operations.AddVM(op, entry.Name.Name)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
 	defer req.App.Operations.Remove(operation)
+	ctx := op.Context()
+	author := req.APIKey.Comment
 
 	switch action {
 	case "lock":
@@ -395,6 +492,7 @@ func ActionVMController(req *server.Request) {
 			req.Stream.Warningf("%s already locked", entry.Name)
 		}
 		err := server.VMLockUnlock(entry.Name, true, req.App.VMDB)
+		req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventLock, author, err, "locked"))
 		if err != nil {
 			req.Stream.Failuref("unable to lock %s: %s", entry.Name, err)
 		} else {
@@ -405,11 +503,37 @@ func ActionVMController(req *server.Request) {
 			req.Stream.Warningf("%s already unlocked", entry.Name)
 		}
 		err := server.VMLockUnlock(entry.Name, false, req.App.VMDB)
+		req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventUnlock, author, err, "unlocked"))
 		if err != nil {
 			req.Stream.Failuref("unable to unlock %s: %s", entry.Name, err)
 		} else {
 			req.Stream.Successf("%s is now unlocked", entry.Name)
 		}
+	case "maintenance":
+		var maintenance bool
+		switch req.HTTP.FormValue("state") {
+		case "on":
+			maintenance = true
+		case "off":
+			maintenance = false
+		default:
+			req.Stream.Failure("invalid state (on or off)")
+			return
+		}
+		state := "disabled"
+		if maintenance {
+			state = "enabled"
+		}
+		if vm.Maintenance == maintenance {
+			req.Stream.Warningf("%s maintenance mode already %s", entry.Name, state)
+		}
+		err := server.VMSetMaintenance(entry.Name, maintenance, req.App.VMDB)
+		req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventMaintenance, author, err, "maintenance mode %s", state))
+		if err != nil {
+			req.Stream.Failuref("unable to change %s maintenance mode: %s", entry.Name, err)
+		} else {
+			req.Stream.Successf("%s maintenance mode is now %s", entry.Name, state)
+		}
 	case "start":
 		req.Stream.Infof("starting %s", vmName)
 		err := server.VMStartByName(entry.Name, vm.SecretUUID, req.App, req.Stream)
@@ -433,14 +557,16 @@ func ActionVMController(req *server.Request) {
 			req.Stream.Failuref("error: %s", err)
 		}
 	case "backup":
-		volHame, err := BackupVM(req, entry.Name)
+		volHame, err := BackupVM(ctx, req, entry.Name)
+		req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventBackup, author, err, "backup %s", volHame))
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
 		} else {
 			req.Stream.Successf("backup completed (%s)", volHame)
 		}
 	case "restore":
-		err := RestoreVM(req, vm, entry.Name)
+		err := RestoreVM(ctx, req, vm, entry.Name)
+		req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventRestore, author, err, "restored from %s", req.HTTP.FormValue("backup_name")))
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
 		} else {
@@ -448,26 +574,58 @@ func ActionVMController(req *server.Request) {
 		}
 	case "rebuild":
 		before := time.Now()
-		err := RebuildVM(req, vm, entry.Name)
+		err := RebuildVM(ctx, req, vm, entry.Name)
 		after := time.Now()
+		req.App.VMHistory.AddRebuild(entry.Name, author, err)
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
 		} else {
 			req.Stream.Successf("rebuild completed (%s)", after.Sub(before))
 		}
 	case "redefine":
-		err := RedefineVM(req, vm, entry.Active)
+		plan := req.HTTP.FormValue("plan") == common.TrueStr
+		err := RedefineVM(req, vm, entry.Name, entry.Active)
+		if !plan {
+			req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventRedefine, author, err, "redefined"))
+		}
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
+		} else if plan {
+			req.Stream.Successf("plan only, VM %s was not redefined", entry.Name)
 		} else {
 			req.Stream.Successf("VM %s redefined (may the sysadmin gods be with you)", entry.Name)
 		}
 	case "activate":
 		ActivateVM(req, vm, entry)
+	case "snapshot":
+		SnapshotVM(req, vm, entry.Name)
+	case "clone":
+		before := time.Now()
+		cloneName, err := CloneVM(req, vm, entry.Name)
+		after := time.Now()
+		req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventClone, author, err, "cloned to %s", req.HTTP.FormValue("clone_name")))
+		if err == nil {
+			req.App.VMHistory.Add(cloneName, server.NewVMHistoryEvent(server.VMEventCreate, author, nil, "cloned from %s", entry.Name))
+		}
+		if err != nil {
+			req.Stream.Failuref("error: %s", err)
+		} else {
+			req.Stream.Successf("VM %s cloned to %s (%s)", entry.Name, cloneName, after.Sub(before))
+		}
+	case "import-disk":
+		err := ImportDiskVM(req, vm, entry.Name)
+		if err != nil {
+			req.Stream.Failuref("error: %s", err)
+		} else {
+			req.Stream.Successf("data disk imported in %s", entry.Name)
+		}
 	case "migrate":
 		before := time.Now()
-		err := MigrateVM(req, vm, entry.Name)
+		err := MigrateVM(ctx, req, vm, entry.Name)
 		after := time.Now()
+		event := server.NewVMHistoryEvent(server.VMEventMigrate, author, err, "migrated to %s", req.HTTP.FormValue("destination"))
+		event.Duration = after.Sub(before)
+		req.App.VMHistory.Add(entry.Name, event)
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
 		} else {
@@ -491,17 +649,22 @@ func DeleteVMController(req *server.Request) {
 		return
 	}
 
-	operation := req.App.Operations.Add(&server.Operation{
+	operation, err := req.App.Operations.AddVM(&server.Operation{
 		Origin:        req.APIKey.Comment,
 		Action:        "delete",
 		Ressource:     "vm",
 		RessourceName: entry.Name.ID(),
-	})
+	}, entry.Name.Name)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
 	defer req.App.Operations.Remove(operation)
 
 	req.Stream.Infof("deleting vm %s", entry.Name)
 
 	err = server.VMDelete(entry.Name, req.App, req.Stream)
+	req.App.VMHistory.Add(entry.Name, server.NewVMHistoryEvent(server.VMEventDelete, req.APIKey.Comment, err, "deleted"))
 	if err != nil {
 		req.Stream.Failuref("unable to delete VM '%s': %s", vmName, err)
 	} else {
@@ -690,6 +853,21 @@ func GetVMInfosController(req *server.Request) {
 		tags = append(tags, tag)
 	}
 
+	var dataDisks []string
+	for _, disk := range vm.Config.Disks {
+		dataDisks = append(dataDisks, fmt.Sprintf("%s (%s on %s)",
+			disk.Name,
+			(datasize.ByteSize(disk.Size)*datasize.B).HR(),
+			disk.Mount,
+		))
+	}
+
+	var health, healthError string
+	if vmHealth := req.App.Health.Get(entry.Name.Name); vmHealth != nil && entry.Active {
+		health = vmHealth.State
+		healthError = vmHealth.LastError
+	}
+
 	data := &common.APIVMInfos{
 		Name:                entry.Name.Name,
 		Revision:            entry.Name.Revision,
@@ -701,6 +879,7 @@ func GetVMInfosController(req *server.Request) {
 		DiskSizeMB:          (vm.Config.DiskSize / 1024 / 1024),
 		AllocatedDiskSizeMB: (vInfos.Allocation / 1024 / 1024),
 		BackupDiskSizeMB:    (vm.Config.BackupDiskSize / 1024 / 1024),
+		DataDisks:           dataDisks,
 		Hostname:            vm.Config.Hostname,
 		Domains:             domains,
 		SuperUser:           vm.App.Config.MulchSuperUser,
@@ -710,10 +889,13 @@ func GetVMInfosController(req *server.Request) {
 		LastRebuildDuration: vm.LastRebuildDuration,
 		LastRebuildDowntime: vm.LastRebuildDowntime,
 		Locked:              vm.Locked,
+		Maintenance:         vm.Maintenance,
 		AssignedIPv4:        vm.AssignedIPv4,
 		AssignedMAC:         vm.AssignedMAC,
 		DoActions:           actions,
 		Tags:                tags,
+		Health:              health,
+		HealthError:         healthError,
 	}
 
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -725,6 +907,14 @@ func GetVMInfosController(req *server.Request) {
 	}
 }
 
+// health is only checked for the active revision
+func vmHealthState(app *server.App, vmName *server.VMName, active bool) string {
+	if !active {
+		return ""
+	}
+	return app.Health.GetState(vmName.Name)
+}
+
 // GetVMLoadController return VM load
 func GetVMLoadController(req *server.Request) {
 	vmName := req.SubPath
@@ -754,6 +944,76 @@ func GetVMLoadController(req *server.Request) {
 	req.Printf("load: %.2f%%\n", load)
 }
 
+// GetVMHistoryController returns the event history of a VM (all revisions,
+// even if the VM was deleted)
+func GetVMHistoryController(req *server.Request) {
+	vmName := req.SubPath
+
+	if vmName == "" {
+		msg := "no VM name given"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	data := []common.APIVMHistoryEvent{}
+	for _, event := range req.App.VMHistory.Get(vmName) {
+		data = append(data, event.ToAPI())
+	}
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// GetVMAccessLogController streams the VM HTTP access log (written by
+// mulch-proxy, if proxy_access_log is enabled)
+func GetVMAccessLogController(req *server.Request) {
+	vmName := req.SubPath
+
+	if !server.IsValidName(vmName) {
+		msg := "invalid or missing VM name"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	lines := 100
+	linesStr := req.HTTP.FormValue("lines")
+	if linesStr != "" {
+		var err error
+		lines, err = strconv.Atoi(linesStr)
+		if err != nil || lines < 0 || lines > server.AccessLogTailMaxLines {
+			msg := fmt.Sprintf("invalid lines value (0-%d)", server.AccessLogTailMaxLines)
+			req.App.Log.Error(msg)
+			http.Error(req.Response, msg, 400)
+			return
+		}
+	}
+
+	follow := req.HTTP.FormValue("follow") == common.TrueStr
+
+	// we're not able to send an HTTP error once the stream is started
+	filename := common.AccessLogFilename(req.App.Config.DataPath, vmName, 0)
+	if !follow && !common.PathExist(filename) {
+		msg := fmt.Sprintf("no access log for VM '%s' (is proxy_access_log enabled?)", vmName)
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 404)
+		return
+	}
+
+	req.Response.Header().Set("Content-Type", "application/octet-stream")
+
+	err := server.AccessLogTail(req.HTTP.Context(), req.Response, req.App.Config.DataPath, vmName, lines, follow)
+	if err != nil {
+		req.App.Log.Errorf("access log read error: %s", err.Error())
+	}
+}
+
 // GetVMDoActionsController return VM do-action list
 func GetVMDoActionsController(req *server.Request) {
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -938,7 +1198,7 @@ func ActivateVM(req *server.Request, vm *server.VM, entry *server.VMDatabaseEntr
 }
 
 // BackupVM launch the backup process
-func BackupVM(req *server.Request, vmName *server.VMName) (string, error) {
+func BackupVM(ctx context.Context, req *server.Request, vmName *server.VMName) (string, error) {
 	allowCompress := server.BackupCompressAllow
 	if req.HTTP.FormValue("allow-compress") == common.FalseStr {
 		allowCompress = server.BackupCompressDisable
@@ -953,10 +1213,10 @@ func BackupVM(req *server.Request, vmName *server.VMName) (string, error) {
 		expire = time.Duration(seconds) * time.Second
 	}
 
-	return server.VMBackup(vmName, req.APIKey.Comment, req.App, req.Stream, allowCompress, expire)
+	return server.VMBackup(ctx, vmName, req.APIKey.Comment, req.App, req.Stream, allowCompress, expire)
 }
 
-func RestoreVM(req *server.Request, vm *server.VM, vmName *server.VMName) error {
+func RestoreVM(ctx context.Context, req *server.Request, vm *server.VM, vmName *server.VMName) error {
 	backupName := req.HTTP.FormValue("backup_name")
 
 	if backupName == "" {
@@ -981,11 +1241,84 @@ func RestoreVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 		return fmt.Errorf("backup '%s' not found in database", backupName)
 	}
 
-	return server.VMRestoreNoChecks(vm, vmName, backup, req.App, req.App.Log)
+	return server.VMRestoreNoChecks(ctx, vm, vmName, backup, req.App, req.App.Log)
+}
+
+// splitFormList splits a comma-separated form value, ignoring empty items
+func splitFormList(value string) []string {
+	var res []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// CloneVM creates a new VM from a live VM, with a new name, domains and ports
+func CloneVM(req *server.Request, vm *server.VM, vmName *server.VMName) (*server.VMName, error) {
+	settings := &server.VMCloneSettings{
+		Name:      req.HTTP.FormValue("clone_name"),
+		Domains:   splitFormList(req.HTTP.FormValue("domains")),
+		Ports:     splitFormList(req.HTTP.FormValue("ports")),
+		KeepPorts: req.HTTP.FormValue("keep_ports") == common.TrueStr,
+	}
+
+	if settings.Name == "" {
+		return nil, errors.New("missing clone_name")
+	}
+
+	if req.APIKey.IsAllowed("CREATE", "/vm/"+settings.Name, req.HTTP) == false {
+		return nil, errors.New("not allowed to create this VM (needs CREATE right)")
+	}
+
+	if vm.WIP != server.VMOperationNone {
+		return nil, fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+	}
+
+	// the clone is cancellable with this operation
+	op := &server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "create",
+		Ressource:     "vm",
+		RessourceName: settings.Name,
+	}
+	operation, err := req.App.Operations.AddVM(op, settings.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer req.App.Operations.Remove(operation)
+
+	_, cloneName, err := server.VMClone(op.Context(), vmName, settings, true, req.APIKey.Comment, req.App, req.Stream)
+	if err != nil {
+		return nil, err
+	}
+	return cloneName, nil
+}
+
+// ImportDiskVM creates a VM data disk from a backup volume (used by migration)
+func ImportDiskVM(req *server.Request, vm *server.VM, vmName *server.VMName) error {
+	diskName := req.HTTP.FormValue("disk")
+	backupName := req.HTTP.FormValue("backup_name")
+
+	if diskName == "" || backupName == "" {
+		return errors.New("missing disk or backup_name")
+	}
+
+	if vm.Locked && req.HTTP.FormValue("force") != common.TrueStr {
+		return errors.New("VM is locked (see --force)")
+	}
+
+	if vm.WIP != server.VMOperationNone {
+		return fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+	}
+
+	return server.VMDataDiskImport(vm, vmName, diskName, backupName, req.App, req.Stream)
 }
 
 // RebuildVM rebuilds a VM from a backup (with revision system) and delete the original
-func RebuildVM(req *server.Request, vm *server.VM, vmName *server.VMName) error {
+func RebuildVM(ctx context.Context, req *server.Request, vm *server.VM, vmName *server.VMName) error {
 
 	if vm.Locked && req.HTTP.FormValue("force") != common.TrueStr {
 		return errors.New("VM is locked (see --force)")
@@ -993,12 +1326,15 @@ func RebuildVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 
 	lock := req.HTTP.FormValue("lock")
 
-	return server.VMRebuild(vmName, lock == common.TrueStr, req.APIKey.Comment, req.App, req.Stream)
+	return server.VMRebuild(ctx, vmName, lock == common.TrueStr, req.APIKey.Comment, req.App, req.Stream)
 }
 
-// RedefineVM replace VM config file with a new one, for next rebuild
-func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
-	if vm.Locked && req.HTTP.FormValue("force") != common.TrueStr {
+// RedefineVM replace VM config file with a new one, for next rebuild. CPU,
+// RAM and disk changes are applied to the domain (live, if possible).
+func RedefineVM(req *server.Request, vm *server.VM, vmName *server.VMName, active bool) error {
+	plan := req.HTTP.FormValue("plan") == common.TrueStr
+
+	if vm.Locked && req.HTTP.FormValue("force") != common.TrueStr && !plan {
 		return errors.New("VM is locked (see --force)")
 	}
 
@@ -1006,17 +1342,11 @@ func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
 		return fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
 	}
 
-	configFile, header, err := req.HTTP.FormFile("config")
-	if err != nil {
-		return fmt.Errorf("'config' file field: %s", err)
-	}
-	defer configFile.Close()
-	req.Stream.Tracef("reading '%s' config file", header.Filename)
-
-	conf, err := server.NewVMConfigFromTomlReader(configFile, req.App)
+	conf, filename, err := vmConfigFromRequest(req)
 	if err != nil {
-		return fmt.Errorf("decoding config: %s", err)
+		return err
 	}
+	req.Stream.Tracef("reading '%s' config file", filename)
 
 	if conf.Name != vm.Config.Name {
 		return fmt.Errorf("VM name does not match")
@@ -1033,12 +1363,27 @@ func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
 		}
 	}
 
+	report := server.VMConfigDiff(vm.Config, conf)
+
+	if plan {
+		running, _ := server.VMIsRunning(vmName, req.App)
+		report.Append(server.VMConfigDiffResources(vm.Config, conf, running))
+		redefineVMReport(req, report, true)
+		return nil
+	}
+
 	// change author
 	vm.AuthorKey = req.APIKey.Comment
 
 	oldActions := vm.Config.DoActions
 	oldTags := vm.Config.Tags
 
+	// before the config switch, so a fetch failure changes nothing
+	err = server.VMErrorPagesRedefine(vm, vmName, conf.ErrorPages, req.App, req.Stream)
+	if err != nil {
+		return fmt.Errorf("error_pages: %s", err)
+	}
+
 	// redefine config
 	vm.Config = conf
 
@@ -1067,11 +1412,201 @@ func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
 		return err
 	}
 
+	// apply CPU/RAM/disk changes to the domain, when possible
+	resourcesReport, err := server.VMApplyResources(vm, vmName, conf, req.App, req.Stream)
+	if err != nil {
+		req.Stream.Warningf("unable to apply resource changes: %s", err)
+		req.Stream.Warning("resource changes will be applied on next rebuild")
+	} else {
+		report.Append(resourcesReport)
+	}
+
+	redefineVMReport(req, report, false)
 	return nil
 }
 
+// stream a redefine report (see VMConfigDiff)
+func redefineVMReport(req *server.Request, report *server.VMChangeReport, plan bool) {
+	if report.IsEmpty() {
+		req.Stream.Info("no change detected")
+		return
+	}
+
+	applied := "applied"
+	if plan {
+		applied = "will be applied"
+	}
+
+	for _, change := range report.Applied {
+		req.Stream.Infof("%s: %s", applied, change)
+	}
+	for _, change := range report.Restart {
+		req.Stream.Warningf("needs a restart: %s", change)
+	}
+	for _, change := range report.Rebuild {
+		req.Stream.Warningf("needs a rebuild: %s", change)
+	}
+}
+
+// upload a data disk to a peer and import it in the remote VM
+func migrateDataDisk(req *server.Request, destination server.ConfigPeer, vmName *server.VMName, revision int, diskName string, volPath string) error {
+	log := req.Stream
+
+	conn, err := req.App.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	vol, err := conn.LookupStorageVolByPath(volPath)
+	if err != nil {
+		return err
+	}
+	defer vol.Free()
+
+	pool, err := vol.LookupPoolByVolume()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+
+	remoteBackup := "migration-" + path.Base(volPath)
+	call := &server.PeerCall{
+		Peer:    destination,
+		Method:  "POST",
+		Path:    "/backup",
+		Args:    map[string]string{},
+		Log:     log,
+		Libvirt: req.App.Libvirt,
+		UploadVolume: &server.PeerCallLibvirtFile{
+			Name: path.Base(volPath),
+			As:   remoteBackup,
+			Pool: pool,
+		},
+	}
+
+	err = call.Do()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		call = &server.PeerCall{
+			Peer:   destination,
+			Method: "DELETE",
+			Path:   "/backup/" + remoteBackup,
+			Args:   map[string]string{},
+			Log:    log,
+		}
+		call.Do()
+	}()
+
+	call = &server.PeerCall{
+		Peer:   destination,
+		Method: "POST",
+		Path:   "/vm/" + vmName.Name,
+		Args: map[string]string{
+			"action":      "import-disk",
+			"disk":        diskName,
+			"backup_name": remoteBackup,
+			"revision":    strconv.Itoa(revision),
+			"force":       strconv.FormatBool(true),
+		},
+		Log: log,
+	}
+
+	return call.Do()
+}
+
+// SnapshotVM creates, reverts or deletes a VM snapshot (deals with failure
+// and success by itself)
+func SnapshotVM(req *server.Request, vm *server.VM, vmName *server.VMName) {
+	snapshotAction := req.HTTP.FormValue("snapshot_action")
+	snapshotName := req.HTTP.FormValue("snapshot_name")
+	force := req.HTTP.FormValue("force")
+
+	switch snapshotAction {
+	case "create":
+		name, err := server.VMSnapshotCreate(vmName, snapshotName, req.APIKey.Comment, req.App, req.Stream)
+		if err != nil {
+			req.Stream.Failuref("unable to create snapshot: %s", err)
+		} else {
+			req.Stream.Successf("snapshot '%s' of %s created", name, vmName)
+		}
+	case "revert":
+		if vm.Locked && force != common.TrueStr {
+			req.Stream.Failuref("VM is locked (see --force)")
+			return
+		}
+		err := server.VMSnapshotRevert(vmName, snapshotName, req.App, req.Stream)
+		if err != nil {
+			req.Stream.Failuref("unable to revert snapshot: %s", err)
+		} else {
+			req.Stream.Successf("VM %s reverted to snapshot '%s'", vmName, snapshotName)
+		}
+	case "delete":
+		if vm.Locked && force != common.TrueStr {
+			req.Stream.Failuref("VM is locked (see --force)")
+			return
+		}
+		err := server.VMSnapshotDelete(vmName, snapshotName, req.App, req.Stream)
+		if err != nil {
+			req.Stream.Failuref("unable to delete snapshot: %s", err)
+		} else {
+			req.Stream.Successf("snapshot '%s' of %s deleted", snapshotName, vmName)
+		}
+	default:
+		req.Stream.Failuref("missing or invalid snapshot action ('%s')", snapshotAction)
+	}
+}
+
+// GetVMSnapshotsController return VM snapshot list
+func GetVMSnapshotsController(req *server.Request) {
+	vmName := req.SubPath
+
+	if vmName == "" {
+		msg := "no VM name given"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	entry, err := getEntryFromRequest(vmName, req)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 404)
+		return
+	}
+
+	snapshots, err := server.VMSnapshotList(entry.Name, req.App)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	var retData common.APIVMSnapshotListEntries
+	for _, snapshot := range snapshots {
+		retData = append(retData, common.APIVMSnapshotListEntry{
+			Name:        snapshot.Name,
+			Description: snapshot.Description,
+			Created:     snapshot.Created,
+			State:       snapshot.State,
+			Parent:      snapshot.Parent,
+			Current:     snapshot.Current,
+		})
+	}
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
 // MigrateVM will migrate VM to a destination server ("peer")
-func MigrateVM(req *server.Request, vm *server.VM, vmName *server.VMName) error {
+func MigrateVM(ctx context.Context, req *server.Request, vm *server.VM, vmName *server.VMName) error {
 	log := req.Stream
 	commit := false
 
@@ -1093,6 +1628,15 @@ func MigrateVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 		keepSourceActive = true
 	}
 
+	dataDisks, err := server.VMDataDisksGetVolumes(vmName, req.App)
+	if err != nil {
+		return err
+	}
+
+	if len(dataDisks) > 0 && keepSourceActive {
+		return errors.New("source VM can't be kept active, it has data disks")
+	}
+
 	destinationName := req.HTTP.FormValue("destination")
 	destination, exists := req.App.Config.Peers[destinationName]
 	if !exists {
@@ -1127,7 +1671,7 @@ func MigrateVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 		Log: log,
 	}
 
-	err := call.Do()
+	err = call.Do()
 	if err != nil {
 		return err
 	}
@@ -1216,6 +1760,11 @@ func MigrateVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 		return errors.New("unable to retrieve revision of remote VM")
 	}
 
+	err = server.OperationCheckCanceled(ctx)
+	if err != nil {
+		return err
+	}
+
 	sourceActive := entry.Active
 	if sourceActive && !keepSourceActive {
 		log.Info("deactivating source VM")
@@ -1234,7 +1783,10 @@ func MigrateVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 	downtimeStart := time.Now()
 
 	// backup source VM
-	backup, err := server.VMBackup(vmName, req.APIKey.Comment, req.App, req.Stream, server.BackupCompressDisable, server.BackupNoExpiration)
+	backup, err := server.VMBackup(ctx, vmName, req.APIKey.Comment, req.App, req.Stream, server.BackupCompressDisable, server.BackupNoExpiration)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		req.Stream.Infof("deleting backup %s", backup)
 		deleteBackup(backup, req)
@@ -1272,6 +1824,42 @@ func MigrateVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 		call.Do()
 	}()
 
+	err = server.OperationCheckCanceled(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(dataDisks) > 0 {
+		// source VM is stopped, so data disks are consistent
+		log.Info("stopping source VM to copy its data disks")
+		err = server.VMStopByName(vmName, server.VMStopNormal, server.VMStopDefaultTimeout, req.App, log)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if !commit {
+				log.Info("restarting source VM")
+				err := server.VMStartByName(vmName, vm.SecretUUID, req.App, log)
+				if err != nil {
+					log.Error(err.Error())
+				}
+			}
+		}()
+
+		for diskName, volPath := range dataDisks {
+			err = migrateDataDisk(req, destination, vmName, revision, diskName, volPath)
+			if err != nil {
+				return err
+			}
+
+			err = server.OperationCheckCanceled(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// restore backup
 	call = &server.PeerCall{
 		Peer:   destination,
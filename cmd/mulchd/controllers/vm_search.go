@@ -14,7 +14,7 @@ import (
 	"github.com/ryanuber/go-glob"
 )
 
-func searchVMsFunctions(vm **server.VM) map[string]govaluate.ExpressionFunction {
+func searchVMsFunctions(vm **server.VM, health *string) map[string]govaluate.ExpressionFunction {
 	return map[string]govaluate.ExpressionFunction{
 
 		// strlen(string) int
@@ -125,6 +125,16 @@ func searchVMsFunctions(vm **server.VM) map[string]govaluate.ExpressionFunction
 			return exists, nil
 		},
 
+		// healthy() bool
+		// return true if the VM healthcheck is OK (false if the VM has
+		// no healthcheck or is not the active revision)
+		"healthy": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 0 {
+				return nil, errors.New("healthy() need no argument")
+			}
+			return *health == server.VMHealthHealthy, nil
+		},
+
 		// like(string) bool
 		// return true if the wildcard match the VM's name
 		"like": func(args ...interface{}) (interface{}, error) {
@@ -165,8 +175,9 @@ func SearchVMsController(req *server.Request) {
 	var matches []*server.VMName
 	vmNames := req.App.VMDB.GetNames()
 	var currentVM *server.VM
+	var currentHealth string
 
-	functions := searchVMsFunctions(&currentVM)
+	functions := searchVMsFunctions(&currentVM, &currentHealth)
 	expr, err := govaluate.NewEvaluableExpressionWithFunctions(q, functions)
 	if err != nil {
 		http.Error(req.Response, err.Error(), 400)
@@ -225,8 +236,10 @@ func SearchVMsController(req *server.Request) {
 		params["ram_gb"] = (float64)(vm.Config.RAMSize) / 1024 / 1024 / 1024
 		params["disk_gb"] = (float64)(vm.Config.DiskSize) / 1024 / 1024 / 1024
 		params["hostname"] = vm.Config.Hostname
+		params["health"] = vmHealthState(req.App, vmName, active)
 
 		currentVM = vm
+		currentHealth = params["health"].(string)
 		res, err := expr.Evaluate(params)
 		if err != nil {
 			http.Error(req.Response, err.Error(), 400)
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+)
+
+func vmStatsSinceFromRequest(req *server.Request) (time.Time, bool) {
+	since, err := strconv.Atoi(req.HTTP.FormValue("since"))
+	if err != nil || since < 1 {
+		msg := "invalid 'since' value"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return time.Time{}, false
+	}
+	return time.Now().Add(-time.Duration(since) * time.Second), true
+}
+
+// GetVMStatsController returns resource usage history of a VM
+func GetVMStatsController(req *server.Request) {
+	vmName := req.SubPath
+
+	if !server.IsValidName(vmName) {
+		msg := "invalid or missing VM name"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	since, ok := vmStatsSinceFromRequest(req)
+	if !ok {
+		return
+	}
+
+	points := 0
+	pointsStr := req.HTTP.FormValue("points")
+	if pointsStr != "" {
+		var err error
+		points, err = strconv.Atoi(pointsStr)
+		if err != nil || points < 0 || points > server.VMStatsMaxPoints {
+			msg := fmt.Sprintf("invalid 'points' value (0-%d)", server.VMStatsMaxPoints)
+			req.App.Log.Error(msg)
+			http.Error(req.Response, msg, 400)
+			return
+		}
+	}
+
+	data, err := req.App.VMStats.Get(vmName, since, points)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// ListVMStatsController returns resource usage summary of all VMs
+func ListVMStatsController(req *server.Request) {
+	since, ok := vmStatsSinceFromRequest(req)
+	if !ok {
+		return
+	}
+
+	data, err := req.App.VMStats.GetAll(since)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&data)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
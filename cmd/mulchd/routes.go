@@ -40,6 +40,14 @@ func AddRoutes(app *server.App) {
 		Handler:      controllers.EnvController,
 	}, server.RouteInternal)
 
+	app.AddRoute(&server.Route{
+		Route:        "POST /error-page",
+		Type:         server.RouteTypeCustom,
+		Public:       true,
+		NoProtoCheck: true,
+		Handler:      controllers.ErrorPageController,
+	}, server.RouteInternal)
+
 	// API routes
 	app.AddRoute(&server.Route{
 		Route:   "GET /log/history",
@@ -47,6 +55,12 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetLogHistoryController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /log/search",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.SearchLogController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /log",
 		Type:    server.RouteTypeStream,
@@ -89,6 +103,36 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetVMDoActionsController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/snapshots/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMSnapshotsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/history/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMHistoryController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/stats",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ListVMStatsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/stats/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMStatsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/access-log/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMAccessLogController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /vm/console/*",
 		Type:    server.RouteTypeCustom,
@@ -101,6 +145,12 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.NewVMSyncController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "POST /vm/validate",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ValidateVMController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "POST /vm-async",
 		Type:    server.RouteTypeCustom,
@@ -125,6 +175,30 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.VersionController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /schedule",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetScheduleController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "POST /schedule",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.ActionScheduleController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /operation",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ListOperationsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "POST /operation/*",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.ActionOperationController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /seed",
 		Type:    server.RouteTypeCustom,
@@ -173,6 +247,12 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.DeleteBackupController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "POST /alert/test",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.TestAlertController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /key",
 		Type:    server.RouteTypeCustom,
@@ -245,6 +325,20 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetKeyPairController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /audit",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ListAuditController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:        "GET /metrics",
+		Type:         server.RouteTypeCustom,
+		NoProtoCheck: true,
+		NoAudit:      true,
+		Handler:      controllers.GetMetricsController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /status",
 		Type:    server.RouteTypeCustom,
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// AccessLogTailMaxLines is the maximum number of lines for AccessLogTail
+const AccessLogTailMaxLines = 100000
+
+// access log polling interval when following
+const accessLogFollowInterval = 500 * time.Millisecond
+
+// AccessLogTail writes the last lines of the access log of a VM (written
+// by mulch-proxy), then waits for new lines if follow is true, until the
+// context is done.
+func AccessLogTail(ctx context.Context, w io.Writer, dataPath string, vmName string, lines int, follow bool) error {
+	filename := common.AccessLogFilename(dataPath, vmName, 0)
+
+	// previous (rotated) file, if the current one is too short
+	prev, err := accessLogLastLines(common.AccessLogFilename(dataPath, vmName, 1), lines)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) || (prev == nil && !follow) {
+			return err
+		}
+		f = nil
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	var current []byte
+	if f != nil {
+		current, err = accessLogLastLinesFile(f, lines)
+		if err != nil {
+			return err
+		}
+		// we'll follow from the end of the file
+		_, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+	}
+
+	missing := lines - bytes.Count(current, []byte{'\n'})
+	if missing > 0 && prev != nil {
+		err = accessLogWrite(w, accessLogKeepLastLines(prev, missing))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = accessLogWrite(w, current)
+	if err != nil || !follow {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(accessLogFollowInterval):
+		}
+
+		if f != nil {
+			err = accessLogCopy(w, f, buf)
+			if err != nil {
+				return err
+			}
+		}
+
+		// file created or rotated?
+		stat, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if f != nil {
+			fstat, err := f.Stat()
+			if err == nil && os.SameFile(stat, fstat) {
+				continue
+			}
+			f.Close()
+		}
+		f, err = os.Open(filename)
+		if err != nil {
+			f = nil
+		}
+	}
+}
+
+// copy all available data from f to w (with a flush)
+func accessLogCopy(w io.Writer, f *os.File, buf []byte) error {
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			errW := accessLogWrite(w, buf[:n])
+			if errW != nil {
+				return errW
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func accessLogWrite(w io.Writer, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := w.Write(data)
+	if err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func accessLogLastLines(filename string, lines int) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return accessLogLastLinesFile(f, lines)
+}
+
+// read the file backward until we get enough lines
+func accessLogLastLinesFile(f *os.File, lines int) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunkSize = 64 * 1024
+	var data []byte
+	offset := stat.Size()
+	for offset > 0 && bytes.Count(data, []byte{'\n'}) <= lines {
+		size := int64(chunkSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+
+		chunk := make([]byte, size)
+		_, err := f.ReadAt(chunk, offset)
+		if err != nil {
+			return nil, err
+		}
+		data = append(chunk, data...)
+	}
+
+	return accessLogKeepLastLines(data, lines), nil
+}
+
+func accessLogKeepLastLines(data []byte, lines int) []byte {
+	if lines <= 0 {
+		return nil
+	}
+	count := 0
+	// ignore the final newline
+	for i := len(data) - 2; i >= 0; i-- {
+		if data[i] == '\n' {
+			count++
+			if count == lines {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
@@ -7,15 +7,19 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Alert are used only for background big "events" (seed download
 // failure, vm autorebuild failure, etc)
 type Alert struct {
-	Type    string
-	Subject string
-	Content string
+	Type     string
+	Severity string // defaults to info for GOOD alerts, critical for BAD ones
+	Subject  string
+	Content  string
+	VMName   string // VM name (if any), used for routing (see vm_tags)
 }
 
 // Alert.Type values
@@ -24,12 +28,55 @@ const (
 	AlertTypeBad  = "BAD"
 )
 
+// Alert.Severity values
+const (
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+var alertSeverityLevels = map[string]int{
+	AlertSeverityInfo:     0,
+	AlertSeverityWarning:  1,
+	AlertSeverityCritical: 2,
+}
+
+// AlertScriptsChannel is the name of the (implicit) alert scripts channel
+const AlertScriptsChannel = "scripts"
+
 const alertScriptDirectory = "alerts"
 
 // AlertSender will be attached to the application
 type AlertSender struct {
 	scriptsPath string
+	channels    []*alertChannel
+	dedupWindow time.Duration
+	recent      map[string]time.Time // recently sent alerts (deduplication)
+	pending     map[string]bool      // alerts being sent (deduplication)
+	mutex       sync.Mutex
+	app         *App
 	log         *Log
+
+	sent            atomic.Uint64
+	failures        atomic.Uint64
+	channelFailures atomic.Uint64
+	throttled       atomic.Uint64
+	duplicates      atomic.Uint64
+}
+
+// AlertStats are AlertSender counters
+type AlertStats struct {
+	Sent            uint64
+	ScriptFailures  uint64
+	ChannelFailures uint64
+	Throttled       uint64
+	Duplicates      uint64
+}
+
+// AlertTestResult is the result of a test alert for a channel
+type AlertTestResult struct {
+	Channel string
+	Err     error
 }
 
 func listScripts(scriptsPath string) ([]string, error) {
@@ -53,12 +100,20 @@ func listScripts(scriptsPath string) ([]string, error) {
 }
 
 // NewAlertSender creates a new AlertSender
-func NewAlertSender(configPath string, log *Log) (*AlertSender, error) {
-	scriptsPath := path.Clean(configPath + "/" + alertScriptDirectory)
+func NewAlertSender(app *App) (*AlertSender, error) {
+	scriptsPath := path.Clean(app.Config.configPath + "/" + alertScriptDirectory)
 
 	sender := &AlertSender{
 		scriptsPath: scriptsPath,
-		log:         log,
+		dedupWindow: app.Config.AlertDedupWindow,
+		recent:      make(map[string]time.Time),
+		pending:     make(map[string]bool),
+		app:         app,
+		log:         app.Log,
+	}
+
+	for _, config := range app.Config.Alerts {
+		sender.channels = append(sender.channels, newAlertChannel(config))
 	}
 
 	// test run
@@ -67,27 +122,115 @@ func NewAlertSender(configPath string, log *Log) (*AlertSender, error) {
 		return nil, fmt.Errorf("alert scripts init: %s", err.Error())
 	}
 
-	if len(list) == 0 {
-		log.Warningf("no alert script found (no *.sh files in '%s') so you're currently blind to background failures", scriptsPath)
+	if len(list) == 0 && len(sender.channels) == 0 {
+		app.Log.Warningf("no alert channel and no alert script found (no *.sh files in '%s') so you're currently blind to background failures", scriptsPath)
 	}
 
 	return sender, nil
 }
 
-// Send an alert using all alert scripts (etc/alerts/*.sh)
+// Send an alert using all alert scripts (etc/alerts/*.sh) and all
+// matching alert channels (see [[alert]] in mulchd.toml)
 func (sender *AlertSender) Send(alert *Alert) error {
+	alertSetDefaults(alert)
+
+	if !sender.reserve(alert) {
+		sender.log.Infof("duplicate alert skipped: %s", alert.Subject)
+		sender.duplicates.Add(1)
+		return nil
+	}
+
+	sender.sent.Add(1)
+	withError := make([]string, 0)
+
+	delivered, err := sender.runScripts(alert)
+	if err != nil {
+		withError = append(withError, err.Error())
+	}
+
+	vmTags := sender.getVMTags(alert.VMName)
+	for _, channel := range sender.channels {
+		if !channel.matches(alert, vmTags) {
+			continue
+		}
+
+		if !channel.allow() {
+			sender.log.Warningf("alert channel '%s' is throttled (max_per_hour = %d), alert '%s' dropped", channel.config.Name, channel.config.MaxPerHour, alert.Subject)
+			sender.throttled.Add(1)
+			continue
+		}
+
+		err := channel.send(alert)
+		if err != nil {
+			sender.log.Errorf("error with alert channel '%s': %s", channel.config.Name, err)
+			sender.channelFailures.Add(1)
+			withError = append(withError, channel.config.Name)
+			continue
+		}
+		sender.log.Infof("alert sent to channel '%s'", channel.config.Name)
+		delivered++
+	}
+
+	// a failed alert is not a duplicate, it may be sent again
+	sender.release(alert, delivered > 0)
+
+	if len(withError) > 0 {
+		return fmt.Errorf("alert errors: %s", strings.Join(withError, ", "))
+	}
+
+	return nil
+}
+
+// Test sends an alert to all channels (or only to channelName), without
+// any routing, deduplication or throttling
+func (sender *AlertSender) Test(alert *Alert, channelName string) ([]AlertTestResult, error) {
+	alertSetDefaults(alert)
+
+	if channelName != "" && channelName != AlertScriptsChannel && sender.getChannel(channelName) == nil {
+		return nil, fmt.Errorf("unknown alert channel '%s'", channelName)
+	}
+
+	var results []AlertTestResult
+
+	if channelName == "" || channelName == AlertScriptsChannel {
+		_, err := sender.runScripts(alert)
+		results = append(results, AlertTestResult{
+			Channel: AlertScriptsChannel,
+			Err:     err,
+		})
+	}
+
+	for _, channel := range sender.channels {
+		if channelName != "" && channel.config.Name != channelName {
+			continue
+		}
+		results = append(results, AlertTestResult{
+			Channel: channel.config.Name,
+			Err:     channel.send(alert),
+		})
+	}
+
+	return results, nil
+}
+
+// run all alert scripts (etc/alerts/*.sh), returns the number of
+// successful scripts
+func (sender *AlertSender) runScripts(alert *Alert) (int, error) {
 	alertScripts, err := listScripts(sender.scriptsPath)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	varMap := make(map[string]string)
 	varMap["TYPE"] = alert.Type
+	varMap["SEVERITY"] = alert.Severity
 	varMap["SUBJECT"] = alert.Subject
 	varMap["CONTENT"] = alert.Content
+	varMap["VM"] = alert.VMName
 	varMap["DATETIME"] = time.Now().Format(time.RFC3339)
 
 	scriptsWithError := make([]string, 0)
+	success := 0
 
 	for _, script := range alertScripts {
 		cmd := exec.Command(script)
@@ -100,18 +243,106 @@ func (sender *AlertSender) Send(alert *Alert) error {
 		if cmdOut, err := cmd.CombinedOutput(); err != nil {
 			sender.log.Errorf("error running alert script '%s': %s, output: %s", script, err, cmdOut)
 			scriptsWithError = append(scriptsWithError, script)
+			sender.failures.Add(1)
 		} else {
 			sender.log.Infof("alert run was successfull '%s'", script)
+			success++
 		}
 	}
 
 	if len(scriptsWithError) > 0 {
-		return fmt.Errorf("error with the following alert scripts: %s", strings.Join(scriptsWithError, ", "))
+		return success, fmt.Errorf("error with the following alert scripts: %s", strings.Join(scriptsWithError, ", "))
+	}
+
+	return success, nil
+}
+
+func alertDedupKey(alert *Alert) string {
+	return strings.Join([]string{alert.Type, alert.Severity, alert.VMName, alert.Subject, alert.Content}, "\x00")
+}
+
+// reserves the alert for sending, returns false if the same alert
+// was delivered recently or is being sent (see release)
+func (sender *AlertSender) reserve(alert *Alert) bool {
+	if sender.dedupWindow == 0 {
+		return true
+	}
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	now := time.Now()
+	for key, sentAt := range sender.recent {
+		if now.Sub(sentAt) > sender.dedupWindow {
+			delete(sender.recent, key)
+		}
+	}
+
+	key := alertDedupKey(alert)
+	if _, exists := sender.recent[key]; exists || sender.pending[key] {
+		return false
+	}
+	sender.pending[key] = true
+	return true
+}
+
+// ends a reservation (see reserve), a delivered alert is then
+// remembered for the dedup window
+func (sender *AlertSender) release(alert *Alert, delivered bool) {
+	if sender.dedupWindow == 0 {
+		return
+	}
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	key := alertDedupKey(alert)
+	delete(sender.pending, key)
+	if delivered {
+		sender.recent[key] = time.Now()
+	}
+}
+
+func (sender *AlertSender) getVMTags(vmName string) map[string]bool {
+	if vmName == "" {
+		return nil
 	}
+	entry, err := sender.app.VMDB.GetActiveEntryByName(vmName)
+	if err != nil {
+		return nil
+	}
+	return entry.VM.Config.Tags
+}
 
+func (sender *AlertSender) getChannel(name string) *alertChannel {
+	for _, channel := range sender.channels {
+		if channel.config.Name == name {
+			return channel
+		}
+	}
 	return nil
 }
 
+// Channels returns the names of all alert channels (including scripts)
+func (sender *AlertSender) Channels() []string {
+	names := []string{AlertScriptsChannel}
+	for _, channel := range sender.channels {
+		names = append(names, channel.config.Name)
+	}
+	return names
+}
+
+// Stats returns AlertSender counters
+func (sender *AlertSender) Stats() AlertStats {
+	return AlertStats{
+		Sent:            sender.sent.Load(),
+		ScriptFailures:  sender.failures.Load(),
+		ChannelFailures: sender.channelFailures.Load(),
+		Throttled:       sender.throttled.Load(),
+		Duplicates:      sender.duplicates.Load(),
+	}
+}
+
 // RunKeepAlive will send a keepalive alert every X days
 func (sender *AlertSender) RunKeepAlive(daysInterval int) {
 	go func() {
@@ -125,3 +356,13 @@ func (sender *AlertSender) RunKeepAlive(daysInterval int) {
 		}
 	}()
 }
+
+func alertSetDefaults(alert *Alert) {
+	if alert.Severity != "" {
+		return
+	}
+	alert.Severity = AlertSeverityInfo
+	if alert.Type == AlertTypeBad {
+		alert.Severity = AlertSeverityCritical
+	}
+}
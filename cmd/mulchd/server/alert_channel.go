@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// native alert channel types
+const (
+	AlertChannelWebhook = "webhook"
+	AlertChannelSlack   = "slack" // Slack and Mattermost incoming webhooks
+	AlertChannelSMTP    = "smtp"
+)
+
+// AlertWebhookSignatureHeader is the HMAC-SHA256 signature of the
+// webhook request body, using the channel secret ("sha256=<hex>")
+const AlertWebhookSignatureHeader = "X-Mulch-Signature"
+
+const alertChannelTimeout = 15 * time.Second
+
+type alertChannel struct {
+	config *ConfigAlert
+	sentAt []time.Time // last hour (throttling)
+	mutex  sync.Mutex
+}
+
+// JSON body of webhook alerts
+type alertWebhookPayload struct {
+	Type     string `json:"type"`
+	Severity string `json:"severity"`
+	Subject  string `json:"subject"`
+	Content  string `json:"content"`
+	VM       string `json:"vm,omitempty"`
+	Host     string `json:"host"`
+	DateTime string `json:"datetime"`
+}
+
+var alertHTTPClient = &http.Client{
+	Timeout: alertChannelTimeout,
+}
+
+func newAlertChannel(config *ConfigAlert) *alertChannel {
+	return &alertChannel{
+		config: config,
+	}
+}
+
+// routing rules
+func (channel *alertChannel) matches(alert *Alert, vmTags map[string]bool) bool {
+	conf := channel.config
+
+	if alertSeverityLevels[alert.Severity] < alertSeverityLevels[conf.MinSeverity] {
+		return false
+	}
+
+	if len(conf.VMTags) > 0 {
+		found := false
+		for _, tag := range conf.VMTags {
+			if vmTags[tag] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(conf.Subjects) > 0 {
+		found := false
+		for _, pattern := range conf.Subjects {
+			if matched, _ := path.Match(pattern, alert.Subject); matched {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// throttling: returns false if max_per_hour is reached
+func (channel *alertChannel) allow() bool {
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+
+	now := time.Now()
+	recent := channel.sentAt[:0]
+	for _, sentAt := range channel.sentAt {
+		if now.Sub(sentAt) < time.Hour {
+			recent = append(recent, sentAt)
+		}
+	}
+	channel.sentAt = recent
+
+	if channel.config.MaxPerHour > 0 && len(channel.sentAt) >= channel.config.MaxPerHour {
+		return false
+	}
+	channel.sentAt = append(channel.sentAt, now)
+	return true
+}
+
+func (channel *alertChannel) send(alert *Alert) error {
+	switch channel.config.Type {
+	case AlertChannelWebhook:
+		return channel.sendWebhook(alert)
+	case AlertChannelSlack:
+		return channel.sendSlack(alert)
+	case AlertChannelSMTP:
+		return channel.sendSMTP(alert)
+	}
+	return fmt.Errorf("unsupported channel type '%s'", channel.config.Type)
+}
+
+func (channel *alertChannel) sendWebhook(alert *Alert) error {
+	body, err := json.Marshal(&alertWebhookPayload{
+		Type:     alert.Type,
+		Severity: alert.Severity,
+		Subject:  alert.Subject,
+		Content:  alert.Content,
+		VM:       alert.VMName,
+		Host:     alertHostname(),
+		DateTime: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := make(map[string]string)
+	if channel.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(channel.config.Secret))
+		mac.Write(body)
+		headers[AlertWebhookSignatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	return alertPostJSON(channel.config.URL, body, headers)
+}
+
+func (channel *alertChannel) sendSlack(alert *Alert) error {
+	mark := ":exclamation:"
+	switch {
+	case alert.Type == AlertTypeGood:
+		mark = ":heavy_check_mark:"
+	case alert.Severity == AlertSeverityInfo:
+		mark = ":information_source:"
+	case alert.Severity == AlertSeverityWarning:
+		mark = ":warning:"
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("%s [%s] %s: *%s* - %s", mark, strings.ToUpper(alert.Severity), alertHostname(), alert.Subject, alert.Content),
+	})
+	if err != nil {
+		return err
+	}
+
+	return alertPostJSON(channel.config.URL, body, nil)
+}
+
+// SMTP with STARTTLS (if supported by the server, and required for
+// authentication, see smtp.PlainAuth)
+func (channel *alertChannel) sendSMTP(alert *Alert) error {
+	conf := channel.config
+
+	subject := fmt.Sprintf("[mulch][%s] %s: %s", strings.ToUpper(alert.Severity), alertHostname(), alert.Subject)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", conf.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(conf.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", alert.Content)
+	fmt.Fprintf(&msg, "Type: %s\r\nSeverity: %s\r\n", alert.Type, alert.Severity)
+	if alert.VMName != "" {
+		fmt.Fprintf(&msg, "VM: %s\r\n", alert.VMName)
+	}
+
+	var auth smtp.Auth
+	if conf.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(conf.SMTPServer)
+		auth = smtp.PlainAuth("", conf.SMTPUser, conf.SMTPPassword, host)
+	}
+
+	// smtp.SendMail has no timeout, let's not block the caller forever
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- smtp.SendMail(conf.SMTPServer, auth, conf.From, conf.To, msg.Bytes())
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(alertChannelTimeout):
+		return fmt.Errorf("timeout sending mail to %s", conf.SMTPServer)
+	}
+}
+
+func alertPostJSON(url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mulchd")
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+
+	res, err := alertHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	return nil
+}
+
+func alertHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "mulchd"
+	}
+	return hostname
+}
@@ -45,6 +45,7 @@ type App struct {
 	PhoneHome      *PhoneHomeHub
 	Log            *Log
 	LogHistory     *LogHistory
+	LogStore       *LogStore
 	MuxInternal    *http.ServeMux
 	MuxAPI         *http.ServeMux
 	Rand           *rand.Rand
@@ -52,6 +53,10 @@ type App struct {
 	SecretsDB      *SecretDatabase
 	VMDB           *VMDatabase
 	VMStateDB      *VMStateDatabase
+	VMHistory      *VMHistoryDatabase
+	VMStats        *VMStatsDatabase
+	Health         *HealthChecker
+	AuditLog       *AuditLog
 	BackupsDB      *BackupDatabase
 	APIKeysDB      *APIKeyDatabase
 	AlertSender    *AlertSender
@@ -62,6 +67,8 @@ type App struct {
 	sshClients     *sshServerClients
 	Operations     *OperationList
 	ProxyReloader  *ProxyReloader
+	AutoRebuild    *AutoRebuildScheduler
+	AutoBackup     *AutoBackupScheduler
 }
 
 // NewApp creates a new application
@@ -90,6 +97,13 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		return nil, err
 	}
 
+	app.LogStore, err = NewLogStore(app.Config.DataPath+"/logs", app.Config.LogMaxSizeMB, app.Config.LogMaxAgeDays, app)
+	if err != nil {
+		return nil, fmt.Errorf("Log store: %s", err)
+	}
+	app.LogHistory.SetStore(app.LogStore)
+	go app.LogStore.Run()
+
 	app.initSigQUITHandler()
 
 	app.Log.Tracef("connecting to libvirt… (%s)", config.LibVirtURI)
@@ -134,6 +148,16 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		return nil, fmt.Errorf("VM State DB: %s", err)
 	}
 
+	err = app.initVMHistoryDB()
+	if err != nil {
+		return nil, fmt.Errorf("VM History DB: %s", err)
+	}
+
+	app.VMStats, err = NewVMStatsDatabase(app.Config.DataPath+"/vm-stats", app)
+	if err != nil {
+		return nil, fmt.Errorf("VM Stats DB: %s", err)
+	}
+
 	// clean DHCP leases
 	err = app.Libvirt.RebuildDHCPStaticLeases(app)
 	if err != nil {
@@ -150,7 +174,12 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		return nil, fmt.Errorf("API Keys DB: %s", err)
 	}
 
-	app.AlertSender, err = NewAlertSender(app.Config.configPath, app.Log)
+	app.AuditLog, err = NewAuditLog(app.Config.DataPath+"/mulch-audit.log", app)
+	if err != nil {
+		return nil, fmt.Errorf("Audit log: %s", err)
+	}
+
+	app.AlertSender, err = NewAlertSender(app)
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +198,12 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 
 	app.Origins = NewOrigins(app)
 
-	app.Operations = NewOperationList(app.Rand)
+	app.Operations = NewOperationList()
+
+	app.AutoRebuild, err = NewAutoRebuildScheduler(app.Config.DataPath+"/mulch-auto-rebuild.db", app)
+	if err != nil {
+		return nil, fmt.Errorf("Auto-rebuild DB: %s", err)
+	}
 
 	app.PhoneHome = NewPhoneHomeHub()
 
@@ -177,7 +211,15 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 
 	go app.VMStateDB.Run()
 
-	go AutoRebuildSchedule(app)
+	go app.VMStats.Run()
+
+	app.Health = NewHealthChecker(app)
+	go app.Health.Run()
+
+	go app.AutoRebuild.Run()
+
+	app.AutoBackup = NewAutoBackupScheduler(app)
+	go app.AutoBackup.Run()
 
 	go app.BackupsDB.Run()
 
@@ -355,6 +397,17 @@ func (app *App) initVMStateDB() error {
 	return nil
 }
 
+func (app *App) initVMHistoryDB() error {
+	dbPath := app.Config.DataPath + "/mulch-vm-history.db"
+
+	db, err := NewVMHistoryDatabase(dbPath, app)
+	if err != nil {
+		return err
+	}
+	app.VMHistory = db
+	return nil
+}
+
 func (app *App) initBackupDB() error {
 	dbPath := app.Config.DataPath + "/mulch-backups.db"
 
@@ -665,14 +718,8 @@ func (app *App) Status() (*common.APIStatus, error) {
 		})
 	}
 
-	for _, operation := range app.Operations.operations {
-		ret.Operations = append(ret.Operations, common.APIOperation{
-			Origin:        operation.Origin,
-			Action:        operation.Action,
-			Ressource:     operation.Ressource,
-			RessourceName: operation.RessourceName,
-			StartTime:     operation.StartTime,
-		})
+	for _, operation := range app.Operations.GetAll() {
+		ret.Operations = append(ret.Operations, operation.ToAPI())
 	}
 
 	for _, origin := range app.Config.Origins {
@@ -2,9 +2,12 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/OnitiFR/mulch/common"
@@ -79,6 +82,16 @@ type AppConfig struct {
 	// everyday VM auto-rebuild time ("HH:MM")
 	AutoRebuildTime string
 
+	// maximum number of simultaneous auto-rebuilds
+	AutoRebuildMaxConcurrent int
+
+	// everyday VM auto-backup time ("HH:MM")
+	AutoBackupTime string
+
+	// log store retention (see LogStore)
+	LogMaxSizeMB  int
+	LogMaxAgeDays int
+
 	// seeds
 	Seeds map[string]ConfigSeed
 
@@ -88,6 +101,12 @@ type AppConfig struct {
 	// origins
 	Origins map[string]*ConfigOrigin
 
+	// native alert channels (alert scripts are always used)
+	Alerts []*ConfigAlert
+
+	// identical alerts are sent only once during this window
+	AlertDedupWindow time.Duration
+
 	// global mulchd configuration path
 	configPath string
 }
@@ -117,6 +136,23 @@ type ConfigOrigin struct {
 	SSHAgent   bool
 }
 
+// ConfigAlert describes a native alert channel, with its routing rules
+type ConfigAlert struct {
+	Name         string
+	Type         string
+	URL          string
+	Secret       string
+	SMTPServer   string
+	SMTPUser     string
+	SMTPPassword string
+	From         string
+	To           []string
+	MinSeverity  string
+	VMTags       []string
+	Subjects     []string
+	MaxPerHour   int
+}
+
 type tomlAppConfig struct {
 	Listen                string
 	InternalServerPort    int    `toml:"internal_port"`
@@ -135,9 +171,15 @@ type tomlAppConfig struct {
 	MulchSuperUser        string `toml:"mulch_super_user"`
 	MulchSuperUserSSHKey  string `toml:"mulch_super_user_ssh_key"`
 	AutoRebuildTime       string `toml:"auto_rebuild_time"`
+	AutoRebuildMaxConc    int    `toml:"auto_rebuild_max_concurrent"`
+	AutoBackupTime        string `toml:"auto_backup_time"`
+	LogMaxSizeMB          int    `toml:"log_max_size_mb"`
+	LogMaxAgeDays         int    `toml:"log_max_age_days"`
+	AlertDedupWindow      string `toml:"alert_dedup_window"`
 	Seed                  []tomlConfigSeed
 	Peer                  []tomlConfigPeer
 	Origin                []tomlConfigOrigin
+	Alert                 []tomlConfigAlert
 }
 
 type tomlConfigSeed struct {
@@ -163,6 +205,22 @@ type tomlConfigOrigin struct {
 	SSHAgent   bool   `toml:"ssh_agent"`
 }
 
+type tomlConfigAlert struct {
+	Name         string
+	Type         string
+	URL          string
+	Secret       string
+	SMTPServer   string   `toml:"smtp_server"`
+	SMTPUser     string   `toml:"smtp_user"`
+	SMTPPassword string   `toml:"smtp_password"`
+	From         string   `toml:"from"`
+	To           []string `toml:"to"`
+	MinSeverity  string   `toml:"min_severity"`
+	VMTags       []string `toml:"vm_tags"`
+	Subjects     []string `toml:"subjects"`
+	MaxPerHour   int      `toml:"max_per_hour"`
+}
+
 // NewAppConfigFromTomlFile return a AppConfig using
 // mulchd.toml config file in the given configPath
 func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
@@ -190,6 +248,11 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 		MulchSuperUser:        "admin",
 		MulchSuperUserSSHKey:  "mulch_super_user",
 		AutoRebuildTime:       "23:30",
+		AutoRebuildMaxConc:    1,
+		AutoBackupTime:        "03:00",
+		LogMaxSizeMB:          1024,
+		LogMaxAgeDays:         30,
+		AlertDedupWindow:      "10m",
 	}
 
 	meta, err := toml.DecodeFile(filename, tConfig)
@@ -253,19 +316,32 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig.ProxyChainChildURL = tConfig.ProxyChainChildURL
 	appConfig.ProxyChainPSK = tConfig.ProxyChainPSK
 
-	partsAr := strings.Split(tConfig.AutoRebuildTime, ":")
-	if len(partsAr) != 2 {
-		return nil, fmt.Errorf("auto_rebuild_time: '%s': wrong format (HH:MM needed)", tConfig.AutoRebuildTime)
+	err = checkConfigTime("auto_rebuild_time", tConfig.AutoRebuildTime)
+	if err != nil {
+		return nil, err
 	}
-	hour, err := strconv.Atoi(partsAr[0])
-	if err != nil || hour > 23 || hour < 0 {
-		return nil, fmt.Errorf("auto_rebuild_time: '%s': invalid hour", tConfig.AutoRebuildTime)
+	appConfig.AutoRebuildTime = tConfig.AutoRebuildTime
+
+	if tConfig.AutoRebuildMaxConc < 1 {
+		return nil, fmt.Errorf("auto_rebuild_max_concurrent: must be at least 1")
 	}
-	minute, err := strconv.Atoi(partsAr[1])
-	if err != nil || minute > 59 || minute < 0 {
-		return nil, fmt.Errorf("auto_rebuild_time: '%s': invalid minute", tConfig.AutoRebuildTime)
+	appConfig.AutoRebuildMaxConcurrent = tConfig.AutoRebuildMaxConc
+
+	err = checkConfigTime("auto_backup_time", tConfig.AutoBackupTime)
+	if err != nil {
+		return nil, err
 	}
-	appConfig.AutoRebuildTime = tConfig.AutoRebuildTime
+	appConfig.AutoBackupTime = tConfig.AutoBackupTime
+
+	if tConfig.LogMaxSizeMB < 1 {
+		return nil, fmt.Errorf("log_max_size_mb: must be at least 1")
+	}
+	appConfig.LogMaxSizeMB = tConfig.LogMaxSizeMB
+
+	if tConfig.LogMaxAgeDays < 1 {
+		return nil, fmt.Errorf("log_max_age_days: must be at least 1")
+	}
+	appConfig.LogMaxAgeDays = tConfig.LogMaxAgeDays
 
 	for _, seed := range tConfig.Seed {
 		if seed.Name == "" {
@@ -384,10 +460,116 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 		appConfig.Origins[origin.Name] = &origConf
 	}
 
+	dedupWindow, err := time.ParseDuration(tConfig.AlertDedupWindow)
+	if err != nil || dedupWindow < 0 {
+		return nil, fmt.Errorf("alert_dedup_window: invalid value '%s'", tConfig.AlertDedupWindow)
+	}
+	appConfig.AlertDedupWindow = dedupWindow
+
+	alertNames := make(map[string]bool)
+	for _, tAlert := range tConfig.Alert {
+		alert, err := checkConfigAlert(tAlert)
+		if err != nil {
+			return nil, err
+		}
+
+		if alertNames[alert.Name] {
+			return nil, fmt.Errorf("duplicate alert '%s'", alert.Name)
+		}
+		alertNames[alert.Name] = true
+
+		appConfig.Alerts = append(appConfig.Alerts, alert)
+	}
+
 	return appConfig, nil
 }
 
+// checkConfigAlert checks an alert channel setting
+func checkConfigAlert(tAlert tomlConfigAlert) (*ConfigAlert, error) {
+	if tAlert.Name == "" {
+		return nil, fmt.Errorf("alert 'name' not defined")
+	}
+
+	if !IsValidName(tAlert.Name) {
+		return nil, fmt.Errorf("'%s' is not a valid alert name", tAlert.Name)
+	}
+
+	alert := &ConfigAlert{
+		Name:         tAlert.Name,
+		URL:          tAlert.URL,
+		Secret:       tAlert.Secret,
+		SMTPServer:   tAlert.SMTPServer,
+		SMTPUser:     tAlert.SMTPUser,
+		SMTPPassword: tAlert.SMTPPassword,
+		From:         tAlert.From,
+		To:           tAlert.To,
+		MinSeverity:  tAlert.MinSeverity,
+		VMTags:       tAlert.VMTags,
+		Subjects:     tAlert.Subjects,
+		MaxPerHour:   tAlert.MaxPerHour,
+	}
+
+	switch tAlert.Type {
+	case AlertChannelWebhook, AlertChannelSlack:
+		if tAlert.URL == "" {
+			return nil, fmt.Errorf("alert '%s': 'url' parameter is required for '%s' type", tAlert.Name, tAlert.Type)
+		}
+		if _, err := url.ParseRequestURI(tAlert.URL); err != nil {
+			return nil, fmt.Errorf("alert '%s': invalid url '%s'", tAlert.Name, tAlert.URL)
+		}
+		if tAlert.Type == AlertChannelSlack && tAlert.Secret != "" {
+			return nil, fmt.Errorf("alert '%s': 'secret' parameter is only valid for '%s' type", tAlert.Name, AlertChannelWebhook)
+		}
+	case AlertChannelSMTP:
+		if _, _, err := net.SplitHostPort(tAlert.SMTPServer); err != nil {
+			return nil, fmt.Errorf("alert '%s': invalid 'smtp_server' parameter (ex: 'smtp.example.com:587')", tAlert.Name)
+		}
+		if tAlert.From == "" || len(tAlert.To) == 0 {
+			return nil, fmt.Errorf("alert '%s': 'from' and 'to' parameters are required for '%s' type", tAlert.Name, AlertChannelSMTP)
+		}
+	default:
+		return nil, fmt.Errorf("alert '%s': unknown type '%s'", tAlert.Name, tAlert.Type)
+	}
+	alert.Type = tAlert.Type
+
+	if alert.MinSeverity == "" {
+		alert.MinSeverity = AlertSeverityInfo
+	}
+	if _, exists := alertSeverityLevels[alert.MinSeverity]; !exists {
+		return nil, fmt.Errorf("alert '%s': invalid min_severity '%s' (info, warning, critical)", tAlert.Name, alert.MinSeverity)
+	}
+
+	for _, pattern := range alert.Subjects {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("alert '%s': invalid subject pattern '%s'", tAlert.Name, pattern)
+		}
+	}
+
+	if alert.MaxPerHour < 0 {
+		return nil, fmt.Errorf("alert '%s': max_per_hour must be positive", tAlert.Name)
+	}
+
+	return alert, nil
+}
+
 // GetTemplateFilepath returns a path to a etc/template file
 func (conf *AppConfig) GetTemplateFilepath(name string) string {
 	return path.Clean(conf.configPath + "/templates/" + name)
 }
+
+// checkConfigTime checks a "HH:MM" setting
+func checkConfigTime(name string, value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("%s: '%s': wrong format (HH:MM needed)", name, value)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour > 23 || hour < 0 {
+		return fmt.Errorf("%s: '%s': invalid hour", name, value)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute > 59 || minute < 0 {
+		return fmt.Errorf("%s: '%s': invalid minute", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// Audit log file rotation: when the current file exceeds AuditLogMaxSize,
+// it's renamed to .1 (.1 to .2, etc) and the oldest one is deleted.
+const (
+	AuditLogMaxSize  = 10 * 1024 * 1024
+	AuditLogMaxFiles = 5
+)
+
+// form params recorded in the audit log (all others are ignored, they may
+// be large or sensitive)
+var auditLogParams = []string{"action", "revision", "force"}
+
+// AuditEntry is an authenticated API call
+type AuditEntry struct {
+	Time     time.Time
+	Key      string // API key comment
+	IP       string
+	Method   string
+	Path     string
+	Params   map[string]string
+	Success  bool
+	Status   int
+	Duration time.Duration
+}
+
+// AuditLog is an append-only on-disk log of API calls
+type AuditLog struct {
+	filename string
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+	app      *App
+}
+
+// NewAuditLog opens (or creates) the audit log file
+func NewAuditLog(filename string, app *App) (*AuditLog, error) {
+	al := &AuditLog{
+		filename: filename,
+		app:      app,
+	}
+
+	err := al.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	f, err := os.OpenFile(al.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	al.file = f
+	al.size = stat.Size()
+	return nil
+}
+
+func (al *AuditLog) rotatedFilename(n int) string {
+	if n == 0 {
+		return al.filename
+	}
+	return fmt.Sprintf("%s.%d", al.filename, n)
+}
+
+// must be called with the mutex locked
+func (al *AuditLog) rotate() error {
+	al.file.Close()
+
+	os.Remove(al.rotatedFilename(AuditLogMaxFiles - 1))
+	for n := AuditLogMaxFiles - 2; n >= 0; n-- {
+		src := al.rotatedFilename(n)
+		if _, err := os.Stat(src); err == nil {
+			err = os.Rename(src, al.rotatedFilename(n+1))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return al.open()
+}
+
+// Add appends an entry to the audit log. Errors are only logged, an
+// audit failure must not break the API call.
+func (al *AuditLog) Add(entry *AuditEntry) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		al.app.Log.Errorf("audit log: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if al.size+int64(len(line)) > AuditLogMaxSize {
+		err = al.rotate()
+		if err != nil {
+			al.app.Log.Errorf("audit log rotation: %s", err)
+			return
+		}
+	}
+
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		al.app.Log.Errorf("audit log: %s", err)
+	}
+}
+
+// AddRequest records an API request, once handled
+func (al *AuditLog) AddRequest(req *Request, status int, start time.Time) {
+	r := req.HTTP
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// form is not parsed here (it may be a large upload not read by
+	// the handler), so we only get params if the handler parsed them
+	params := make(map[string]string)
+	for _, name := range auditLogParams {
+		val := r.URL.Query().Get(name)
+		if r.Form != nil {
+			val = r.Form.Get(name)
+		}
+		if val != "" {
+			params[name] = val
+		}
+	}
+
+	al.Add(&AuditEntry{
+		Time:     start,
+		Key:      req.APIKey.Comment,
+		IP:       ip,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Params:   params,
+		Success:  status < 400 && (req.Stream == nil || !req.Stream.HasFailures()),
+		Status:   status,
+		Duration: time.Since(start),
+	})
+}
+
+// open all audit files, oldest first (the current one is limited to its
+// actual size, so we don't read a line being written)
+func (al *AuditLog) openFiles() ([]*os.File, []io.Reader, error) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	var files []*os.File
+	var readers []io.Reader
+	for n := AuditLogMaxFiles - 1; n >= 0; n-- {
+		f, err := os.Open(al.rotatedFilename(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, f)
+		if n == 0 {
+			readers = append(readers, io.LimitReader(f, al.size))
+		} else {
+			readers = append(readers, f)
+		}
+	}
+	return files, readers, nil
+}
+
+// Search returns entries matching the API key comment (if not empty)
+// and more recent than since, oldest first. Files are opened with the
+// mutex locked (rotation), but read without it, so API calls are not
+// blocked during the search.
+func (al *AuditLog) Search(key string, since time.Time) ([]*AuditEntry, error) {
+	files, readers, err := al.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	res := []*AuditEntry{}
+	for _, reader := range readers {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			var entry AuditEntry
+			err := json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				// truncated line (crash?), not fatal
+				continue
+			}
+			if entry.Time.Before(since) {
+				continue
+			}
+			if key != "" && entry.Key != key {
+				continue
+			}
+			res = append(res, &entry)
+		}
+		err = scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// ToAPI converts the entry to its API counterpart
+func (entry *AuditEntry) ToAPI() common.APIAuditEntry {
+	return common.APIAuditEntry{
+		Time:     entry.Time,
+		Key:      entry.Key,
+		IP:       entry.IP,
+		Method:   entry.Method,
+		Path:     entry.Path,
+		Params:   entry.Params,
+		Success:  entry.Success,
+		Status:   entry.Status,
+		Duration: entry.Duration,
+	}
+}
+
+// auditResponseWriter captures the status code of a response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, needed by stream routes
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
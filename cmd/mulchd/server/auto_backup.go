@@ -0,0 +1,293 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AutoBackupAuthorKey is the author of automatic backups (it's also used
+// to find them, since manual backups are never affected by retention)
+const AutoBackupAuthorKey = "[auto-backup]"
+
+// extra time given to a kept backup, so it's not deleted right before
+// the next automatic backup is done
+const autoBackupRetentionMargin = 24 * time.Hour
+
+// AutoBackupScheduler will schedule automatic backups of VMs (see
+// auto_backup VM setting) and apply retention policies
+type AutoBackupScheduler struct {
+	app     *App
+	mutex   sync.Mutex
+	pending map[string]bool      // VM name
+	missed  map[string]time.Time // VM name -> postponed run date
+	queue   chan *VMName
+}
+
+// NewAutoBackupScheduler instanciates a new scheduler
+func NewAutoBackupScheduler(app *App) *AutoBackupScheduler {
+	return &AutoBackupScheduler{
+		app:     app,
+		pending: make(map[string]bool),
+		missed:  make(map[string]time.Time),
+		queue:   make(chan *VMName, 1024),
+	}
+}
+
+// Run the scheduler loop (blocking)
+func (abs *AutoBackupScheduler) Run() {
+	abs.app.VMStateDB.WaitRestore()
+
+	// backups are done one at a time
+	go abs.worker()
+
+	for {
+		// wait for the beginning of the next minute
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		abs.check(time.Now())
+	}
+}
+
+// check all active VMs and queue backups that are due (or postponed)
+func (abs *AutoBackupScheduler) check(now time.Time) {
+	app := abs.app
+
+	vmNames := app.VMDB.GetNames()
+	names := make(map[string]bool)
+	for _, vmName := range vmNames {
+		names[vmName.Name] = true
+	}
+
+	// forget postponed backups of deleted VMs
+	abs.mutex.Lock()
+	for name := range abs.missed {
+		if !names[name] {
+			delete(abs.missed, name)
+		}
+	}
+	abs.mutex.Unlock()
+
+	for _, vmName := range vmNames {
+		entry, err := app.VMDB.GetEntryByName(vmName)
+		if err != nil || !entry.Active {
+			continue
+		}
+
+		sched, err := ParseSchedule(entry.VM.Config.AutoBackup)
+		if err != nil || sched == nil {
+			continue
+		}
+
+		// a failed attempt counts as a run, or a one-shot schedule
+		// would be retried forever
+		last := entry.VM.LastAutoBackupTry
+		backups := autoBackupList(entry.VM.Config.Name, app)
+		if len(backups) > 0 && backups[0].Created.After(last) {
+			last = backups[0].Created
+		}
+
+		abs.mutex.Lock()
+		missedSince, missed := abs.missed[vmName.Name]
+		abs.mutex.Unlock()
+		missed = missed && now.Sub(missedSince) >= scheduleRetryDelay
+
+		if !sched.IsDue(now, last, app.Config.AutoBackupTime) && !missed {
+			continue
+		}
+
+		abs.mutex.Lock()
+		exists := abs.pending[vmName.Name]
+		abs.pending[vmName.Name] = true
+		abs.mutex.Unlock()
+
+		if !exists {
+			abs.queue <- vmName
+		}
+	}
+}
+
+func (abs *AutoBackupScheduler) worker() {
+	app := abs.app
+	for vmName := range abs.queue {
+		err := autoBackupVM(vmName, app)
+
+		postponed := errors.Is(err, errSchedulePostponed)
+
+		abs.mutex.Lock()
+		if postponed {
+			abs.missed[vmName.Name] = time.Now()
+		} else {
+			delete(abs.missed, vmName.Name)
+		}
+		abs.mutex.Unlock()
+
+		if postponed {
+			app.Log.Warningf("auto-backup of %s postponed, retry in %s: %s", vmName, scheduleRetryDelay, err)
+		} else if err != nil {
+			app.Log.Errorf("error during auto-backup of %s: %s", vmName, err)
+			app.AlertSender.Send(&Alert{
+				Type:     AlertTypeBad,
+				Severity: AlertSeverityWarning,
+				Subject:  "Auto-backup",
+				Content:  fmt.Sprintf("error during backup of %s: %s", vmName.ID(), err),
+				VMName:   vmName.Name,
+			})
+		}
+
+		abs.mutex.Lock()
+		delete(abs.pending, vmName.Name)
+		abs.mutex.Unlock()
+	}
+}
+
+func autoBackupVM(vmName *VMName, app *App) error {
+	vm, err := app.VMDB.GetByName(vmName)
+	if err != nil {
+		// VM was deleted while queued
+		return nil
+	}
+
+	log := NewLog(vm.Config.Name, app.Hub, app.LogHistory)
+
+	op := &Operation{
+		Origin:        "[auto-backup]",
+		Action:        "backup",
+		Ressource:     "vm",
+		RessourceName: vmName.ID(),
+	}
+	operation, err := app.Operations.AddVM(op, vmName.Name)
+	if err != nil {
+		// will be retried, see scheduleRetryDelay
+		return fmt.Errorf("%w: %s", errSchedulePostponed, err)
+	}
+	defer app.Operations.Remove(operation)
+
+	vm.LastAutoBackupTry = time.Now()
+	err = app.VMDB.Update()
+	if err != nil {
+		return err
+	}
+
+	running, _ := VMIsRunning(vmName, app)
+	if !running {
+		// VM is down, this is not an error
+		log.Infof("auto-backup skipped, %s is down", vmName)
+		return nil
+	}
+
+	log.Infof("auto-backup of %s", vmName)
+
+	backupName, err := VMBackup(op.Context(), vmName, AutoBackupAuthorKey, app, log, BackupCompressAllow, BackupNoExpiration)
+	app.VMHistory.Add(vmName, NewVMHistoryEvent(VMEventBackup, op.Origin, err, "backup %s", backupName))
+	if err != nil {
+		log.Errorf("auto-backup failed for %s", vmName)
+		return err
+	}
+
+	return AutoBackupApplyRetention(vm.Config.Name, vm.Config.BackupRetention, app)
+}
+
+// autoBackupList returns automatic backups of a VM, newest first
+func autoBackupList(vmName string, app *App) []*Backup {
+	var res []*Backup
+	for _, name := range app.BackupsDB.GetNames() {
+		backup := app.BackupsDB.GetByName(name)
+		if backup == nil || backup.AuthorKey != AutoBackupAuthorKey {
+			continue
+		}
+		if backup.VM == nil || backup.VM.Config == nil || backup.VM.Config.Name != vmName {
+			continue
+		}
+		res = append(res, backup)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.After(res[j].Created)
+	})
+	return res
+}
+
+// AutoBackupApplyRetention sets expiration dates of automatic backups of
+// a VM. The newest backup of each day, week and month is kept, up to the
+// number of backups given in the retention, and will expire when it leaves
+// its period. Other automatic backups will expire right now (see
+// BackupDatabase.Run).
+func AutoBackupApplyRetention(vmName string, retention *VMBackupRetention, app *App) error {
+	if retention == nil {
+		return nil
+	}
+
+	backups := autoBackupList(vmName, app)
+	expires := make(map[string]time.Time)
+
+	periods := []struct {
+		count  int
+		key    func(t time.Time) string
+		expire func(t time.Time) time.Time
+	}{
+		{
+			count:  retention.Daily,
+			key:    func(t time.Time) string { return t.Format("2006-01-02") },
+			expire: func(t time.Time) time.Time { return t.AddDate(0, 0, retention.Daily) },
+		},
+		{
+			count: retention.Weekly,
+			key: func(t time.Time) string {
+				year, week := t.ISOWeek()
+				return fmt.Sprintf("%d-%d", year, week)
+			},
+			expire: func(t time.Time) time.Time { return t.AddDate(0, 0, 7*retention.Weekly) },
+		},
+		{
+			count:  retention.Monthly,
+			key:    func(t time.Time) string { return t.Format("2006-01") },
+			expire: func(t time.Time) time.Time { return t.AddDate(0, retention.Monthly, 0) },
+		},
+	}
+
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for _, backup := range backups {
+			if len(seen) >= period.count {
+				break
+			}
+			key := period.key(backup.Created)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			expire := period.expire(backup.Created).Add(autoBackupRetentionMargin)
+			if expire.After(expires[backup.DiskName]) {
+				expires[backup.DiskName] = expire
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, backup := range backups {
+		expire, kept := expires[backup.DiskName]
+		if !kept {
+			expire = now
+		}
+
+		if backup.Expire.Equal(expire) {
+			continue
+		}
+
+		if !kept {
+			app.Log.Infof("backup '%s' is out of retention, will be deleted", backup.DiskName)
+		}
+
+		err := app.BackupsDB.Expire(backup.DiskName, expire)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
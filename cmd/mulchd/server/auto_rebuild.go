@@ -1,45 +1,298 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 )
 
-// AutoRebuildSchedule will schedule auto-rebuilds
-func AutoRebuildSchedule(app *App) {
+// Auto-rebuild status of a VM
+const (
+	AutoRebuildStatusQueued     = "queued"
+	AutoRebuildStatusRebuilding = "rebuilding"
+)
+
+// AutoRebuildScheduler will schedule auto-rebuilds of VMs, see
+// auto_rebuild VM setting (ParseSchedule)
+type AutoRebuildScheduler struct {
+	app      *App
+	filename string
+	mutex    sync.Mutex
+	slots    chan bool
+	status   map[string]string    // VM ID -> status
+	missed   map[string]time.Time // VM name -> postponed run date
+	state    autoRebuildState
+}
+
+// persistent state of the scheduler
+type autoRebuildState struct {
+	PausedUntil time.Time
+}
+
+// AutoRebuildEntry is the auto-rebuild schedule of a VM
+type AutoRebuildEntry struct {
+	VMName      *VMName
+	Schedule    *Schedule
+	LastRebuild time.Time
+	LastAttempt time.Time // last rebuild or failed attempt
+	Next        time.Time
+	Status      string
+}
+
+// NewAutoRebuildScheduler instanciates a new scheduler, restoring pause state
+// from filename, if any
+func NewAutoRebuildScheduler(filename string, app *App) (*AutoRebuildScheduler, error) {
+	ars := &AutoRebuildScheduler{
+		app:      app,
+		filename: filename,
+		slots:    make(chan bool, app.Config.AutoRebuildMaxConcurrent),
+		status:   make(map[string]string),
+		missed:   make(map[string]time.Time),
+	}
+
+	if _, err := os.Stat(ars.filename); err == nil {
+		err = ars.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := ars.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return ars, nil
+}
+
+func (ars *AutoRebuildScheduler) save() error {
+	f, err := os.Create(ars.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	return enc.Encode(&ars.state)
+}
+
+func (ars *AutoRebuildScheduler) load() error {
+	f, err := os.Open(ars.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	return dec.Decode(&ars.state)
+}
+
+// Run the scheduler loop (blocking)
+func (ars *AutoRebuildScheduler) Run() {
+	app := ars.app
 	app.VMStateDB.WaitRestore()
 	// big relaxing, so we don't compete too much with other things like
 	// seeder rebuilds and other mulchd startup stuff.
 	time.Sleep(15 * time.Minute)
 
 	for {
-		now := time.Now().Format("15:04")
-		if app.Config.AutoRebuildTime == now {
-			autoRebuildStart(app)
+		// wait for the beginning of the next minute
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		if ars.IsPaused() {
+			continue
 		}
-		time.Sleep(time.Minute)
+
+		ars.check(time.Now())
 	}
 }
 
-func autoRebuildStart(app *App) {
-	vmNames := app.VMDB.GetNames()
-	for _, vmName := range vmNames {
-		err := autoRebuildVM(vmName, app)
-		if err != nil {
-			app.Log.Errorf("error rebuilding %s: %s", vmName, err)
-			app.AlertSender.Send(&Alert{
-				Type:    AlertTypeBad,
-				Subject: "Auto-rebuild",
-				Content: fmt.Sprintf("error rebuilding %s, see server log", vmName.ID()),
-			})
+// Pause auto-rebuilds until the given date (zero time or a past date
+// will resume auto-rebuilds). Running rebuilds are not affected.
+func (ars *AutoRebuildScheduler) Pause(until time.Time) error {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	if until.After(time.Now()) {
+		ars.app.Log.Infof("auto-rebuilds paused until %s", until.Format("2006-01-02 15:04"))
+	} else {
+		ars.app.Log.Info("auto-rebuilds resumed")
+		until = time.Time{}
+	}
+
+	ars.state.PausedUntil = until
+	return ars.save()
+}
+
+// IsPaused returns true if auto-rebuilds are paused
+func (ars *AutoRebuildScheduler) IsPaused() bool {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	return ars.state.PausedUntil.After(time.Now())
+}
+
+// PausedUntil returns the pause end date (zero time if not paused)
+func (ars *AutoRebuildScheduler) PausedUntil() time.Time {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	if ars.state.PausedUntil.After(time.Now()) {
+		return ars.state.PausedUntil
+	}
+	return time.Time{}
+}
+
+// GetEntries returns the auto-rebuild schedule of all active VMs
+func (ars *AutoRebuildScheduler) GetEntries() []*AutoRebuildEntry {
+	app := ars.app
+	now := time.Now()
+
+	var res []*AutoRebuildEntry
+	for _, vmName := range app.VMDB.GetNames() {
+		entry, err := app.VMDB.GetEntryByName(vmName)
+		if err != nil || !entry.Active {
+			continue
+		}
+
+		sched, err := ParseSchedule(entry.VM.Config.AutoRebuild)
+		if err != nil || sched == nil {
+			continue
+		}
+
+		ars.mutex.Lock()
+		status := ars.status[vmName.ID()]
+		ars.mutex.Unlock()
+
+		// a failed attempt counts as a run, or a one-shot schedule
+		// would be retried forever
+		last := entry.VM.InitDate
+		if entry.VM.LastAutoRebuildTry.After(last) {
+			last = entry.VM.LastAutoRebuildTry
+		}
+
+		res = append(res, &AutoRebuildEntry{
+			VMName:      vmName,
+			Schedule:    sched,
+			LastRebuild: entry.VM.InitDate,
+			LastAttempt: last,
+			Next:        sched.Next(now, last, app.Config.AutoRebuildTime),
+			Status:      status,
+		})
+	}
+	return res
+}
+
+// check all VMs and queue rebuilds that are due (or postponed)
+func (ars *AutoRebuildScheduler) check(now time.Time) {
+	entries := ars.GetEntries()
+	ars.pruneMissed(entries)
+
+	for _, entry := range entries {
+		if !entry.Schedule.IsDue(now, entry.LastAttempt, ars.app.Config.AutoRebuildTime) && !ars.isMissedDue(entry.VMName, now) {
+			continue
+		}
+
+		ars.mutex.Lock()
+		_, exists := ars.status[entry.VMName.ID()]
+		if !exists {
+			ars.status[entry.VMName.ID()] = AutoRebuildStatusQueued
+		}
+		ars.mutex.Unlock()
+
+		if exists {
+			continue
 		}
+
+		go ars.rebuild(entry.VMName)
+	}
+}
+
+// returns true if a postponed rebuild must be retried
+func (ars *AutoRebuildScheduler) isMissedDue(vmName *VMName, now time.Time) bool {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	since, exists := ars.missed[vmName.Name]
+	return exists && now.Sub(since) >= scheduleRetryDelay
+}
+
+// forget postponed rebuilds of deleted VMs
+func (ars *AutoRebuildScheduler) pruneMissed(entries []*AutoRebuildEntry) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.VMName.Name] = true
+	}
+	for name := range ars.missed {
+		if !names[name] {
+			delete(ars.missed, name)
+		}
+	}
+}
+
+func (ars *AutoRebuildScheduler) setMissed(vmName *VMName, missed bool) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	if missed {
+		ars.missed[vmName.Name] = time.Now()
+	} else {
+		delete(ars.missed, vmName.Name)
+	}
+}
+
+func (ars *AutoRebuildScheduler) setStatus(vmName *VMName, status string) {
+	ars.mutex.Lock()
+	defer ars.mutex.Unlock()
+
+	if status == "" {
+		delete(ars.status, vmName.ID())
+	} else {
+		ars.status[vmName.ID()] = status
+	}
+}
+
+// wait for a free slot and rebuild the VM
+func (ars *AutoRebuildScheduler) rebuild(vmName *VMName) {
+	app := ars.app
+	defer ars.setStatus(vmName, "")
+
+	ars.slots <- true
+	defer func() { <-ars.slots }()
+
+	ars.setStatus(vmName, AutoRebuildStatusRebuilding)
+
+	err := autoRebuildVM(vmName, app)
+	if errors.Is(err, errSchedulePostponed) {
+		app.Log.Warningf("auto-rebuild of %s postponed, retry in %s: %s", vmName, scheduleRetryDelay, err)
+		ars.setMissed(vmName, true)
+		return
+	}
+	ars.setMissed(vmName, false)
+
+	if err != nil {
+		app.Log.Errorf("error rebuilding %s: %s", vmName, err)
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Auto-rebuild",
+			Content: fmt.Sprintf("error rebuilding %s, see server log", vmName.ID()),
+			VMName:  vmName.Name,
+		})
 	}
 }
 
 func autoRebuildVM(vmName *VMName, app *App) error {
 	entry, err := app.VMDB.GetEntryByName(vmName)
 	if err != nil {
-		return err
+		// VM was deleted while queued
+		return nil
 	}
 
 	// we currently rebuild only active VMs
@@ -47,40 +300,43 @@ func autoRebuildVM(vmName *VMName, app *App) error {
 		return nil
 	}
 
-	running, _ := VMIsRunning(vmName, app)
-	if !running {
-		// VM is down, this is not an error (i guess?)
-		return nil
-	}
-
 	vm, err := app.VMDB.GetByName(vmName)
 	if err != nil {
 		return err
 	}
 
-	// Depending on the rebuild order and rebuild duration,
-	// we may miss a rebuild for a few minutes (and it's quite important
-	// for VMAutoRebuildDaily). So we use a time margin of half a day. This
-	// is a simple and cheap way to fix this (until rebuilds take half a
-	// day, but we're not there).
-	timeMargin := 12 * time.Hour
-
-	if !IsRebuildNeeded(vm.Config.AutoRebuild, vm.InitDate.Add(-timeMargin)) {
-		return nil
-	}
-
 	log := NewLog(vm.Config.Name, app.Hub, app.LogHistory)
-	log.Infof("auto-rebuilding %s", vmName)
 
-	operation := app.Operations.Add(&Operation{
+	op := &Operation{
 		Origin:        "[auto-rebuilder]",
 		Action:        "rebuild",
 		Ressource:     "vm",
 		RessourceName: entry.Name.ID(),
-	})
+	}
+	operation, err := app.Operations.AddVM(op, vmName.Name)
+	if err != nil {
+		// will be retried, see scheduleRetryDelay
+		return fmt.Errorf("%w: %s", errSchedulePostponed, err)
+	}
 	defer app.Operations.Remove(operation)
 
-	errR := VMRebuild(vmName, false, vm.AuthorKey, app, log)
+	vm.LastAutoRebuildTry = time.Now()
+	err = app.VMDB.Update()
+	if err != nil {
+		return err
+	}
+
+	running, _ := VMIsRunning(vmName, app)
+	if !running {
+		// VM is down, this is not an error (i guess?)
+		log.Infof("auto-rebuild skipped, %s is down", vmName)
+		return nil
+	}
+
+	log.Infof("auto-rebuilding %s", vmName)
+
+	errR := VMRebuild(op.Context(), vmName, false, vm.AuthorKey, app, log)
+	app.VMHistory.AddRebuild(vmName, op.Origin, errR)
 
 	// log on VM target
 	if errR != nil {
@@ -94,6 +350,7 @@ func autoRebuildVM(vmName *VMName, app *App) error {
 }
 
 // IsRebuildNeeded return true if lastRebuild is older than rebuildSetting
+// (daily, weekly or monthly)
 func IsRebuildNeeded(rebuildSetting string, lastRebuild time.Time) bool {
 	sinceLastRebuild := time.Since(lastRebuild)
 
@@ -210,5 +210,5 @@ func (db *BackupDatabase) Expire(name string, expire time.Time) error {
 	}
 
 	db.db[name].Expire = expire
-	return nil
+	return db.save()
 }
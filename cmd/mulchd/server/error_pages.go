@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// VMErrorPageSave stores a custom error page for a VM revision and records
+// it in the VM (the caller must update the VM database)
+func VMErrorPageSave(vm *VM, vmName *VMName, status int, content io.Reader, app *App) error {
+	if !common.IsValidErrorPageStatus(status) {
+		return fmt.Errorf("invalid status %d (allowed: %v)", status, common.ErrorPageStatuses)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(content, common.ErrorPageMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > common.ErrorPageMaxSize {
+		return fmt.Errorf("page is too large (max %d bytes)", common.ErrorPageMaxSize)
+	}
+
+	filename := common.ErrorPageFilename(app.Config.DataPath, vmName.ID(), status)
+	err = os.MkdirAll(path.Dir(filename), 0750)
+	if err != nil {
+		return err
+	}
+
+	// atomic replace, the proxy may read the page at any time
+	tmpFilename := filename + ".tmp"
+	err = os.WriteFile(tmpFilename, data, 0640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return err
+	}
+
+	// copy, the VM database may be reading this map
+	pages := make(map[int]string, len(vm.ErrorPages)+1)
+	for s, f := range vm.ErrorPages {
+		pages[s] = f
+	}
+	pages[status] = filename
+	vm.ErrorPages = pages
+
+	return nil
+}
+
+// VMErrorPagesFetch downloads custom error pages of the VM config
+// (see error_pages setting)
+func VMErrorPagesFetch(vm *VM, vmName *VMName, app *App, log *Log) error {
+	for status, pageURL := range vm.Config.ErrorPages {
+		stream, err := app.Origins.GetContent(pageURL)
+		if err != nil {
+			return fmt.Errorf("unable to get page '%s': %s", pageURL, err)
+		}
+
+		err = VMErrorPageSave(vm, vmName, status, stream, app)
+		stream.Close()
+		if err != nil {
+			return fmt.Errorf("page '%s': %s", pageURL, err)
+		}
+		log.Infof("error page %d: %s", status, pageURL)
+	}
+	return nil
+}
+
+// VMErrorPagesRedefine applies error_pages changes of a redefine (the VM
+// config is not modified): new or modified pages are fetched, and pages
+// removed from the config are deleted (the caller must update the VM database)
+func VMErrorPagesRedefine(vm *VM, vmName *VMName, newPages map[int]string, app *App, log *Log) error {
+	oldPages := vm.Config.ErrorPages
+
+	for status, pageURL := range newPages {
+		if oldPages[status] == pageURL {
+			continue
+		}
+
+		stream, err := app.Origins.GetContent(pageURL)
+		if err != nil {
+			return fmt.Errorf("unable to get page '%s': %s", pageURL, err)
+		}
+
+		err = VMErrorPageSave(vm, vmName, status, stream, app)
+		stream.Close()
+		if err != nil {
+			return fmt.Errorf("page '%s': %s", pageURL, err)
+		}
+		log.Infof("error page %d: %s", status, pageURL)
+	}
+
+	removed := false
+	for status := range oldPages {
+		if _, exists := newPages[status]; exists {
+			continue
+		}
+		err := os.Remove(common.ErrorPageFilename(app.Config.DataPath, vmName.ID(), status))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed = true
+		log.Infof("error page %d removed", status)
+	}
+
+	if removed {
+		// copy, the VM database may be reading this map
+		pages := make(map[int]string, len(vm.ErrorPages))
+		for status, filename := range vm.ErrorPages {
+			if _, exists := newPages[status]; exists || oldPages[status] == "" {
+				pages[status] = filename
+			}
+		}
+		vm.ErrorPages = pages
+	}
+
+	return nil
+}
+
+// VMErrorPagesDelete removes all custom error pages of a VM revision
+func VMErrorPagesDelete(vmName *VMName, app *App) error {
+	dir := path.Clean(app.Config.DataPath + "/" + common.ErrorPagesDir + "/" + vmName.ID())
+	return os.RemoveAll(dir)
+}
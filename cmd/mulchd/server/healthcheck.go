@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VM health states
+const (
+	VMHealthUnknown   = "unknown"
+	VMHealthHealthy   = "healthy"
+	VMHealthUnhealthy = "unhealthy"
+)
+
+// Healthcheck settings
+const (
+	VMHealthcheckDefaultInterval = 1 * time.Minute
+	VMHealthcheckMinInterval     = 10 * time.Second
+	VMHealthcheckTimeout         = 10 * time.Second
+
+	// consecutive failures before a VM is declared unhealthy
+	VMHealthcheckMaxFailures = 3
+)
+
+// VMHealth is the health state of a VM (see VMHealthcheck)
+type VMHealth struct {
+	State     string
+	Since     time.Time
+	LastCheck time.Time
+	LastError string
+	failures  int
+	running   bool
+}
+
+// HealthChecker probes active and running VMs with a healthcheck
+// setting (and not in maintenance mode), and sends alerts on health
+// state changes
+type HealthChecker struct {
+	states map[string]*VMHealth // by VM name
+	mutex  sync.Mutex
+	client *http.Client
+	app    *App
+}
+
+// NewHealthChecker creates a new HealthChecker
+func NewHealthChecker(app *App) *HealthChecker {
+	return &HealthChecker{
+		states: make(map[string]*VMHealth),
+		client: &http.Client{
+			Timeout: VMHealthcheckTimeout,
+			// a redirect is a valid answer (see expect_status)
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		app: app,
+	}
+}
+
+// Run the healthcheck loop
+func (hc *HealthChecker) Run() {
+	hc.app.VMStateDB.WaitRestore()
+
+	for {
+		hc.schedule()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// start checks that are due, and forget VMs that are no longer checked
+func (hc *HealthChecker) schedule() {
+	vmStates := hc.app.VMStateDB.Get()
+	checked := make(map[string]bool)
+
+	for _, vmName := range hc.app.VMDB.GetNames() {
+		entry, err := hc.app.VMDB.GetEntryByName(vmName)
+		if err != nil {
+			continue
+		}
+		vm := entry.VM
+		if !entry.Active || vm.Config.Healthcheck == nil || vm.Maintenance {
+			continue
+		}
+		if vmStates[vmName.ID()] != VMStateUp {
+			continue
+		}
+		checked[vmName.Name] = true
+
+		// VM may be busy (backup, restore, …), try later
+		if vm.WIP != VMOperationNone {
+			continue
+		}
+
+		hc.mutex.Lock()
+		health, exists := hc.states[vmName.Name]
+		if !exists {
+			health = &VMHealth{
+				State: VMHealthUnknown,
+				Since: time.Now(),
+			}
+			hc.states[vmName.Name] = health
+		}
+		due := !health.running && time.Since(health.LastCheck) >= vm.Config.Healthcheck.Interval
+		if due {
+			health.running = true
+		}
+		hc.mutex.Unlock()
+
+		if due {
+			go hc.check(vmName, vm)
+		}
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	for name := range hc.states {
+		if !checked[name] {
+			delete(hc.states, name)
+		}
+	}
+}
+
+func (hc *HealthChecker) check(vmName *VMName, vm *VM) {
+	err := hc.probe(vm)
+
+	hc.mutex.Lock()
+	health, exists := hc.states[vmName.Name]
+	if !exists {
+		hc.mutex.Unlock()
+		return
+	}
+
+	health.running = false
+	health.LastCheck = time.Now()
+
+	var alert *Alert
+	if err == nil {
+		health.failures = 0
+		health.LastError = ""
+		if health.State != VMHealthHealthy {
+			if health.State == VMHealthUnhealthy {
+				alert = &Alert{
+					Type:    AlertTypeGood,
+					Subject: fmt.Sprintf("VM %s is healthy", vmName.Name),
+					Content: fmt.Sprintf("VM %s healthcheck is OK again (was unhealthy for %s)", vmName, time.Since(health.Since).Truncate(time.Second)),
+					VMName:  vmName.Name,
+				}
+			}
+			health.State = VMHealthHealthy
+			health.Since = time.Now()
+		}
+	} else {
+		health.failures++
+		health.LastError = err.Error()
+		if health.State != VMHealthUnhealthy && health.failures >= VMHealthcheckMaxFailures {
+			health.State = VMHealthUnhealthy
+			health.Since = time.Now()
+			alert = &Alert{
+				Type:    AlertTypeBad,
+				Subject: fmt.Sprintf("VM %s is unhealthy", vmName.Name),
+				Content: fmt.Sprintf("VM %s healthcheck failed %d times: %s", vmName, health.failures, err),
+				VMName:  vmName.Name,
+			}
+		}
+	}
+	hc.mutex.Unlock()
+
+	if alert != nil {
+		hc.app.Log.Warning(alert.Content)
+		hc.app.AlertSender.Send(alert)
+	}
+}
+
+// HTTP request to the VM, using the libvirt network
+func (hc *HealthChecker) probe(vm *VM) error {
+	check := vm.Config.Healthcheck
+
+	ip := vm.AssignedIPv4
+	if ip == "" {
+		ip = vm.LastIP
+	}
+	if ip == "" {
+		return fmt.Errorf("unknown VM IP address")
+	}
+
+	url := "http://" + net.JoinHostPort(ip, strconv.Itoa(check.Port)) + check.URL
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	// use the first proxied domain of the VM for name-based virtual hosts
+	for _, domain := range vm.Config.Domains {
+		if domain.RedirectTo == "" {
+			req.Host = domain.Name
+			break
+		}
+	}
+	req.Header.Set("User-Agent", "mulch-healthcheck")
+
+	res, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode != check.ExpectStatus {
+		return fmt.Errorf("%s returned status %d (expected %d)", check.URL, res.StatusCode, check.ExpectStatus)
+	}
+	return nil
+}
+
+// Get returns the health of a VM (nil if the VM is not checked)
+func (hc *HealthChecker) Get(vmName string) *VMHealth {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	health, exists := hc.states[vmName]
+	if !exists {
+		return nil
+	}
+	dup := *health
+	return &dup
+}
+
+// GetState returns the health state of a VM ("" if the VM is not checked)
+func (hc *HealthChecker) GetState(vmName string) string {
+	health := hc.Get(vmName)
+	if health == nil {
+		return ""
+	}
+	return health.State
+}
@@ -446,6 +446,48 @@ func (lv *Libvirt) ResizeDisk(disk string, size uint64, pool *libvirt.StoragePoo
 	return nil
 }
 
+// GetStoragePool returns a storage pool and its description, using the pool
+// name. An empty name returns Mulch disks pool. Use ReleaseStoragePool after use.
+func (lv *Libvirt) GetStoragePool(name string) (*libvirt.StoragePool, *libvirtxml.StoragePool, error) {
+	if name == "" {
+		return lv.Pools.Disks, lv.Pools.DisksXML, nil
+	}
+
+	conn, errC := lv.GetConnection()
+	if errC != nil {
+		return nil, nil, errC
+	}
+
+	pool, err := conn.LookupStoragePoolByName(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage pool '%s': %s", name, err)
+	}
+
+	xmldoc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		pool.Free()
+		return nil, nil, err
+	}
+
+	poolcfg := &libvirtxml.StoragePool{}
+	err = poolcfg.Unmarshal(xmldoc)
+	if err != nil {
+		pool.Free()
+		return nil, nil, err
+	}
+
+	return pool, poolcfg, nil
+}
+
+// ReleaseStoragePool frees a pool returned by GetStoragePool (Mulch pools
+// are never freed)
+func (lv *Libvirt) ReleaseStoragePool(pool *libvirt.StoragePool) {
+	if pool == lv.Pools.Disks || pool == lv.Pools.Seeds || pool == lv.Pools.Backups {
+		return
+	}
+	pool.Free()
+}
+
 // GetDomainByName returns a domain or nil if domain is not foud.
 // Remember to call dom.Free() after use.
 func (lv *Libvirt) GetDomainByName(domainName string) (*libvirt.Domain, error) {
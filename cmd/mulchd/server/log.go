@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/OnitiFR/mulch/common"
 )
@@ -11,6 +12,7 @@ type Log struct {
 	target  string
 	hub     *Hub
 	history *LogHistory
+	failed  atomic.Bool
 }
 
 // NewLog creates a new log for the provided target and hub
@@ -97,6 +99,7 @@ func (log *Log) Successf(format string, args ...interface{}) {
 
 // Failure sends an MessageFailure Message
 func (log *Log) Failure(message string) {
+	log.failed.Store(true)
 	log.Log(common.NewMessage(common.MessageFailure, log.target, message))
 }
 
@@ -106,6 +109,11 @@ func (log *Log) Failuref(format string, args ...interface{}) {
 	log.Failure(msg)
 }
 
+// HasFailures returns true if at least one Failure was sent with this log
+func (log *Log) HasFailures() bool {
+	return log.failed.Load()
+}
+
 // SetTarget change the current "sending" target
 func (log *Log) SetTarget(target string) {
 	// You can't send to "*", only listen. But NoTarget does the same
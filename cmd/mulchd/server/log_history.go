@@ -23,6 +23,7 @@ type LogHistory struct {
 	oldest      *logHistorySlot
 	newest      *logHistorySlot
 	mux         sync.Mutex
+	store       *LogStore
 }
 
 // NewLogHistory will create and initialize a new log message history
@@ -32,11 +33,23 @@ func NewLogHistory(elems int) *LogHistory {
 	}
 }
 
+// SetStore enables persistence of (full) messages in a LogStore
+func (lh *LogHistory) SetStore(store *LogStore) {
+	lh.mux.Lock()
+	defer lh.mux.Unlock()
+
+	lh.store = store
+}
+
 // Push a new message in the list
 func (lh *LogHistory) Push(message *common.Message) {
 	lh.mux.Lock()
 	defer lh.mux.Unlock()
 
+	if lh.store != nil {
+		lh.store.Write(message)
+	}
+
 	localMsg := message
 
 	// truncate message if needed
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// LogStoreSearchMaxLines is the maximum number of messages returned by
+// a search
+const LogStoreSearchMaxLines = 50000
+
+const logStoreFilePrefix = "mulchd-"
+const logStoreFileSuffix = ".log"
+const logStoreDateFormat = "2006-01-02"
+
+// messages waiting to be written to disk
+const logStoreQueueSize = 4096
+
+// LogStore is a disk-backed log store (one JSON file per day), with
+// size and age retention. Unlike LogHistory, messages are not truncated.
+type LogStore struct {
+	dir      string
+	maxSize  int64
+	maxAge   time.Duration
+	file     *os.File
+	fileDate string
+	queue    chan *common.Message
+	dropped  atomic.Uint64 // messages dropped since the last report
+	mutex    sync.Mutex
+	app      *App
+}
+
+// LogStoreFilter describes a LogStore search
+type LogStoreFilter struct {
+	Target string   // common.MessageAllTargets for all
+	Types  []string // empty for all types
+	Since  time.Time
+	Until  time.Time // zero for "now"
+	Lines  int       // latest matching messages
+}
+
+// NewLogStore creates a new LogStore in the given directory (created
+// if needed)
+func NewLogStore(dir string, maxSizeMB int, maxAgeDays int, app *App) (*LogStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &LogStore{
+		dir:     dir,
+		maxSize: int64(maxSizeMB) * 1024 * 1024,
+		maxAge:  time.Duration(maxAgeDays) * 24 * time.Hour,
+		queue:   make(chan *common.Message, logStoreQueueSize),
+		app:     app,
+	}
+
+	go ls.writer()
+
+	return ls, nil
+}
+
+func (ls *LogStore) filename(date string) string {
+	return path.Clean(ls.dir + "/" + logStoreFilePrefix + date + logStoreFileSuffix)
+}
+
+// Write queues a message for the store. Messages are written in the
+// background, so a slow disk does not block log producers (LogHistory
+// lock, hub, …). If the queue is full, the message is not stored (the
+// number of dropped messages is reported once the queue is drained).
+func (ls *LogStore) Write(message *common.Message) {
+	select {
+	case ls.queue <- message:
+	default:
+		ls.dropped.Add(1)
+	}
+}
+
+func (ls *LogStore) writer() {
+	for message := range ls.queue {
+		ls.write(message)
+
+		if len(ls.queue) == 0 {
+			if dropped := ls.dropped.Swap(0); dropped > 0 {
+				fmt.Printf("log store: queue was full, %d message(s) dropped\n", dropped)
+			}
+		}
+	}
+}
+
+// Errors are only printed, since logging them would write to the
+// store again.
+func (ls *LogStore) write(message *common.Message) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	date := message.Time.Format(logStoreDateFormat)
+	if ls.file == nil || ls.fileDate != date {
+		if ls.file != nil {
+			ls.file.Close()
+			ls.file = nil
+		}
+		f, err := os.OpenFile(ls.filename(date), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Printf("log store: %s\n", err)
+			return
+		}
+		ls.file = f
+		ls.fileDate = date
+	}
+
+	line, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("log store: %s\n", err)
+		return
+	}
+
+	_, err = ls.file.Write(append(line, '\n'))
+	if err != nil {
+		fmt.Printf("log store: %s\n", err)
+	}
+}
+
+type logStoreFile struct {
+	name string
+	date time.Time
+	size int64
+}
+
+// returns all store files, oldest first
+func (ls *LogStore) files() ([]*logStoreFile, error) {
+	entries, err := os.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*logStoreFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, logStoreFilePrefix) || !strings.HasSuffix(name, logStoreFileSuffix) {
+			continue
+		}
+		dateStr := strings.TrimSuffix(strings.TrimPrefix(name, logStoreFilePrefix), logStoreFileSuffix)
+		date, err := time.ParseInLocation(logStoreDateFormat, dateStr, time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, &logStoreFile{
+			name: path.Clean(ls.dir + "/" + name),
+			date: date,
+			size: info.Size(),
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].date.Before(res[j].date)
+	})
+	return res, nil
+}
+
+// Cleanup deletes files older than maxAge, and oldest files until the
+// total size is below maxSize (the current file is never deleted)
+func (ls *LogStore) Cleanup() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	files, err := ls.files()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+
+	today := time.Now().Format(logStoreDateFormat)
+	for _, file := range files {
+		if file.date.Format(logStoreDateFormat) == today {
+			break
+		}
+		// a file contains a full day, hence the +24h
+		if time.Since(file.date) < ls.maxAge+24*time.Hour && total <= ls.maxSize {
+			break
+		}
+		err := os.Remove(file.name)
+		if err != nil {
+			return err
+		}
+		total -= file.size
+	}
+
+	return nil
+}
+
+// Run the cleanup loop
+func (ls *LogStore) Run() {
+	for {
+		err := ls.Cleanup()
+		if err != nil {
+			ls.app.Log.Errorf("log store cleanup: %s", err)
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+// Search returns the latest messages matching the filter, oldest first
+func (ls *LogStore) Search(filter *LogStoreFilter) ([]*common.Message, error) {
+	ls.mutex.Lock()
+	files, err := ls.files()
+	ls.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	until := filter.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	exact := common.MessageMatchDefault
+	if filter.Target != common.MessageAllTargets {
+		exact = common.MessageMatchExact
+	}
+
+	types := make(map[string]bool)
+	for _, mtype := range filter.Types {
+		types[strings.ToUpper(mtype)] = true
+	}
+
+	var res []*common.Message
+	for _, file := range files {
+		// skip files out of the range
+		if file.date.Add(24*time.Hour).Before(filter.Since) || file.date.After(until) {
+			continue
+		}
+
+		err := ls.searchFile(file.name, func(message *common.Message) {
+			if message.Time.Before(filter.Since) || message.Time.After(until) {
+				return
+			}
+			if len(types) > 0 && !types[message.Type] {
+				return
+			}
+			if !message.MatchTarget(filter.Target, exact) {
+				return
+			}
+			res = append(res, message)
+			if len(res) > 2*filter.Lines {
+				res = res[len(res)-filter.Lines:]
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(res) > filter.Lines {
+		res = res[len(res)-filter.Lines:]
+	}
+	return res, nil
+}
+
+func (ls *LogStore) searchFile(filename string, cb func(*common.Message)) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		// deleted by Cleanup in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var message common.Message
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			// truncated line (crash?), not fatal
+			continue
+		}
+		cb(&message)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// WriteMetrics writes mulchd metrics using Prometheus text format.
+// VM states are taken from VMStateDB, so they may be 10 seconds old.
+func (app *App) WriteMetrics(w io.Writer) error {
+	mw := common.NewMetricsWriter(w)
+
+	mw.Gauge("mulch_start_time_seconds", "Start time of mulchd since unix epoch", float64(app.StartTime.Unix()))
+
+	// VMs
+	states := app.VMStateDB.Get()
+	vmStates := map[string]int{VMStateUp: 0, VMStateDown: 0}
+	vmActive := 0
+	vmLocked := 0
+	for _, vmName := range app.VMDB.GetNames() {
+		entry, err := app.VMDB.GetEntryByName(vmName)
+		if err != nil {
+			continue
+		}
+		if state, exists := states[vmName.ID()]; exists {
+			vmStates[state]++
+		}
+		if entry.Active {
+			vmActive++
+		}
+		if entry.VM.Locked {
+			vmLocked++
+		}
+	}
+	for _, state := range []string{VMStateUp, VMStateDown} {
+		mw.Gauge("mulch_vms", "Number of VMs (all revisions) by state", float64(vmStates[state]), "state", state)
+	}
+	mw.Gauge("mulch_vms_active", "Number of active VMs", float64(vmActive))
+	mw.Gauge("mulch_vms_locked", "Number of locked VMs", float64(vmLocked))
+
+	// operations
+	running := make(map[string]int)
+	for _, op := range app.Operations.GetAll() {
+		running[OperationBaseAction(op.Action)]++
+	}
+	for _, action := range metricsSortedKeys(running) {
+		mw.Gauge("mulch_operations_running", "Number of running operations by action", float64(running[action]), "action", action)
+	}
+
+	stats := app.Operations.GetStats()
+	for _, action := range metricsSortedKeys(stats) {
+		mw.Counter("mulch_operation_duration_seconds_total", "Total duration of finished operations by action", stats[action].TotalDuration.Seconds(), "action", action)
+	}
+	for _, action := range metricsSortedKeys(stats) {
+		mw.Counter("mulch_operations_finished_total", "Number of finished operations by action", float64(stats[action].Count), "action", action)
+	}
+	for _, action := range metricsSortedKeys(stats) {
+		mw.Gauge("mulch_operation_last_duration_seconds", "Duration of the last finished operation by action", stats[action].LastDuration.Seconds(), "action", action)
+	}
+
+	// seeds
+	seedNames := app.Seeder.GetNames()
+	sort.Strings(seedNames)
+	for _, name := range seedNames {
+		seed, err := app.Seeder.GetByName(name)
+		if err != nil {
+			continue
+		}
+		mw.Gauge("mulch_seed_ready", "Seed readiness (1 = ready)", common.MetricBool(seed.Ready), "seed", name)
+	}
+	for _, name := range seedNames {
+		seed, err := app.Seeder.GetByName(name)
+		if err != nil || seed.LastModified.IsZero() {
+			continue
+		}
+		mw.Gauge("mulch_seed_age_seconds", "Age of the seed image", time.Since(seed.LastModified).Seconds(), "seed", name)
+	}
+
+	// backups
+	backupNames := app.BackupsDB.GetNames()
+	var backupSize uint64
+	for _, name := range backupNames {
+		infos, err := app.Libvirt.VolumeInfos(name, app.Libvirt.Pools.Backups)
+		if err != nil {
+			continue
+		}
+		backupSize += infos.Allocation
+	}
+	mw.Gauge("mulch_backups", "Number of backups", float64(len(backupNames)))
+	mw.Gauge("mulch_backups_size_bytes", "Allocated size of all backups", float64(backupSize))
+
+	// misc
+	mw.Gauge("mulch_secrets", "Number of secrets", float64(len(app.SecretsDB.GetKeys())))
+	mw.Gauge("mulch_ssh_sessions", "Number of SSH proxy sessions", float64(len(app.sshClients.getClients())))
+
+	alertStats := app.AlertSender.Stats()
+	mw.Counter("mulch_alerts_sent_total", "Number of sent alerts", float64(alertStats.Sent))
+	mw.Counter("mulch_alert_script_failures_total", "Number of alert script failures", float64(alertStats.ScriptFailures))
+	mw.Counter("mulch_alert_channel_failures_total", "Number of alert channel failures", float64(alertStats.ChannelFailures))
+	mw.Counter("mulch_alerts_throttled_total", "Number of alerts dropped by channel throttling", float64(alertStats.Throttled))
+	mw.Counter("mulch_alerts_duplicates_total", "Number of duplicate alerts skipped", float64(alertStats.Duplicates))
+
+	return mw.Err()
+}
+
+func metricsSortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
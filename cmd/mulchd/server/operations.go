@@ -1,50 +1,251 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"strings"
+	"sync"
 	"time"
-)
 
-// Basic operation list, only for 'status' command currently. That's why
-// it's mostly managed by controllers and not server package.
+	"github.com/OnitiFR/mulch/common"
+)
 
-// A possible enhancement is to get "real" ressources pointers (*VM, *Seed, …)
-// to allow various things like protections (ex: "you can't stop a VM
-// during its rebuild")
+// Operation list, used by 'status' and 'op' commands, and as a lock for VM
+// operations (ex: "you can't stop a VM during its rebuild"), see AddVM.
+// Long operations can be canceled, see Context().
+// It's mostly managed by controllers and not server package.
 
 // Operation on the server
 type Operation struct {
+	ID            string
 	Origin        string // API Key, "[seeder]", "[autorebuild]", …
 	Action        string // delete, remove, rebuild, …
 	Ressource     string // backup, seed, vm, …
 	RessourceName string // VM name, seed name, …
 	StartTime     time.Time
+	Cancellable   bool
+	CanceledBy    string // API Key, if a cancel was requested
+
+	lock   string // locked VM name (all revisions), if any
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // OperationList is a list of currently running operations
 type OperationList struct {
 	operations map[string]*Operation
-	rand       *rand.Rand
+	stats      map[string]*OperationStats
+	mutex      sync.Mutex
+	lastID     int
+}
+
+// OperationStats are statistics about finished operations of an action
+type OperationStats struct {
+	Count         uint64
+	TotalDuration time.Duration
+	LastDuration  time.Duration
+}
+
+// actions that watch their operation context (see Context())
+var operationCancellableActions = map[string]bool{
+	"create":  true,
+	"rebuild": true,
+	"backup":  true,
+	"restore": true,
+	"migrate": true,
+}
+
+// VM actions that can't run concurrently on the same VM
+var operationVMExclusiveActions = map[string]bool{
+	"create":      true,
+	"delete":      true,
+	"rebuild":     true,
+	"redefine":    true,
+	"backup":      true,
+	"restore":     true,
+	"migrate":     true,
+	"clone":       true,
+	"stop":        true,
+	"restart":     true,
+	"import-disk": true,
+	"snapshot":    true,
 }
 
 // NewOperationList instanciates a new OperationList
-func NewOperationList(rand *rand.Rand) *OperationList {
+func NewOperationList() *OperationList {
 	return &OperationList{
 		operations: make(map[string]*Operation),
-		rand:       rand,
+		stats:      make(map[string]*OperationStats),
 	}
 }
 
 // Add an operation to the list
 func (db *OperationList) Add(op *Operation) string {
-	id := fmt.Sprintf("operation-%d", rand.Int31())
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.add(op)
+}
+
+func (db *OperationList) add(op *Operation) string {
+	db.lastID++
+	op.ID = fmt.Sprintf("%d", db.lastID)
 	op.StartTime = time.Now()
-	db.operations[id] = op
-	return id
+	op.Cancellable = operationCancellableActions[op.Action]
+	op.ctx, op.cancel = context.WithCancel(context.Background())
+	db.operations[op.ID] = op
+	return op.ID
+}
+
+// AddVM adds an operation on a VM to the list. If the action is exclusive
+// (rebuild, backup, stop, delete, …), the VM is locked until the operation
+// is removed, and an error is returned if another exclusive operation
+// is already running on this VM (any revision).
+func (db *OperationList) AddVM(op *Operation, vmName string) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if !operationVMExclusiveActions[OperationBaseAction(op.Action)] {
+		return db.add(op), nil
+	}
+
+	for _, other := range db.operations {
+		if other.lock == vmName {
+			return "", fmt.Errorf("VM %s is locked by a '%s' operation from %s, running since %s (%s)",
+				vmName,
+				other.Action,
+				other.Origin,
+				other.StartTime.Format("15:04:05"),
+				time.Since(other.StartTime).Truncate(time.Second),
+			)
+		}
+	}
+
+	op.lock = vmName
+	return db.add(op), nil
+}
+
+// IsVMLocked returns true if an exclusive operation is running on
+// this VM (any revision), see AddVM
+func (db *OperationList) IsVMLocked(vmName string) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, op := range db.operations {
+		if op.lock == vmName {
+			return true
+		}
+	}
+	return false
 }
 
 // Remove an operation from the list
 func (db *OperationList) Remove(id string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	op, exists := db.operations[id]
+	if !exists {
+		return
+	}
+	op.cancel()
 	delete(db.operations, id)
+
+	action := OperationBaseAction(op.Action)
+	stats, exists := db.stats[action]
+	if !exists {
+		stats = &OperationStats{}
+		db.stats[action] = stats
+	}
+	duration := time.Since(op.StartTime)
+	stats.Count++
+	stats.TotalDuration += duration
+	stats.LastDuration = duration
+}
+
+// GetStats returns a copy of finished operations statistics, by action
+func (db *OperationList) GetStats() map[string]OperationStats {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	res := make(map[string]OperationStats, len(db.stats))
+	for action, stats := range db.stats {
+		res[action] = *stats
+	}
+	return res
+}
+
+// OperationBaseAction returns the action without its details
+// (ex: "do:backup" -> "do")
+func OperationBaseAction(action string) string {
+	return strings.SplitN(action, ":", 2)[0]
+}
+
+// Cancel a running operation: its context is canceled, and the operation
+// will abort, running its usual rollback steps
+func (db *OperationList) Cancel(id string, by string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	op, exists := db.operations[id]
+	if !exists {
+		return fmt.Errorf("operation '%s' not found", id)
+	}
+
+	if !op.Cancellable {
+		return fmt.Errorf("operation '%s' (%s) can't be canceled", id, op.Action)
+	}
+
+	if op.CanceledBy != "" {
+		return fmt.Errorf("operation '%s' is already being canceled", id)
+	}
+
+	op.CanceledBy = by
+	op.cancel()
+	return nil
+}
+
+// Context returns the context of the operation, canceled when the
+// operation is canceled (see OperationList.Cancel) or removed
+func (op *Operation) Context() context.Context {
+	return op.ctx
+}
+
+// ErrOperationCanceled is returned when an operation was canceled
+var ErrOperationCanceled = errors.New("operation canceled")
+
+// OperationCheckCanceled returns ErrOperationCanceled if the context
+// was canceled, useful between steps of long operations
+func OperationCheckCanceled(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ErrOperationCanceled
+	}
+	return nil
+}
+
+// GetAll returns a copy of all running operations
+func (db *OperationList) GetAll() []Operation {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	res := make([]Operation, 0, len(db.operations))
+	for _, op := range db.operations {
+		res = append(res, *op)
+	}
+	return res
+}
+
+// ToAPI converts the operation to its API counterpart
+func (op *Operation) ToAPI() common.APIOperation {
+	return common.APIOperation{
+		ID:            op.ID,
+		Origin:        op.Origin,
+		Action:        op.Action,
+		Ressource:     op.Ressource,
+		RessourceName: op.RessourceName,
+		StartTime:     op.StartTime,
+		Cancellable:   op.Cancellable,
+		CanceledBy:    op.CanceledBy,
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 )
 
 // Request describes a request and allows to build a response
@@ -19,6 +20,8 @@ type Request struct {
 	startStreamChan chan bool
 	streamStarted   bool
 	streamMutex     sync.Mutex
+	auditStart      time.Time
+	auditWriter     *auditResponseWriter // nil for public routes
 }
 
 // StartStream indicates that headers have been sent and "body" stream can start
@@ -68,3 +71,11 @@ func (req *Request) IsAPIKeyAllowed() bool {
 
 	return req.APIKey.IsAllowed(method, path, req.HTTP)
 }
+
+// record the (authenticated) request in the audit log
+func (req *Request) addAudit() {
+	if req.auditWriter == nil {
+		return
+	}
+	req.App.AuditLog.AddRequest(req, req.auditWriter.status, req.auditStart)
+}
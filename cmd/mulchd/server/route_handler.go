@@ -35,6 +35,7 @@ type Route struct {
 	Type         int
 	Public       bool
 	NoProtoCheck bool
+	NoAudit      bool // read-only polling routes (ex: metrics scrapes)
 	Handler      func(*Request)
 
 	// decomposed Route
@@ -90,6 +91,7 @@ func routeStreamHandler(request *Request) {
 	closer := make(chan bool)
 	go func() {
 		request.Route.Handler(request)
+		request.addAudit()
 		// let's ensure the last message have time to be flushed
 		time.Sleep(time.Duration(100) * time.Millisecond)
 		select {
@@ -254,12 +256,22 @@ func routeHandleFunc(route *Route, w http.ResponseWriter, r *http.Request, app *
 
 		request.APIKey = key
 
+		request.auditStart = time.Now()
+		request.auditWriter = &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		request.Response = request.auditWriter
+
 		if !request.IsAPIKeyAllowed() {
 			errMsg := "permission denied (rights)"
 			app.Log.Errorf("%d: %s", http.StatusForbidden, errMsg)
-			http.Error(w, errMsg, http.StatusForbidden)
+			http.Error(request.Response, errMsg, http.StatusForbidden)
+			request.addAudit()
 			return
 		}
+
+		// denied calls are still recorded, see above
+		if route.NoAudit {
+			request.auditWriter = nil
+		}
 		app.Log.Tracef("API call: %s %s %s (key: %s)", ip, r.Method, route.path, key.Comment)
 	} else {
 		app.Log.Tracef("API call: %s %s %s", ip, r.Method, route.path)
@@ -272,5 +284,6 @@ func routeHandleFunc(route *Route, w http.ResponseWriter, r *http.Request, app *
 		request.Stream = NewLog("", app.Hub, app.LogHistory)
 		request.streamStarted = true
 		route.Handler(request)
+		request.addAudit()
 	}
 }
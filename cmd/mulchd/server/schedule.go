@@ -0,0 +1,297 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule types
+const (
+	ScheduleTypePeriodic = "periodic" // daily, weekly, monthly
+	ScheduleTypeCron     = "cron"     // "0 3 * * sun"
+	ScheduleTypeAt       = "at"       // "at 2026-01-31 03:00" (one-shot)
+)
+
+// ScheduleAtFormat is the date format for one-shot schedules
+const ScheduleAtFormat = "2006-01-02 15:04"
+
+// Depending on the rebuild order and rebuild duration, we may miss a periodic
+// run for a few minutes (and it's quite important for daily ones). So we
+// use a time margin of half a day. This is a simple and cheap way to fix
+// this (until rebuilds take half a day, but we're not there).
+const schedulePeriodicMargin = 12 * time.Hour
+
+// A scheduled run may be postponed because the VM is locked by another
+// operation. Since IsDue would not match again before the next period,
+// the run is remembered and retried after this delay, until it's done.
+const scheduleRetryDelay = 5 * time.Minute
+
+// errSchedulePostponed is returned by automatic operations when the VM
+// is locked by another operation
+var errSchedulePostponed = errors.New("postponed")
+
+// Schedule describes when an automatic operation must run
+type Schedule struct {
+	Type   string
+	Spec   string
+	Period time.Duration // ScheduleTypePeriodic
+	At     time.Time     // ScheduleTypeAt
+	cron   *cronExpr     // ScheduleTypeCron
+}
+
+// ParseSchedule parses a schedule string: daily, weekly, monthly, a cron
+// expression (minute hour day-of-month month day-of-week) or a one-shot
+// date ("at YYYY-MM-DD HH:MM", local time). An empty string returns nil.
+func ParseSchedule(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	sched := &Schedule{Spec: spec}
+
+	switch spec {
+	case VMAutoRebuildDaily:
+		sched.Type = ScheduleTypePeriodic
+		sched.Period = 24 * time.Hour
+		return sched, nil
+	case VMAutoRebuildWeekly:
+		sched.Type = ScheduleTypePeriodic
+		sched.Period = 7 * 24 * time.Hour
+		return sched, nil
+	case VMAutoRebuildMonthly:
+		sched.Type = ScheduleTypePeriodic
+		sched.Period = 30 * 24 * time.Hour
+		return sched, nil
+	}
+
+	if strings.HasPrefix(spec, "at ") {
+		at, err := time.ParseInLocation(ScheduleAtFormat, strings.TrimSpace(spec[3:]), time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date in '%s' (format: at YYYY-MM-DD HH:MM)", spec)
+		}
+		sched.Type = ScheduleTypeAt
+		sched.At = at
+		return sched, nil
+	}
+
+	cron, err := parseCronExpr(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': %s", spec, err)
+	}
+	sched.Type = ScheduleTypeCron
+	sched.cron = cron
+	return sched, nil
+}
+
+// IsDue returns true if the schedule must run now, given the last run date.
+// dailyTime ("HH:MM") is used by periodic schedules.
+func (sched *Schedule) IsDue(now time.Time, last time.Time, dailyTime string) bool {
+	switch sched.Type {
+	case ScheduleTypePeriodic:
+		return now.Format("15:04") == dailyTime && now.Sub(last) > sched.Period-schedulePeriodicMargin
+	case ScheduleTypeCron:
+		return sched.cron.match(now) && last.Before(now.Truncate(time.Minute))
+	case ScheduleTypeAt:
+		return !now.Before(sched.At) && last.Before(sched.At)
+	}
+	return false
+}
+
+// Next returns the next planned run after now (zero time if none). A one-shot
+// schedule that is overdue returns its (past) date.
+func (sched *Schedule) Next(now time.Time, last time.Time, dailyTime string) time.Time {
+	switch sched.Type {
+	case ScheduleTypePeriodic:
+		t, err := time.ParseInLocation("15:04", dailyTime, time.Local)
+		if err != nil {
+			return time.Time{}
+		}
+		next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		for next.Sub(last) <= sched.Period-schedulePeriodicMargin {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next
+	case ScheduleTypeCron:
+		return sched.cron.next(now)
+	case ScheduleTypeAt:
+		if last.Before(sched.At) {
+			return sched.At
+		}
+	}
+	return time.Time{}
+}
+
+// cronExpr is a parsed 5-field cron expression (bitsets)
+type cronExpr struct {
+	minutes uint64
+	hours   uint64
+	doms    uint64
+	months  uint64
+	dows    uint64
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+func parseCronExpr(spec string) (*cronExpr, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields, found %d", len(cronFields), len(parts))
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		b, err := cronFields[i].parse(strings.ToLower(part))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", cronFields[i].name, err)
+		}
+		bits[i] = b
+	}
+
+	// sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronExpr{
+		minutes: bits[0],
+		hours:   bits[1],
+		doms:    bits[2],
+		months:  bits[3],
+		dows:    bits[4],
+		domStar: parts[2] == "*",
+		dowStar: parts[4] == "*",
+	}, nil
+}
+
+func (field *cronField) value(str string) (int, error) {
+	for i, name := range field.names {
+		if str == name {
+			return i + field.min, nil
+		}
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", str)
+	}
+	if val < field.min || val > field.max {
+		return 0, fmt.Errorf("value %d out of range (%d-%d)", val, field.min, field.max)
+	}
+	return val, nil
+}
+
+// parse a field like "*", "*/15", "1-5", "mon-fri", "0,30" or "10-50/10"
+func (field *cronField) parse(str string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(str, ",") {
+		rangeStr := item
+		step := 1
+
+		if idx := strings.Index(item, "/"); idx != -1 {
+			var err error
+			rangeStr = item[:idx]
+			step, err = strconv.Atoi(item[idx+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", item)
+			}
+		}
+
+		var from, to int
+		var err error
+		switch {
+		case rangeStr == "*":
+			from, to = field.min, field.max
+		case strings.Contains(rangeStr, "-"):
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			if from, err = field.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if to, err = field.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range '%s'", rangeStr)
+			}
+		default:
+			if from, err = field.value(rangeStr); err != nil {
+				return 0, err
+			}
+			to = from
+			if step > 1 {
+				to = field.max
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (cron *cronExpr) matchDay(t time.Time) bool {
+	domMatch := cron.doms&(1<<uint(t.Day())) != 0
+	dowMatch := cron.dows&(1<<uint(t.Weekday())) != 0
+
+	// same as Vixie cron: if both fields are restricted, any of them matches
+	if !cron.domStar && !cron.dowStar {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func (cron *cronExpr) match(t time.Time) bool {
+	return cron.minutes&(1<<uint(t.Minute())) != 0 &&
+		cron.hours&(1<<uint(t.Hour())) != 0 &&
+		cron.months&(1<<uint(t.Month())) != 0 &&
+		cron.matchDay(t)
+}
+
+// next returns the first matching minute after t (zero time if nothing
+// matches during the next 5 years, like "0 0 30 feb *")
+func (cron *cronExpr) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if cron.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
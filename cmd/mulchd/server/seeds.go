@@ -170,9 +170,10 @@ func (db *SeedDatabase) Run() {
 
 func seedSendErrorAlert(app *App, seed string) {
 	app.AlertSender.Send(&Alert{
-		Type:    AlertTypeBad,
-		Subject: "Seed error",
-		Content: fmt.Sprintf("Error with seed %s, see seed status for details.", seed),
+		Type:     AlertTypeBad,
+		Severity: AlertSeverityWarning,
+		Subject:  "Seed error",
+		Content:  fmt.Sprintf("Error with seed %s, see seed status for details.", seed),
 	})
 }
 
@@ -240,7 +241,7 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 	}
 	defer stream.Close()
 
-	conf, err := NewVMConfigFromTomlReader(stream, db.app)
+	conf, err := NewVMConfigFromTomlReader(stream, "", nil, db.app)
 	if err != nil {
 		return fmt.Errorf("decoding config: %s", err)
 	}
@@ -249,6 +250,10 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 		return fmt.Errorf("seeder is missing 'auto_rebuild' setting (it's the whole point :)")
 	}
 
+	if sched, err := ParseSchedule(conf.AutoRebuild); err != nil || sched.Type != ScheduleTypePeriodic {
+		return fmt.Errorf("seeder 'auto_rebuild' setting must be daily, weekly or monthly")
+	}
+
 	if !IsRebuildNeeded(conf.AutoRebuild, seed.LastModified) && !force {
 		log.Tracef("no rebuild needed yet for seeder '%s'", seed.Name)
 		return nil
@@ -257,16 +262,17 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 	db.app.Log.Infof("rebuilding seed '%s'", seed.Name)
 	seed.UpdateStatus("rebuilding")
 
-	operation := db.app.Operations.Add(&Operation{
+	op := &Operation{
 		Origin:        "[seeder]",
 		Action:        "rebuild",
 		Ressource:     "seed",
 		RessourceName: seed.Name,
-	})
+	}
+	operation := db.app.Operations.Add(op)
 	defer db.app.Operations.Remove(operation)
 
 	before := time.Now()
-	_, vmName, err := NewVM(conf, VMInactive, VMStopOnScriptFailure, "[seeder]", db.app, log)
+	_, vmName, err := NewVM(op.Context(), conf, VMInactive, VMStopOnScriptFailure, "[seeder]", db.app, log)
 	if err != nil {
 		log.Failuref("Cannot create VM: %s", err)
 		return err
@@ -293,7 +299,7 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 	}
 	defer post.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(op.Context())
 	defer cancel()
 
 	run := &Run{
@@ -29,9 +29,10 @@ type VMOperation string
 
 // VMOperation values
 const (
-	VMOperationNone    = ""
-	VMOperationBackup  = "backup"
-	VMOperationRestore = "restore"
+	VMOperationNone     = ""
+	VMOperationBackup   = "backup"
+	VMOperationRestore  = "restore"
+	VMOperationSnapshot = "snapshot"
 )
 
 // Backup compression
@@ -64,6 +65,12 @@ const (
 const VMStopDefaultTimeout = 3 * time.Minute
 const VMStopEmergencyTimeout = 20 * time.Second
 
+// VMStartTimeout is the delay given to a starting VM to phone home
+const VMStartTimeout = 10 * time.Minute
+
+// ErrVMDomainNotFound is returned when the libvirt domain of a VM does not exist
+var ErrVMDomainNotFound = errors.New("can't find domain")
+
 // BackupBlankRestore disables *install* scripts during a
 // a VM creation (so we can restore backup a bit later)
 const BackupBlankRestore = "-"
@@ -84,9 +91,13 @@ type VM struct {
 	InitDate             time.Time
 	LastIP               string
 	Locked               bool
+	Maintenance          bool
+	ErrorPages           map[int]string // custom error page filenames, by status
 	WIP                  VMOperation
 	LastRebuildDuration  time.Duration
 	LastRebuildDowntime  time.Duration
+	LastAutoRebuildTry   time.Time // last auto-rebuild attempt, even failed
+	LastAutoBackupTry    time.Time // last auto-backup attempt, even failed
 	AssignedMAC          string
 	AssignedIPv4         string
 
@@ -230,7 +241,7 @@ func vmGetConsoleDevice(domain *libvirt.Domain) (string, error) {
 // NewVM builds a new virtual machine from config
 // TODO: this function is HUUUGE and needs to be splitted. It's tricky
 // because there's a "transaction" here.
-func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey string, app *App, log *Log) (*VM, *VMName, error) {
+func NewVM(ctx context.Context, vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey string, app *App, log *Log) (*VM, *VMName, error) {
 	log.Infof("creating new VM '%s'", vmConfig.Name)
 
 	commit := false
@@ -314,6 +325,24 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, err
 	}
 
+	// restore from another VM: backup it now
+	if srcName, ok := VMRestoreSourceVM(vm.Config.RestoreBackup); ok {
+		if len(vm.Config.Restore) == 0 {
+			return nil, nil, errors.New("no restore script defined for this VM, can't restore")
+		}
+		backupName, err := VMTransientBackup(ctx, srcName, vm.Config.Name, authorKey, app, log)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			err := BackupDelete(backupName, app)
+			if err != nil {
+				app.Log.Errorf("cannot delete transient backup: %s", err)
+			}
+		}()
+		vm.Config.RestoreBackup = backupName
+	}
+
 	// check if backup exists (if a restore was requested)
 	backup := app.BackupsDB.GetByName(vm.Config.RestoreBackup)
 	if vm.Config.RestoreBackup != "" {
@@ -338,7 +367,7 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	app.Libvirt.AddTransientDHCPHost(transientLease, app)
 	defer app.Libvirt.RemoveTransientDHCPHost(transientLease, app)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// 1 - copy from reference image
@@ -393,11 +422,12 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	domcfg.Name = domainName
 
 	domcfg.Memory.Unit = "bytes"
-	domcfg.Memory.Value = uint(vm.Config.RAMSize)
+	domcfg.Memory.Value = uint(vm.Config.RAMSizeMax)
 	domcfg.CurrentMemory.Unit = "bytes"
 	domcfg.CurrentMemory.Value = uint(vm.Config.RAMSize)
 
-	domcfg.VCPU.Value = uint(vm.Config.CPUCount)
+	domcfg.VCPU.Value = uint(vm.Config.CPUCountMax)
+	domcfg.VCPU.Current = uint(vm.Config.CPUCount)
 
 	serial := "ds=nocloud-net;s=http://" + app.Libvirt.NetworkXML.IPs[0].Address + ":" + strconv.Itoa(app.Config.InternalServerPort) + "/cloud-init/" + vm.SecretUUID + "/"
 	serialFound := false
@@ -466,6 +496,26 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, fmt.Errorf("vm xml file: found %d interface(s) with 'ua-mulch-bridge' alias, exactly one is needed", foundInterfaces)
 	}
 
+	// data disks (if deferred, the caller will move or import existing disks)
+	if !vmConfig.DataDisksDeferred && len(vmConfig.Disks) > 0 {
+		volPaths, err := vmDataDisksCreate(vmName, vmConfig, domcfg, app, log)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		defer func() {
+			if !commit {
+				for _, volPath := range volPaths {
+					log.Infof("rollback, deleting data disk '%s'", path.Base(volPath))
+					errDef := vmDataDiskDeleteVolume(volPath, app)
+					if errDef != nil {
+						log.Errorf("failed data disk delete: %s (%s)", errDef, volPath)
+					}
+				}
+			}
+		}()
+	}
+
 	xml2, err := domcfg.Marshal()
 	if err != nil {
 		return nil, nil, err
@@ -522,6 +572,8 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		select {
 		case <-timeout:
 			return nil, nil, errors.New("vm init is too long, something probably went wrong")
+		case <-ctx.Done():
+			return nil, nil, ErrOperationCanceled
 		case call := <-phone.PhoneCalls:
 			// seeders already have phone call service, let's filter it out
 			if call.CloutInit {
@@ -550,6 +602,29 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 
 	log.Infof("REVISION=%d", revision)
 
+	if !vmConfig.DataDisksDeferred && len(vmConfig.Disks) > 0 {
+		log.Infof("mounting data disks")
+		err = VMDataDisksMount(vm, vmConfig.Disks, app, log)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// prepare scripts may push their own error pages (see push_error_page)
+	defer func() {
+		if !commit {
+			VMErrorPagesDelete(vmName, app)
+		}
+	}()
+
+	if len(vmConfig.ErrorPages) > 0 {
+		log.Infof("downloading error pages")
+		err = VMErrorPagesFetch(vm, vmName, app, log)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// 4 - run prepare scripts
 	log.Infof("running 'prepare' scripts")
 	tasks := []*RunTask{}
@@ -669,7 +744,7 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	if vm.Config.RestoreBackup != "" {
 		if vm.Config.RestoreBackup != BackupBlankRestore {
 			// 5a - restore backup
-			err = VMRestoreNoChecks(vm, vmName, backup, app, log)
+			err = VMRestoreNoChecks(ctx, vm, vmName, backup, app, log)
 			if err != nil {
 				if !allowScriptFailure || vm.TemporaryFlags.ForceDeleteOnScriptFailure {
 					return nil, nil, err
@@ -790,6 +865,8 @@ func VMStopByName(name *VMName, force bool, timeout time.Duration, app *App, log
 		return errors.New("VM is not up")
 	}
 
+	app.VMStateDB.Expect(name, VMStateDown)
+
 	if !force {
 		// shutdown
 		errS := domain.Shutdown()
@@ -863,6 +940,8 @@ func VMStartByName(name *VMName, secretUUID string, app *App, log *Log) error {
 	phone := app.PhoneHome.Register(secretUUID)
 	defer phone.Unregister()
 
+	app.VMStateDB.Expect(name, VMStateUp)
+
 	err = domain.Create()
 	if err != nil {
 		return err
@@ -871,7 +950,7 @@ func VMStartByName(name *VMName, secretUUID string, app *App, log *Log) error {
 	log.Infof("started, waiting phone call from %s", name)
 
 	select {
-	case <-time.After(10 * time.Minute):
+	case <-time.After(VMStartTimeout):
 		return fmt.Errorf("vm is too long to start, something probably went wrong (%s)", name)
 	case <-phone.PhoneCalls:
 		log.Infof("vm %s phoned home", name)
@@ -892,6 +971,18 @@ func VMLockUnlock(vmName *VMName, locked bool, vmdb *VMDatabase) error {
 	return nil
 }
 
+// VMSetMaintenance will enable or disable the maintenance mode of a VM:
+// mulch-proxy serves a maintenance page instead of the VM content
+func VMSetMaintenance(vmName *VMName, maintenance bool, vmdb *VMDatabase) error {
+	vm, err := vmdb.GetByName(vmName)
+	if err != nil {
+		return err
+	}
+
+	vm.Maintenance = maintenance
+	return vmdb.Update()
+}
+
 // VMDelete will delete a VM (using its name) and linked storages.
 func VMDelete(vmName *VMName, app *App, log *Log) error {
 	vm, err := app.VMDB.GetByName(vmName)
@@ -969,10 +1060,21 @@ func VMDelete(vmName *VMName, app *App, log *Log) error {
 		}
 	}
 
+	// 3 - delete data disks volumes (still attached, so not moved to another revision)
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Alias != nil && strings.HasPrefix(disk.Alias.Name, VMStorageAliasDataPrefix) {
+			log.Infof("removing data disk volume '%s'", path.Base(disk.Source.File.File))
+			err = vmDataDiskDeleteVolume(disk.Source.File.File, app)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	log.Infof("removing VM from libvirt and database")
 
-	// undefine domain
-	errU := domain.Undefine()
+	// undefine domain (and its snapshots, deleted with the disk)
+	errU := domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
 	if errU != nil {
 		return errU
 	}
@@ -983,6 +1085,11 @@ func VMDelete(vmName *VMName, app *App, log *Log) error {
 		return errD
 	}
 
+	errE := VMErrorPagesDelete(vmName, app)
+	if errE != nil {
+		log.Errorf("unable to remove error pages: %s", errE)
+	}
+
 	errR := app.Libvirt.RebuildDHCPStaticLeases(app)
 	if errR != nil {
 		return errR
@@ -998,7 +1105,7 @@ func VMIsRunning(vmName *VMName, app *App) (bool, error) {
 		return false, err
 	}
 	if dom == nil {
-		return false, fmt.Errorf("can't find domain for %s", vmName)
+		return false, fmt.Errorf("%w for %s", ErrVMDomainNotFound, vmName)
 	}
 	defer dom.Free()
 
@@ -1207,7 +1314,7 @@ func VMDetachBackup(vmName *VMName, app *App) error {
 }
 
 // VMBackup launch the backup process (returns backup filename)
-func VMBackup(vmName *VMName, authorKey string, app *App, log *Log, compressAllow bool, expire time.Duration) (string, error) {
+func VMBackup(ctx context.Context, vmName *VMName, authorKey string, app *App, log *Log, compressAllow bool, expire time.Duration) (string, error) {
 	vm, err := app.VMDB.GetByName(vmName)
 	if err != nil {
 		return "", err
@@ -1269,7 +1376,7 @@ func VMBackup(vmName *VMName, authorKey string, app *App, log *Log, compressAllo
 	}
 	defer post.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	runCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// defer detach + vol delete in case of failure
@@ -1297,7 +1404,7 @@ func VMBackup(vmName *VMName, authorKey string, app *App, log *Log, compressAllo
 				Tasks: tasks,
 				Log:   log,
 			}
-			errRun := run.Go(ctx)
+			errRun := run.Go(context.Background())
 			if errRun != nil {
 				log.Errorf("failed post-backup: %s", errRun)
 				// continue anyway, it's not fatal
@@ -1367,7 +1474,7 @@ func VMBackup(vmName *VMName, authorKey string, app *App, log *Log, compressAllo
 		Tasks: tasks,
 		Log:   log,
 	}
-	err = run.Go(ctx)
+	err = run.Go(runCtx)
 	if err != nil {
 		return "", err
 	}
@@ -1415,7 +1522,7 @@ func VMBackup(vmName *VMName, authorKey string, app *App, log *Log, compressAllo
 // VMRestoreNoChecks launch the restore process, this function is a symetric
 // of VMBackup, since a few checks are missing because it's supposed to be
 // called -during VM creation- (and not after)
-func VMRestoreNoChecks(vm *VM, vmName *VMName, backup *Backup, app *App, log *Log) error {
+func VMRestoreNoChecks(ctx context.Context, vm *VM, vmName *VMName, backup *Backup, app *App, log *Log) error {
 	vm.SetOperation(VMOperationRestore)
 	defer vm.SetOperation(VMOperationNone)
 
@@ -1462,7 +1569,7 @@ func VMRestoreNoChecks(vm *VM, vmName *VMName, backup *Backup, app *App, log *Lo
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	tasks := []*RunTask{}
@@ -1646,7 +1753,7 @@ func VMRename(orgVMName *VMName, newVMName *VMName, app *App, log *Log) error {
 }
 
 // VMRebuild delete VM and rebuilds it from a backup (using revisions)
-func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log) error {
+func VMRebuild(ctx context.Context, vmName *VMName, lock bool, authorKey string, app *App, log *Log) error {
 	rebuildStart := time.Now()
 
 	entry, err := app.VMDB.GetEntryByName(vmName)
@@ -1681,31 +1788,54 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 		return errors.New("VM should be up and running")
 	}
 
-	configFile := vm.Config.FileContent
+	configFile := vm.Config.GetSourceContent()
 
-	conf, err := NewVMConfigFromTomlReader(strings.NewReader(configFile), app)
+	conf, err := NewVMConfigFromTomlReader(strings.NewReader(configFile), vm.Config.VarsAuthorKey, vm.Config.Vars, app)
 	if err != nil {
 		return fmt.Errorf("decoding config: %s", err)
 	}
 
+	// restore_backup = "vm:name": data is restored from this other VM
+	backupSource := vmName
+	if srcName, ok := VMRestoreSourceVM(conf.RestoreBackup); ok && srcName != vmName.Name {
+		if !backupAndRestore {
+			return errors.New("no backup and restore scripts defined for this VM, can't restore from another VM")
+		}
+		backupSource, err = VMGetRestoreSource(srcName, app)
+		if err != nil {
+			return err
+		}
+		log.Infof("data will be restored from %s", backupSource)
+	}
+
 	if backupAndRestore {
 		conf.RestoreBackup = BackupBlankRestore
 	} else {
 		conf.RestoreBackup = ""
 	}
 
+	// data disks are moved from rev+0, see below
+	conf.DataDisksDeferred = true
+
+	dataDisks, err := VMDataDisksGetVolumes(vmName, app)
+	if err != nil {
+		return fmt.Errorf("listing data disks: %s", err)
+	}
+	moveDataDisks := len(dataDisks) > 0 || len(conf.Disks) > 0
+
 	success := false
+	keepNewVM := false
 
 	// create VM rev+1
 	// replace original VM author with "rebuilder"
-	newVM, newVMName, err := NewVM(conf, false, VMStopOnScriptFailure, authorKey, app, log)
+	newVM, newVMName, err := NewVM(ctx, conf, false, VMStopOnScriptFailure, authorKey, app, log)
 	if err != nil {
 		log.Error(err.Error())
 		return fmt.Errorf("cannot create VM: %s", err)
 	}
 
 	defer func() {
-		if !success {
+		if !success && !keepNewVM {
 			err = VMDelete(newVMName, app, log)
 			if err != nil {
 				log.Error(err.Error())
@@ -1734,9 +1864,15 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 		}()
 	}
 
+	var backup *Backup
 	if backupAndRestore {
-		// backup rev+0
-		backupName, err := VMBackup(vmName, authorKey, app, log, BackupCompressDisable, BackupNoExpiration)
+		// backup rev+0 (or the source VM, locked during its backup)
+		var backupName string
+		if backupSource == vmName {
+			backupName, err = VMBackup(ctx, backupSource, authorKey, app, log, BackupCompressDisable, BackupNoExpiration)
+		} else {
+			backupName, err = VMTransientBackup(ctx, backupSource.Name, vmName.Name, authorKey, app, log)
+		}
 		if err != nil {
 			return fmt.Errorf("creating backup: %s", err)
 		}
@@ -1756,18 +1892,65 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 			}
 		}()
 
-		backup := app.BackupsDB.GetByName(backupName)
+		backup = app.BackupsDB.GetByName(backupName)
 		if backup == nil {
 			return fmt.Errorf("can't find backup '%s' in DB", backupName)
 		}
+	}
+
+	err = OperationCheckCanceled(ctx)
+	if err != nil {
+		return err
+	}
+
+	if moveDataDisks {
+		// rev+0 must be stopped, so its data disks are no more in use
+		log.Infof("stopping %s to move its data disks", vmName)
+		err = VMStopByName(vmName, VMStopNormal, VMStopDefaultTimeout, app, log)
+		if err != nil {
+			return fmt.Errorf("stopping original VM: %s", err)
+		}
+
+		defer func() {
+			if !success {
+				log.Infof("moving data disks back to %s", vmName)
+				var err error
+				if running, _ := VMIsRunning(newVMName, app); running {
+					err = VMStopByName(newVMName, VMStopForce, VMStopDefaultTimeout, app, log)
+				}
+				if err == nil {
+					err = VMDataDisksMove(newVMName, vm, vmName, app, log)
+				}
+				if err != nil {
+					// keep rev+1, so its data disks are not deleted
+					keepNewVM = true
+					log.Errorf("unable to move data disks back, keeping %s: %s", newVMName, err)
+					return
+				}
+				err = VMStartByName(vmName, vm.SecretUUID, app, log)
+				if err != nil {
+					log.Error(err.Error())
+				}
+			}
+		}()
+
+		err = VMDataDisksMove(vmName, newVM, newVMName, app, log)
+		if err != nil {
+			return fmt.Errorf("moving data disks: %s", err)
+		}
+	}
 
+	if backupAndRestore {
 		// restore rev+1
-		err = VMRestoreNoChecks(newVM, newVMName, backup, app, log)
+		err = VMRestoreNoChecks(ctx, newVM, newVMName, backup, app, log)
 		if err != nil {
 			return fmt.Errorf("restoring backup: %s", err)
 		}
 	}
 
+	// keep manual maintenance mode
+	newVM.Maintenance = vm.Maintenance
+
 	if sourceIsActive {
 		// activate rev+1
 		err = app.VMDB.SetActiveRevision(newVMName.Name, newVMName.Revision)
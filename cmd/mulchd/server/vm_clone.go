@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// VMCloneSettings describes overrides for the cloned VM
+type VMCloneSettings struct {
+	Name      string
+	Domains   []string
+	Ports     []string
+	KeepPorts bool // keep source ports (Ports is ignored)
+}
+
+// VMCloneConfig returns a new config for a clone of srcConfig, with
+// overridden name, domains and ports. Redirects and hostname are removed,
+// since they depend on source domains. Comments of the original file
+// are not preserved, and "extends" is already resolved in the result.
+func VMCloneConfig(srcConfig *VMConfig, settings *VMCloneSettings, app *App) (*VMConfig, error) {
+	if settings.Name == "" {
+		return nil, fmt.Errorf("missing clone name")
+	}
+
+	var tomlMap map[string]interface{}
+	_, err := toml.Decode(srcConfig.FileContent, &tomlMap)
+	if err != nil {
+		return nil, fmt.Errorf("decoding source config: %s", err)
+	}
+
+	tomlMap["name"] = settings.Name
+	delete(tomlMap, "hostname")
+	delete(tomlMap, "redirects")
+	delete(tomlMap, "restore_backup")
+
+	delete(tomlMap, "domains")
+	if len(settings.Domains) > 0 {
+		tomlMap["domains"] = settings.Domains
+	}
+
+	if !settings.KeepPorts {
+		delete(tomlMap, "ports")
+		if len(settings.Ports) > 0 {
+			tomlMap["ports"] = settings.Ports
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# cloned from %s\n\n", srcConfig.Name)
+	err = toml.NewEncoder(&buf).Encode(tomlMap)
+	if err != nil {
+		return nil, fmt.Errorf("encoding clone config: %s", err)
+	}
+
+	conf, err := NewVMConfigFromTomlReader(strings.NewReader(buf.String()), "", nil, app)
+	if err != nil {
+		return nil, fmt.Errorf("clone config: %s", err)
+	}
+	return conf, nil
+}
+
+// VMClone creates a new VM from a live VM: a transient backup of the
+// source is created, then restored in a new VM using a config derived
+// from the source one (see VMCloneConfig)
+func VMClone(ctx context.Context, srcName *VMName, settings *VMCloneSettings, active bool, authorKey string, app *App, log *Log) (*VM, *VMName, error) {
+	srcEntry, err := app.VMDB.GetEntryByName(srcName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if app.VMDB.GetCountForName(settings.Name) > 0 {
+		return nil, nil, fmt.Errorf("VM '%s' already exists", settings.Name)
+	}
+
+	conf, err := VMCloneConfig(srcEntry.VM.Config, settings, app)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	running, _ := VMIsRunning(srcName, app)
+	if !running {
+		return nil, nil, fmt.Errorf("source VM %s should be up and running", srcName)
+	}
+
+	log.Infof("creating transient backup of %s", srcName)
+	backup, err := VMBackup(ctx, srcName, authorKey, app, log, BackupCompressDisable, BackupNoExpiration)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot backup %s: %s", srcName, err)
+	}
+	defer func() {
+		err := BackupDelete(backup, app)
+		if err != nil {
+			app.Log.Errorf("cannot delete transient backup: %s", err)
+		}
+	}()
+	conf.RestoreBackup = backup
+
+	log.Infof("creating clone %s", settings.Name)
+	vm, vmName, err := NewVM(ctx, conf, active, VMStopOnScriptFailure, authorKey, app, log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create VM: %s", err)
+	}
+
+	return vm, vmName, nil
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,6 +23,10 @@ const (
 	VMAutoRebuildMonthly = "monthly"
 )
 
+// VMBackupRetentionDefaultDaily is the number of daily automatic backups
+// kept when auto_backup is used without backup_retention
+const VMBackupRetentionDefaultDaily = 7
+
 // VM tag from config or from script?
 const (
 	VMTagFromConfig = true
@@ -30,26 +35,42 @@ const (
 
 // VMConfig stores needed parameters for a new VM
 type VMConfig struct {
-	FileContent string // config file content
-
-	Name           string
-	Hostname       string
-	Timezone       string
-	AppUser        string
-	Seed           string
-	InitUpgrade    bool
-	DiskSize       uint64
-	RAMSize        uint64
-	CPUCount       int
-	Domains        []*common.Domain
-	Env            map[string]string
-	Secrets        []string
-	Ports          []*VMPort
-	BackupDiskSize uint64
-	BackupCompress bool
-	RestoreBackup  string
-	AutoRebuild    string
-	BuildTimeout   time.Duration
+	FileContent   string // config file content (resolved and expanded)
+	SourceContent string // original config file content, if different
+
+	// ${USER} and --var values, so SourceContent can be expanded
+	// again on rebuild (see VMConfigExpandVariables)
+	VarsAuthorKey string
+	Vars          map[string]string
+
+	Name            string
+	Hostname        string
+	Timezone        string
+	AppUser         string
+	Seed            string
+	InitUpgrade     bool
+	DiskSize        uint64
+	RAMSize         uint64
+	RAMSizeMax      uint64
+	CPUCount        int
+	CPUCountMax     int
+	Domains         []*common.Domain
+	Env             map[string]string
+	Secrets         []string
+	Ports           []*VMPort
+	BackupDiskSize  uint64
+	BackupCompress  bool
+	RestoreBackup   string
+	AutoRebuild     string
+	AutoBackup      string
+	BackupRetention *VMBackupRetention
+	BuildTimeout    time.Duration
+	Disks           []*VMDataDisk
+	Healthcheck     *VMHealthcheck
+	ErrorPages      map[int]string // source URL/path, by HTTP status
+
+	// data disks will be attached by the caller (rebuild, migration)
+	DataDisksDeferred bool
 
 	Prepare []*VMConfigScript
 	Install []*VMConfigScript
@@ -66,6 +87,30 @@ type VMConfigScript struct {
 	As        string
 }
 
+// VMDataDisk is an additional persistent disk, kept during rebuilds
+type VMDataDisk struct {
+	Name  string
+	Size  uint64
+	Mount string
+	Pool  string // libvirt storage pool (default: Mulch disks pool)
+}
+
+// VMHealthcheck is an HTTP probe of the VM (see HealthChecker)
+type VMHealthcheck struct {
+	URL          string // path (and query)
+	Port         int
+	ExpectStatus int
+	Interval     time.Duration
+}
+
+// VMBackupRetention is the number of automatic backups to keep, for
+// each period (see auto_backup)
+type VMBackupRetention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
 // VMDoAction is a script for a "do" action (scripts for usual tasks in the VM)
 type VMDoAction struct {
 	Name        string
@@ -84,7 +129,9 @@ type tomlVMConfig struct {
 	InitUpgrade     bool              `toml:"init_upgrade"`
 	DiskSize        datasize.ByteSize `toml:"disk_size"`
 	RAMSize         datasize.ByteSize `toml:"ram_size"`
+	RAMSizeMax      datasize.ByteSize `toml:"ram_size_max"`
 	CPUCount        int               `toml:"cpu_count"`
+	CPUCountMax     int               `toml:"cpu_count_max"`
 	Domains         []string
 	RedirectToHTTPS bool   `toml:"redirect_to_https"`
 	RateProfile     string `toml:"rate_profile"`
@@ -93,11 +140,16 @@ type tomlVMConfig struct {
 	Secrets         []string
 	EnvRaw          string `toml:"env_raw"`
 	Ports           []string
-	BackupDiskSize  datasize.ByteSize `toml:"backup_disk_size"`
-	BackupCompress  bool              `toml:"backup_compress"`
-	RestoreBackup   string            `toml:"restore_backup"`
-	AutoRebuild     string            `toml:"auto_rebuild"`
-	BuildTimeout    string            `toml:"build_timeout"`
+	BackupDiskSize  datasize.ByteSize      `toml:"backup_disk_size"`
+	BackupCompress  bool                   `toml:"backup_compress"`
+	RestoreBackup   string                 `toml:"restore_backup"`
+	AutoRebuild     string                 `toml:"auto_rebuild"`
+	AutoBackup      string                 `toml:"auto_backup"`
+	BackupRetention *tomlVMBackupRetention `toml:"backup_retention"`
+	BuildTimeout    string                 `toml:"build_timeout"`
+	Disks           []tomlVMDataDisk       `toml:"disks"`
+	Healthcheck     *tomlVMHealthcheck     `toml:"healthcheck"`
+	ErrorPages      map[string]string      `toml:"error_pages"`
 
 	PreparePrefixURL string `toml:"prepare_prefix_url"`
 	Prepare          []string
@@ -110,6 +162,32 @@ type tomlVMConfig struct {
 
 	DoActions []tomlVMDoAction `toml:"do-actions"`
 	Tags      []string         `toml:"tags"`
+
+	// already expanded, see VMConfigExpandVariables
+	Variables map[string]string `toml:"variables"`
+
+	// already resolved, see VMConfigResolveExtends
+	Extends string `toml:"extends"`
+}
+
+type tomlVMDataDisk struct {
+	Name  string
+	Size  datasize.ByteSize
+	Mount string
+	Pool  string
+}
+
+type tomlVMHealthcheck struct {
+	URL          string `toml:"url"`
+	Port         int    `toml:"port"`
+	ExpectStatus int    `toml:"expect_status"`
+	Interval     string `toml:"interval"`
+}
+
+type tomlVMBackupRetention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
 }
 
 type tomlVMDoAction struct {
@@ -119,6 +197,71 @@ type tomlVMDoAction struct {
 	Description string
 }
 
+func vmConfigGetHealthcheck(tHealthcheck *tomlVMHealthcheck) (*VMHealthcheck, error) {
+	healthcheck := &VMHealthcheck{
+		URL:          tHealthcheck.URL,
+		Port:         tHealthcheck.Port,
+		ExpectStatus: tHealthcheck.ExpectStatus,
+		Interval:     VMHealthcheckDefaultInterval,
+	}
+
+	if healthcheck.URL == "" {
+		healthcheck.URL = "/"
+	}
+	if !strings.HasPrefix(healthcheck.URL, "/") {
+		return nil, fmt.Errorf("url must be a path, starting with / (ex: \"/health\")")
+	}
+
+	if healthcheck.Port == 0 {
+		healthcheck.Port = 80
+	}
+	if healthcheck.Port < 1 || healthcheck.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", healthcheck.Port)
+	}
+
+	if healthcheck.ExpectStatus == 0 {
+		healthcheck.ExpectStatus = http.StatusOK
+	}
+	if healthcheck.ExpectStatus < 100 || healthcheck.ExpectStatus > 599 {
+		return nil, fmt.Errorf("invalid expect_status %d", healthcheck.ExpectStatus)
+	}
+
+	if tHealthcheck.Interval != "" {
+		duration, err := time.ParseDuration(tHealthcheck.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval value '%s'", tHealthcheck.Interval)
+		}
+		if duration < VMHealthcheckMinInterval {
+			return nil, fmt.Errorf("interval value '%s' is too small (min %s)", tHealthcheck.Interval, VMHealthcheckMinInterval)
+		}
+		healthcheck.Interval = duration
+	}
+
+	return healthcheck, nil
+}
+
+func vmConfigGetErrorPages(tErrorPages map[string]string, origins *Origins) (map[int]string, error) {
+	errorPages := make(map[int]string)
+
+	for key, pageURL := range tErrorPages {
+		status, err := strconv.Atoi(key)
+		if err != nil || !common.IsValidErrorPageStatus(status) {
+			return nil, fmt.Errorf("invalid status '%s' (allowed: %v)", key, common.ErrorPageStatuses)
+		}
+
+		// test readability
+		stream, err := origins.GetContent(pageURL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get page '%s': %s", pageURL, err)
+		}
+		stream.Close()
+
+		errorPages[status] = pageURL
+	}
+
+	return errorPages, nil
+}
+
 func vmCheckScriptURL(scriptURL string, origins *Origins) error {
 	// test readability
 	stream, errG := origins.GetContent(scriptURL)
@@ -197,9 +340,25 @@ func vmConfigGetDoAction(tDoAction *tomlVMDoAction, origin *Origins) (*VMDoActio
 	return doAction, nil
 }
 
+// GetSourceContent returns the original config file content (with
+// "extends", if any), so base configs are resolved again during rebuilds
+func (conf *VMConfig) GetSourceContent() string {
+	if conf.SourceContent != "" {
+		return conf.SourceContent
+	}
+	return conf.FileContent
+}
+
 // NewVMConfigFromTomlReader cretes a new VMConfig instance from
-// a io.Reader containing VM configuration description
-func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error) {
+// a io.Reader containing VM configuration description, with ${USER}
+// (authorKey) and --var values (vars) for variable expansion
+func NewVMConfigFromTomlReader(configIn io.Reader, authorKey string, vars map[string]string, app *App) (*VMConfig, error) {
+	return newVMConfigFromTomlReader(configIn, authorKey, vars, app, nil)
+}
+
+// if problems is not nil, validation errors are added to it and decoding
+// continues, so all problems are reported at once (see VMConfigValidate)
+func newVMConfigFromTomlReader(configIn io.Reader, authorKey string, vars map[string]string, app *App, problems *VMConfigProblems) (*VMConfig, error) {
 	origins := app.Origins
 
 	content, err := io.ReadAll(configIn)
@@ -207,9 +366,37 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 		return nil, err
 	}
 
+	softError := func(setting string, err error) error {
+		if problems == nil {
+			return err
+		}
+		problems.Add(setting, err.Error())
+		return nil
+	}
+
+	softErrorf := func(setting string, format string, args ...interface{}) error {
+		return softError(setting, fmt.Errorf(format, args...))
+	}
+
+	resolved, err := VMConfigResolveExtends(string(content), origins)
+	if err != nil {
+		return nil, fmt.Errorf("extends: %s", err)
+	}
+
+	expanded, err := VMConfigExpandVariables(resolved, authorKey, vars)
+	if err != nil {
+		return nil, fmt.Errorf("expanding config variables: %s", err)
+	}
+
 	vmConfig := &VMConfig{
-		Env:         make(map[string]string),
-		FileContent: string(content),
+		Env:           make(map[string]string),
+		FileContent:   expanded,
+		VarsAuthorKey: authorKey,
+		Vars:          vars,
+	}
+
+	if expanded != string(content) {
+		vmConfig.SourceContent = string(content)
 	}
 
 	// defaults (if not in the file)
@@ -232,11 +419,15 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 
 	undecoded := meta.Undecoded()
 	for _, param := range undecoded {
-		return nil, fmt.Errorf("unknown setting '%s'", param)
+		if err = softErrorf("", "unknown setting '%s'", param); err != nil {
+			return nil, err
+		}
 	}
 
 	if tConfig.Name == "" || !IsValidName(tConfig.Name) {
-		return nil, fmt.Errorf("invalid VM name '%s'", tConfig.Name)
+		if err = softErrorf("name", "invalid VM name '%s'", tConfig.Name); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.Name = tConfig.Name
 
@@ -244,32 +435,65 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	vmConfig.Timezone = tConfig.Timezone
 
 	if tConfig.AppUser == "" {
-		return nil, fmt.Errorf("invalid app_user name '%s'", tConfig.AppUser)
+		if err = softErrorf("app_user", "invalid app_user name '%s'", tConfig.AppUser); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.AppUser = tConfig.AppUser
 
 	if tConfig.Seed == "" || !IsValidName(tConfig.Seed) {
-		return nil, fmt.Errorf("invalid seed image '%s'", tConfig.Seed)
+		if err = softErrorf("seed", "invalid seed image '%s'", tConfig.Seed); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.Seed = tConfig.Seed
 
 	vmConfig.InitUpgrade = tConfig.InitUpgrade
 
 	if tConfig.DiskSize < 1*datasize.MB {
-		return nil, fmt.Errorf("looks like a too small disk (%s)", tConfig.DiskSize)
+		if err = softErrorf("disk_size", "looks like a too small disk (%s)", tConfig.DiskSize); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.DiskSize = tConfig.DiskSize.Bytes()
 
 	if tConfig.RAMSize < 1*datasize.MB {
-		return nil, fmt.Errorf("looks like a too small RAM amount (%s)", tConfig.RAMSize)
+		if err = softErrorf("ram_size", "looks like a too small RAM amount (%s)", tConfig.RAMSize); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.RAMSize = tConfig.RAMSize.Bytes()
 
 	if tConfig.CPUCount < 1 {
-		return nil, fmt.Errorf("need a least one CPU")
+		if err = softErrorf("cpu_count", "need a least one CPU"); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.CPUCount = tConfig.CPUCount
 
+	// max values allow live changes (hotplug, balloon) during a redefine
+	vmConfig.RAMSizeMax = vmConfig.RAMSize
+	if tConfig.RAMSizeMax != 0 {
+		if tConfig.RAMSizeMax < tConfig.RAMSize {
+			if err = softErrorf("ram_size_max", "ram_size_max (%s) is lower than ram_size (%s)", tConfig.RAMSizeMax, tConfig.RAMSize); err != nil {
+				return nil, err
+			}
+		} else {
+			vmConfig.RAMSizeMax = tConfig.RAMSizeMax.Bytes()
+		}
+	}
+
+	vmConfig.CPUCountMax = vmConfig.CPUCount
+	if tConfig.CPUCountMax != 0 {
+		if tConfig.CPUCountMax < tConfig.CPUCount {
+			if err = softErrorf("cpu_count_max", "cpu_count_max (%d) is lower than cpu_count (%d)", tConfig.CPUCountMax, tConfig.CPUCount); err != nil {
+				return nil, err
+			}
+		} else {
+			vmConfig.CPUCountMax = tConfig.CPUCountMax
+		}
+	}
+
 	// seeders, compute VMs, etc
 	// if len(tConfig.Domains) == 0 {
 	// 	log.Warningf("no domain defined for this VM")
@@ -279,7 +503,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, domainName := range tConfig.Domains {
 		parts := strings.Split(domainName, "->")
 		if len(parts) != 1 && len(parts) != 2 {
-			return nil, fmt.Errorf("invalid domain string '%s'", domainName)
+			if err = softErrorf("domains", "invalid domain string '%s'", domainName); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		hostName := strings.TrimSpace(strings.ToLower(parts[0]))
 		portNum := 80
@@ -287,7 +514,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 			p := strings.TrimSpace(parts[1])
 			portNum, err = strconv.Atoi(p)
 			if err != nil {
-				return nil, fmt.Errorf("invalid port number '%s'", p)
+				if err = softErrorf("domains", "invalid port number '%s'", p); err != nil {
+					return nil, err
+				}
+				continue
 			}
 		}
 		domain := common.Domain{
@@ -302,7 +532,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 
 	for _, redirectParts := range tConfig.Redirects {
 		if len(redirectParts) != 2 && len(redirectParts) != 3 {
-			return nil, fmt.Errorf("values for 'redirects' setting must be two string arrays, plus additional HTTP code (['a', 'b', '301'] will redirect a to b permanently)")
+			if err = softErrorf("redirects", "values for 'redirects' setting must be two string arrays, plus additional HTTP code (['a', 'b', '301'] will redirect a to b permanently)"); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		from := strings.TrimSpace(strings.ToLower(redirectParts[0]))
 		dest := strings.TrimSpace(strings.ToLower(redirectParts[1]))
@@ -312,7 +545,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 		if len(redirectParts) == 3 {
 			status, err = strconv.Atoi(redirectParts[2])
 			if err != nil {
-				return nil, fmt.Errorf("can't parse '%s' as an integer (%s)", redirectParts[2], err)
+				if err = softErrorf("redirects", "can't parse '%s' as an integer (%s)", redirectParts[2], err); err != nil {
+					return nil, err
+				}
+				continue
 			}
 			switch status {
 			case http.StatusMovedPermanently: // 301
@@ -326,7 +562,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 				status = http.StatusPermanentRedirect
 
 			default:
-				return nil, fmt.Errorf("unsupported HTTP redirect code '%d'", status)
+				if err = softErrorf("redirects", "unsupported HTTP redirect code '%d'", status); err != nil {
+					return nil, err
+				}
+				continue
 			}
 		}
 
@@ -339,7 +578,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 			}
 		}
 		if !found {
-			return nil, fmt.Errorf("cannot redirect to '%s', it's not one of VM's domains", dest)
+			if err = softErrorf("redirects", "cannot redirect to '%s', it's not one of VM's domains", dest); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		domain := common.Domain{
@@ -355,7 +597,9 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, domain := range vmConfig.Domains {
 		_, exist := domainMap[domain.Name]
 		if exist {
-			return nil, fmt.Errorf("domain '%s' is duplicated in this VM", domain.Name)
+			if err = softErrorf("domains", "domain '%s' is duplicated in this VM", domain.Name); err != nil {
+				return nil, err
+			}
 		}
 		domainMap[domain.Name] = true
 	}
@@ -371,10 +615,11 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	}
 
 	if tConfig.EnvRaw != "" {
-		var env map[string]string
 		env, err := godotenv.Unmarshal(tConfig.EnvRaw)
 		if err != nil {
-			return nil, fmt.Errorf("can't parse env_raw: %s", err)
+			if err = softErrorf("env_raw", "can't parse env_raw: %s", err); err != nil {
+				return nil, err
+			}
 		}
 		for key, val := range env {
 			vmConfig.Env[key] = val
@@ -383,20 +628,29 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 
 	for _, line := range tConfig.Env {
 		if len(line) != 2 {
-			return nil, fmt.Errorf("invalid 'env' line, need two values (key, val), found %d", len(line))
+			if err = softErrorf("env", "invalid 'env' line, need two values (key, val), found %d", len(line)); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		key := line[0]
 		val := line[1]
 		if !IsValidName(key) {
-			return nil, fmt.Errorf("invalid 'env' name '%s'", key)
+			if err = softErrorf("env", "invalid 'env' name '%s'", key); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		// TODO: check for reserved names?
 
 		_, exists := vmConfig.Env[key]
 		if exists {
-			return nil, fmt.Errorf("duplicated 'env' name '%s'", key)
+			if err = softErrorf("env", "duplicated 'env' name '%s'", key); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		vmConfig.Env[key] = val
@@ -408,17 +662,24 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 
 		_, exists := secrets[key]
 		if exists {
-			return nil, fmt.Errorf("duplicated secret '%s'", key)
+			if err = softErrorf("secrets", "duplicated secret '%s'", key); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		_, exists = vmConfig.Env[key]
 		if exists {
-			return nil, fmt.Errorf("conflict with secret and environment variable named '%s'", key)
+			if err = softErrorf("secrets", "conflict with secret and environment variable named '%s'", key); err != nil {
+				return nil, err
+			}
 		}
 
 		_, err := app.SecretsDB.Get(keyPath)
 		if err != nil {
-			return nil, fmt.Errorf("secret error: %s", err)
+			if err = softError("secrets", fmt.Errorf("secret error: %s", err)); err != nil {
+				return nil, err
+			}
 		}
 		secrets[key] = true
 	}
@@ -427,19 +688,74 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 
 	vmConfig.Ports, err = NewVMPortArray(tConfig.Ports)
 	if err != nil {
-		return nil, err
+		if err = softError("ports", err); err != nil {
+			return nil, err
+		}
 	}
 
 	if tConfig.BackupDiskSize < 32*datasize.MB {
-		return nil, fmt.Errorf("looks like a too small backup disk (%s, min 32MB)", tConfig.BackupDiskSize)
+		if err = softErrorf("backup_disk_size", "looks like a too small backup disk (%s, min 32MB)", tConfig.BackupDiskSize); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.BackupDiskSize = tConfig.BackupDiskSize.Bytes()
 	vmConfig.BackupCompress = tConfig.BackupCompress
 
+	disksNames := make(map[string]bool)
+	disksMounts := make(map[string]bool)
+	for _, tDisk := range tConfig.Disks {
+		// name is also used as the disk serial, limited to 20 chars by virtio
+		if tDisk.Name == "" || !IsValidName(tDisk.Name) || len(tDisk.Name) > VMDataDiskNameMaxLength {
+			if err = softErrorf("disks", "invalid disk name '%s' (max %d chars)", tDisk.Name, VMDataDiskNameMaxLength); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if disksNames[tDisk.Name] {
+			if err = softErrorf("disks", "duplicated disk name '%s'", tDisk.Name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		disksNames[tDisk.Name] = true
+
+		if tDisk.Size < 1*datasize.MB {
+			if err = softErrorf("disks", "disk '%s': looks like a too small disk (%s)", tDisk.Name, tDisk.Size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		mount := filepath.Clean(tDisk.Mount)
+		if !vmDataDiskMountRegexp.MatchString(mount) || mount == "/" {
+			if err = softErrorf("disks", "disk '%s': invalid mount point '%s'", tDisk.Name, tDisk.Mount); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if disksMounts[mount] {
+			if err = softErrorf("disks", "disk '%s': duplicated mount point '%s'", tDisk.Name, mount); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		disksMounts[mount] = true
+
+		vmConfig.Disks = append(vmConfig.Disks, &VMDataDisk{
+			Name:  tDisk.Name,
+			Size:  tDisk.Size.Bytes(),
+			Mount: mount,
+			Pool:  tDisk.Pool,
+		})
+	}
+
 	for _, tScript := range tConfig.Prepare {
 		script, err := vmConfigGetScript(tScript, tConfig.PreparePrefixURL, origins)
 		if err != nil {
-			return nil, err
+			if err = softError("prepare", err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		vmConfig.Prepare = append(vmConfig.Prepare, script)
 	}
@@ -447,7 +763,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, tScript := range tConfig.Install {
 		script, err := vmConfigGetScript(tScript, tConfig.InstallPrefixURL, origins)
 		if err != nil {
-			return nil, err
+			if err = softError("install", err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		vmConfig.Install = append(vmConfig.Install, script)
 	}
@@ -455,7 +774,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, tScript := range tConfig.Backup {
 		script, err := vmConfigGetScript(tScript, tConfig.BackupPrefixURL, origins)
 		if err != nil {
-			return nil, err
+			if err = softError("backup", err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		vmConfig.Backup = append(vmConfig.Backup, script)
 	}
@@ -463,27 +785,95 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, tScript := range tConfig.Restore {
 		script, err := vmConfigGetScript(tScript, tConfig.RestorePrefixURL, origins)
 		if err != nil {
-			return nil, err
+			if err = softError("restore", err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		vmConfig.Restore = append(vmConfig.Restore, script)
 	}
+	if srcName, ok := VMRestoreSourceVM(tConfig.RestoreBackup); ok && !IsValidName(srcName) {
+		if err = softErrorf("restore_backup", "restore_backup: invalid VM name '%s'", srcName); err != nil {
+			return nil, err
+		}
+	}
 	vmConfig.RestoreBackup = tConfig.RestoreBackup
 
-	if tConfig.AutoRebuild != "" && tConfig.AutoRebuild != VMAutoRebuildDaily &&
-		tConfig.AutoRebuild != VMAutoRebuildWeekly && tConfig.AutoRebuild != VMAutoRebuildMonthly {
-		return nil, fmt.Errorf("'%s' is not a correct value for auto_rebuild setting", tConfig.AutoRebuild)
+	if _, err := ParseSchedule(tConfig.AutoRebuild); err != nil {
+		if err = softErrorf("auto_rebuild", "auto_rebuild: %s", err); err != nil {
+			return nil, err
+		}
 	}
 	vmConfig.AutoRebuild = tConfig.AutoRebuild
 
+	if _, err := ParseSchedule(tConfig.AutoBackup); err != nil {
+		if err = softErrorf("auto_backup", "auto_backup: %s", err); err != nil {
+			return nil, err
+		}
+	}
+	vmConfig.AutoBackup = tConfig.AutoBackup
+
+	if tConfig.BackupRetention != nil {
+		retention := tConfig.BackupRetention
+		var retentionErr error
+		switch {
+		case tConfig.AutoBackup == "":
+			retentionErr = errors.New("backup_retention needs an auto_backup setting")
+		case retention.Daily < 0 || retention.Weekly < 0 || retention.Monthly < 0:
+			retentionErr = errors.New("backup_retention: negative values are not allowed")
+		case retention.Daily+retention.Weekly+retention.Monthly == 0:
+			retentionErr = errors.New("backup_retention: at least one backup must be kept")
+		}
+		if retentionErr != nil {
+			if err = softError("backup_retention", retentionErr); err != nil {
+				return nil, err
+			}
+		} else {
+			vmConfig.BackupRetention = &VMBackupRetention{
+				Daily:   retention.Daily,
+				Weekly:  retention.Weekly,
+				Monthly: retention.Monthly,
+			}
+		}
+	} else if tConfig.AutoBackup != "" {
+		vmConfig.BackupRetention = &VMBackupRetention{
+			Daily: VMBackupRetentionDefaultDaily,
+		}
+	}
+
 	if tConfig.BuildTimeout != "" {
 		duration, err := time.ParseDuration(tConfig.BuildTimeout)
 		if err != nil {
-			return nil, fmt.Errorf("invalid build_timeout value '%s'", tConfig.BuildTimeout)
+			if err = softErrorf("build_timeout", "invalid build_timeout value '%s'", tConfig.BuildTimeout); err != nil {
+				return nil, err
+			}
+		} else if duration < 15*time.Second {
+			if err = softErrorf("build_timeout", "build_timeout value '%s' is too small", tConfig.BuildTimeout); err != nil {
+				return nil, err
+			}
+		} else {
+			vmConfig.BuildTimeout = duration
+		}
+	}
+
+	if tConfig.Healthcheck != nil {
+		healthcheck, err := vmConfigGetHealthcheck(tConfig.Healthcheck)
+		if err != nil {
+			if err = softErrorf("healthcheck", "healthcheck: %s", err); err != nil {
+				return nil, err
+			}
 		}
-		if duration < 15*time.Second {
-			return nil, fmt.Errorf("build_timeout value '%s' is too small", tConfig.BuildTimeout)
+		vmConfig.Healthcheck = healthcheck
+	}
+
+	if len(tConfig.ErrorPages) > 0 {
+		errorPages, err := vmConfigGetErrorPages(tConfig.ErrorPages, origins)
+		if err != nil {
+			if err = softErrorf("error_pages", "error_pages: %s", err); err != nil {
+				return nil, err
+			}
 		}
-		vmConfig.BuildTimeout = duration
+		vmConfig.ErrorPages = errorPages
 	}
 
 	var actions []*VMDoAction
@@ -491,7 +881,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, tDoAction := range tConfig.DoActions {
 		doAction, err := vmConfigGetDoAction(&tDoAction, origins)
 		if err != nil {
-			return nil, err
+			if err = softError("do-actions", err); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		actions = append(actions, doAction)
 	}
@@ -501,7 +894,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	for _, action := range actions {
 		_, exist := vmConfig.DoActions[action.Name]
 		if exist {
-			return nil, fmt.Errorf("duplicate do-action '%s'", action.Name)
+			if err = softErrorf("do-actions", "duplicate do-action '%s'", action.Name); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		vmConfig.DoActions[action.Name] = action
 	}
@@ -510,7 +906,10 @@ func NewVMConfigFromTomlReader(configIn io.Reader, app *App) (*VMConfig, error)
 	vmConfig.Tags = make(map[string]bool)
 	for _, tag := range tConfig.Tags {
 		if !IsValidWord(tag) {
-			return nil, fmt.Errorf("invalid tag name '%s'", tag)
+			if err = softErrorf("tags", "invalid tag name '%s'", tag); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		vmConfig.Tags[tag] = VMTagFromConfig
 	}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// VMConfigExtendsMaxDepth is the maximum number of nested "extends"
+const VMConfigExtendsMaxDepth = 5
+
+// script lists, with their prefix setting
+var vmConfigScriptLists = map[string]string{
+	"prepare": "prepare_prefix_url",
+	"install": "install_prefix_url",
+	"backup":  "backup_prefix_url",
+	"restore": "restore_prefix_url",
+}
+
+// lists appended to the base config ones (true: without duplicates)
+var vmConfigMergedLists = map[string]bool{
+	"prepare": false,
+	"install": false,
+	"backup":  false,
+	"restore": false,
+	"ports":   true,
+	"tags":    true,
+	"secrets": true,
+}
+
+// VMConfigResolveExtends resolves the "extends" setting of a VM config:
+// the base config (an origin path or URL, like "{core}/templates/lamp.toml")
+// is loaded and merged with the config:
+// - prepare, install, backup, restore, ports, tags and secrets are appended
+// - env, do-actions, disks and variables are merged by name
+// - env_raw are concatenated
+// - other settings are replaced
+// ${var} variables are not expanded here, but in the result, so base
+// configs can use them too (see VMConfigExpandVariables). Returns a new
+// TOML content, or the unmodified content if there's no "extends" setting.
+func VMConfigResolveExtends(content string, origins *Origins) (string, error) {
+	var pre struct {
+		Extends string
+	}
+	_, err := toml.Decode(content, &pre)
+	if err != nil {
+		return "", err
+	}
+
+	if pre.Extends == "" {
+		return content, nil
+	}
+
+	merged, chain, err := vmConfigResolveMap(content, origins, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# resolved config, extends: %s\n\n", strings.Join(chain, " < "))
+	err = toml.NewEncoder(&buf).Encode(merged)
+	if err != nil {
+		return "", fmt.Errorf("encoding resolved config: %s", err)
+	}
+
+	return buf.String(), nil
+}
+
+// returns merged config and the chain of extended files
+func vmConfigResolveMap(content string, origins *Origins, depth int) (map[string]interface{}, []string, error) {
+	var conf map[string]interface{}
+	_, err := toml.Decode(content, &conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vmConfigApplyScriptPrefixes(conf, origins)
+
+	baseURL, ok := conf["extends"].(string)
+	delete(conf, "extends")
+	if !ok || baseURL == "" {
+		return conf, nil, nil
+	}
+
+	if depth >= VMConfigExtendsMaxDepth {
+		return nil, nil, fmt.Errorf("too many nested 'extends' (max %d, loop?)", VMConfigExtendsMaxDepth)
+	}
+
+	stream, err := origins.GetContent(baseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get '%s': %s", baseURL, err)
+	}
+	defer stream.Close()
+
+	baseContent, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read '%s': %s", baseURL, err)
+	}
+
+	base, chain, err := vmConfigResolveMap(string(baseContent), origins, depth+1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", baseURL, err)
+	}
+
+	return vmConfigMerge(base, conf), append([]string{baseURL}, chain...), nil
+}
+
+// script prefixes are file-specific, so we apply them before merging
+func vmConfigApplyScriptPrefixes(conf map[string]interface{}, origins *Origins) {
+	for list, prefixSetting := range vmConfigScriptLists {
+		prefix, _ := conf[prefixSetting].(string)
+		delete(conf, prefixSetting)
+
+		scripts, ok := conf[list].([]interface{})
+		if !ok || prefix == "" {
+			continue
+		}
+
+		for i, item := range scripts {
+			line, ok := item.(string)
+			if !ok {
+				continue
+			}
+			sepPlace := strings.Index(line, "@")
+			if sepPlace == -1 {
+				continue // error will be reported during config decoding
+			}
+			scriptName := line[sepPlace+1:]
+			if scheme, _ := GetURLScheme(scriptName); scheme != "" {
+				continue
+			}
+			if origin, _, _ := origins.GetOriginFromPath(scriptName); origin != "" {
+				continue
+			}
+			scripts[i] = line[:sepPlace+1] + prefix + scriptName
+		}
+	}
+}
+
+func vmConfigMerge(base map[string]interface{}, conf map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{})
+	for key, val := range base {
+		res[key] = val
+	}
+
+	for key, val := range conf {
+		res[key] = val
+	}
+
+	for key, unique := range vmConfigMergedLists {
+		baseList := vmConfigList(base[key])
+		confList := vmConfigList(conf[key])
+		if baseList == nil || confList == nil {
+			continue
+		}
+		list := append([]interface{}{}, baseList...)
+		for _, item := range confList {
+			if unique && vmConfigListContains(list, item) {
+				continue
+			}
+			list = append(list, item)
+		}
+		res[key] = list
+	}
+
+	// env: [["KEY", "value"], …]
+	res["env"] = vmConfigMergeByName(base["env"], conf["env"], func(item interface{}) string {
+		if pair, ok := item.([]interface{}); ok && len(pair) > 0 {
+			return fmt.Sprint(pair[0])
+		}
+		return ""
+	})
+
+	// do-actions, disks: [{name = "…", …}, …]
+	tableName := func(item interface{}) string {
+		if table, ok := item.(map[string]interface{}); ok {
+			return fmt.Sprint(table["name"])
+		}
+		return ""
+	}
+	res["do-actions"] = vmConfigMergeByName(base["do-actions"], conf["do-actions"], tableName)
+	res["disks"] = vmConfigMergeByName(base["disks"], conf["disks"], tableName)
+
+	baseVars, _ := base["variables"].(map[string]interface{})
+	confVars, _ := conf["variables"].(map[string]interface{})
+	if baseVars != nil && confVars != nil {
+		vars := make(map[string]interface{})
+		for key, val := range baseVars {
+			vars[key] = val
+		}
+		for key, val := range confVars {
+			vars[key] = val
+		}
+		res["variables"] = vars
+	}
+
+	baseRaw, _ := base["env_raw"].(string)
+	confRaw, _ := conf["env_raw"].(string)
+	if baseRaw != "" && confRaw != "" {
+		res["env_raw"] = baseRaw + "\n" + confRaw
+	}
+
+	for key, val := range res {
+		if val == nil {
+			delete(res, key)
+		}
+	}
+
+	return res
+}
+
+// merge two lists, items of conf with the same name replace base ones
+func vmConfigMergeByName(base interface{}, conf interface{}, nameFunc func(interface{}) string) interface{} {
+	baseList := vmConfigList(base)
+	confList := vmConfigList(conf)
+	if baseList == nil {
+		return conf
+	}
+	if confList == nil {
+		return base
+	}
+
+	res := append([]interface{}{}, baseList...)
+	for _, item := range confList {
+		replaced := false
+		for i, baseItem := range res {
+			if nameFunc(baseItem) == nameFunc(item) {
+				res[i] = item
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func vmConfigListContains(list []interface{}, item interface{}) bool {
+	for _, val := range list {
+		if fmt.Sprint(val) == fmt.Sprint(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// arrays of tables are decoded as []map[string]interface{}
+func vmConfigList(val interface{}) []interface{} {
+	switch list := val.(type) {
+	case []interface{}:
+		return list
+	case []map[string]interface{}:
+		res := make([]interface{}, 0, len(list))
+		for _, item := range list {
+			res = append(res, item)
+		}
+		return res
+	}
+	return nil
+}
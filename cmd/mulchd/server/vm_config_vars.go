@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Built-in VM config variables
+const (
+	VMConfigVarUser = "USER" // author (API key) of the operation
+	VMConfigVarName = "name" // VM name (can itself use variables)
+)
+
+var vmConfigVarRegexp = regexp.MustCompile(`\$\{([a-zA-Z0-9_]+)\}`)
+var vmConfigVarNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// VMConfigExpandVariables expands ${var} variables in a VM TOML config
+// content (already resolved, see VMConfigResolveExtends). Values come
+// from (in ascending priority):
+// - built-in variables (USER, if authorKey is not empty)
+// - defaults declared in the config (variables = { branch = "main" })
+// - vars argument (--var CLI flag)
+// The "name" variable is the VM name, after its own expansion. Unknown
+// variables are left untouched (they may be used by the VM, in env_raw
+// for instance). Variables are only allowed inside TOML strings, values
+// are escaped for the string they land in.
+func VMConfigExpandVariables(content string, authorKey string, vars map[string]string) (string, error) {
+	if !vmConfigVarRegexp.MatchString(content) && len(vars) == 0 {
+		return content, nil
+	}
+
+	var pre struct {
+		Name      string
+		Variables map[string]string
+	}
+
+	_, err := toml.Decode(content, &pre)
+	if err != nil {
+		return "", fmt.Errorf("%s (note: variables are only allowed in strings)", err)
+	}
+
+	values := make(map[string]string)
+	if authorKey != "" {
+		values[VMConfigVarUser] = authorKey
+	}
+
+	for _, src := range []map[string]string{pre.Variables, vars} {
+		for key, val := range src {
+			if !vmConfigVarNameRegexp.MatchString(key) {
+				return "", fmt.Errorf("invalid variable name '%s'", key)
+			}
+			if key == VMConfigVarName {
+				return "", fmt.Errorf("variable '%s' is reserved", key)
+			}
+			values[key] = val
+		}
+	}
+
+	values[VMConfigVarName] = vmConfigExpand(pre.Name, values)
+
+	return vmConfigExpandTOML(content, values)
+}
+
+func vmConfigExpand(str string, values map[string]string) string {
+	return vmConfigVarRegexp.ReplaceAllStringFunc(str, func(match string) string {
+		key := match[2 : len(match)-1]
+		if val, exists := values[key]; exists {
+			return val
+		}
+		return match
+	})
+}
+
+// TOML contexts, see vmConfigContexts
+const (
+	vmConfigNoString = iota
+	vmConfigBasicString
+	vmConfigMultiLineBasicString
+	vmConfigLiteralString
+	vmConfigMultiLineLiteralString
+	vmConfigComment
+)
+
+// expand variables in a TOML content, escaping each value for the
+// string it lands in (variables in comments are left untouched)
+func vmConfigExpandTOML(content string, values map[string]string) (string, error) {
+	matches := vmConfigVarRegexp.FindAllStringIndex(content, -1)
+	contexts := vmConfigContexts(content, matches)
+
+	var res strings.Builder
+	last := 0
+	for i, match := range matches {
+		res.WriteString(content[last:match[0]])
+		last = match[1]
+
+		key := content[match[0]+2 : match[1]-1]
+		val, exists := values[key]
+		if !exists || contexts[i] == vmConfigComment {
+			res.WriteString(content[match[0]:match[1]])
+			continue
+		}
+
+		switch contexts[i] {
+		case vmConfigLiteralString:
+			if strings.ContainsAny(val, "'\r\n") {
+				return "", fmt.Errorf("variable '%s': quotes and newlines are not allowed in literal strings ('…'), use a basic string (\"…\")", key)
+			}
+		case vmConfigMultiLineLiteralString:
+			if strings.Contains(val, "'''") {
+				return "", fmt.Errorf("variable '%s': triple quotes are not allowed in multi-line literal strings ('''…'''), use a basic string (\"\"\"…\"\"\")", key)
+			}
+		default:
+			val = vmConfigEscapeBasicString(val)
+		}
+		res.WriteString(val)
+	}
+	res.WriteString(content[last:])
+
+	return res.String(), nil
+}
+
+// returns the TOML context (string type, comment, …) of each match
+func vmConfigContexts(content string, matches [][]int) []int {
+	contexts := make([]int, len(matches))
+	current := vmConfigNoString
+	m := 0
+
+	for i := 0; i < len(content) && m < len(matches); i++ {
+		for m < len(matches) && matches[m][0] == i {
+			contexts[m] = current
+			m++
+		}
+
+		rest := content[i:]
+		switch current {
+		case vmConfigNoString:
+			switch {
+			case rest[0] == '#':
+				current = vmConfigComment
+			case strings.HasPrefix(rest, `"""`):
+				current = vmConfigMultiLineBasicString
+				i += 2
+			case strings.HasPrefix(rest, "'''"):
+				current = vmConfigMultiLineLiteralString
+				i += 2
+			case rest[0] == '"':
+				current = vmConfigBasicString
+			case rest[0] == '\'':
+				current = vmConfigLiteralString
+			}
+		case vmConfigBasicString, vmConfigMultiLineBasicString:
+			switch {
+			case rest[0] == '\\':
+				i++ // escaped char
+			case current == vmConfigBasicString && rest[0] == '"':
+				current = vmConfigNoString
+			case current == vmConfigMultiLineBasicString && strings.HasPrefix(rest, `"""`):
+				current = vmConfigNoString
+				i += 2
+			}
+		case vmConfigLiteralString:
+			if rest[0] == '\'' {
+				current = vmConfigNoString
+			}
+		case vmConfigMultiLineLiteralString:
+			if strings.HasPrefix(rest, "'''") {
+				current = vmConfigNoString
+				i += 2
+			}
+		case vmConfigComment:
+			if rest[0] == '\n' {
+				current = vmConfigNoString
+			}
+		}
+	}
+
+	return contexts
+}
+
+// escape a value for a TOML basic string ("…" or """…""")
+func vmConfigEscapeBasicString(val string) string {
+	var res strings.Builder
+	for _, r := range val {
+		switch {
+		case r == '"' || r == '\\':
+			res.WriteRune('\\')
+			res.WriteRune(r)
+		case r == '\n':
+			res.WriteString(`\n`)
+		case r == '\r':
+			res.WriteString(`\r`)
+		case r == '\t':
+			res.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&res, `\u%04X`, r)
+		default:
+			res.WriteRune(r)
+		}
+	}
+	return res.String()
+}
+
+// VMConfigParseVariables parses "key=value" lines (--var CLI flag)
+func VMConfigParseVariables(lines string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(lines, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid variable '%s' (key=value needed)", line)
+		}
+		vars[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return vars, nil
+}
@@ -72,16 +72,37 @@ func NewVMDatabase(filename string, domainFilename string, portFilename string,
 
 // build domain database, updated with each vm.LastIP (and name, as it's not
 // available at config file reading time)
+// Domains of stopped VMs, VMs in maintenance mode and VMs without any active
+// revision (during a rebuild or a migration, for instance) are flagged, so
+// the proxy serves a maintenance page.
 func (vmdb *VMDatabase) genDomainsDB() error {
 	domains := make(map[string]*common.Domain)
 
+	var vmStates map[string]string
+	if vmdb.app.VMStateDB != nil {
+		vmStates = vmdb.app.VMStateDB.Get()
+	}
+
+	inactives := make(map[string]*VMDatabaseEntry)
+	actives := make(map[string]bool)
+
 	for _, entry := range vmdb.db {
 		if !entry.Active {
+			last, exists := inactives[entry.Name.Name]
+			if !exists || entry.Name.Revision > last.Name.Revision {
+				inactives[entry.Name.Name] = entry
+			}
 			continue
 		}
+		actives[entry.Name.Name] = true
+
 		vm := entry.VM
-		for _, domain := range vm.Config.Domains {
+		maintenance := vm.Maintenance || vmStates[entry.Name.ID()] == VMStateDown
+		for _, vmDomain := range vm.Config.Domains {
+			domain := *vmDomain
 			domain.VMName = entry.Name.ID()
+			domain.Maintenance = maintenance
+			domain.ErrorPages = vm.ErrorPages
 			if domain.RedirectTo == "" {
 				domain.DestinationHost = vm.LastIP
 			}
@@ -91,7 +112,24 @@ func (vmdb *VMDatabase) genDomainsDB() error {
 				return fmt.Errorf("domain '%s' is duplicated in '%s' and '%s' VMs", domain.Name, otherDomain.VMName, domain.VMName)
 			}
 
-			domains[domain.Name] = domain
+			domains[domain.Name] = &domain
+		}
+	}
+
+	// no active revision for this VM name
+	for name, entry := range inactives {
+		if actives[name] {
+			continue
+		}
+		for _, vmDomain := range entry.VM.Config.Domains {
+			if _, exist := domains[vmDomain.Name]; exist {
+				continue
+			}
+			domain := *vmDomain
+			domain.VMName = entry.Name.ID()
+			domain.Maintenance = true
+			domain.ErrorPages = entry.VM.ErrorPages
+			domains[domain.Name] = &domain
 		}
 	}
 
@@ -0,0 +1,516 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"golang.org/x/crypto/ssh"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// VMStorageAliasDataPrefix is the alias prefix for data disks
+const VMStorageAliasDataPrefix = "ua-mulch-data-"
+
+// VMDataDiskNameMaxLength is the maximum length of a data disk name (the
+// name is used as the disk serial, and virtio limits it to 20 chars)
+const VMDataDiskNameMaxLength = 20
+
+var vmDataDiskMountRegexp = regexp.MustCompile(`^/[a-zA-Z0-9_./-]+$`)
+
+// small helper to generate data disk volume name (there's no revision in
+// the name, since data disks are moved from one revision to the next)
+func vmGenDataDiskName(vmName *VMName, disk *VMDataDisk) string {
+	return vmName.Name + "-data-" + disk.Name + ".qcow2"
+}
+
+// vmDataDiskCreate creates a new empty data disk volume
+func vmDataDiskCreate(volName string, disk *VMDataDisk, app *App, log *Log) (string, error) {
+	pool, poolXML, err := app.Libvirt.GetStoragePool(disk.Pool)
+	if err != nil {
+		return "", err
+	}
+	defer app.Libvirt.ReleaseStoragePool(pool)
+
+	// Casual refresh, without any error checking. Alacool.
+	pool.Refresh(0)
+
+	vol, err := pool.LookupStorageVolByName(volName)
+	if err == nil {
+		vol.Free()
+		return "", fmt.Errorf("data disk volume '%s' already exists", volName)
+	}
+
+	log.Infof("creating data disk '%s'", volName)
+	err = app.Libvirt.UploadFileToLibvirt(
+		pool,
+		poolXML,
+		path.Clean(app.Config.GetTemplateFilepath("volume.xml")),
+		path.Clean(app.Config.GetTemplateFilepath("empty.qcow2")),
+		volName,
+		log)
+	if err != nil {
+		return "", err
+	}
+
+	volPath := poolXML.Target.Path + "/" + volName
+
+	err = app.Libvirt.ResizeDisk(volName, disk.Size, pool, log)
+	if err != nil {
+		vmDataDiskDeleteVolume(volPath, app)
+		return "", err
+	}
+
+	return volPath, nil
+}
+
+// vmDataDiskDeleteVolume deletes a data disk volume, using its path
+func vmDataDiskDeleteVolume(volPath string, app *App) error {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	vol, err := conn.LookupStorageVolByPath(volPath)
+	if err != nil {
+		return err
+	}
+	defer vol.Free()
+
+	return vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+}
+
+// vmDataDiskGrow grows a data disk volume (never shrinks), if needed
+func vmDataDiskGrow(volPath string, size uint64, app *App, log *Log) error {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	vol, err := conn.LookupStorageVolByPath(volPath)
+	if err != nil {
+		return err
+	}
+	defer vol.Free()
+
+	infos, err := vol.GetInfo()
+	if err != nil {
+		return err
+	}
+
+	if size < infos.Capacity {
+		log.Warningf("data disk '%s' can't be shrinked, keeping current size", path.Base(volPath))
+		return nil
+	}
+
+	if size == infos.Capacity {
+		return nil
+	}
+
+	err = vol.Resize(size, 0)
+	if err != nil {
+		return err
+	}
+	log.Infof("data disk '%s' resized to %s", path.Base(volPath), (datasize.ByteSize(size) * datasize.B).HR())
+	return nil
+}
+
+// vmDataDiskDomainDisk returns a disk description, ready to be added to a domain
+func vmDataDiskDomainDisk(volPath string, disk *VMDataDisk, target string, app *App) (*libvirtxml.DomainDisk, error) {
+	xml, err := os.ReadFile(app.Config.GetTemplateFilepath("disk.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	diskcfg := &libvirtxml.DomainDisk{}
+	err = diskcfg.Unmarshal(string(xml))
+	if err != nil {
+		return nil, err
+	}
+	diskcfg.Alias.Name = VMStorageAliasDataPrefix + disk.Name
+	diskcfg.Source.File.File = volPath
+	diskcfg.Target.Dev = target
+	diskcfg.Serial = disk.Name
+
+	return diskcfg, nil
+}
+
+// vmDataDiskNextTarget returns the first available target device
+// (vda is the main disk, vdb is used for backups)
+func vmDataDiskNextTarget(domcfg *libvirtxml.Domain) (string, error) {
+	used := make(map[string]bool)
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Target != nil {
+			used[disk.Target.Dev] = true
+		}
+	}
+
+	for c := 'c'; c <= 'z'; c++ {
+		dev := "vd" + string(c)
+		if !used[dev] {
+			return dev, nil
+		}
+	}
+	return "", errors.New("no more target device available for data disks")
+}
+
+// vmDataDisksGet returns domain description and its data disks (by name)
+func vmDataDisksGet(dom *libvirt.Domain, flags libvirt.DomainXMLFlags) (map[string]libvirtxml.DomainDisk, *libvirtxml.Domain, error) {
+	xmldoc, err := dom.GetXMLDesc(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	err = domcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	disks := make(map[string]libvirtxml.DomainDisk)
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Alias != nil && strings.HasPrefix(disk.Alias.Name, VMStorageAliasDataPrefix) {
+			name := strings.TrimPrefix(disk.Alias.Name, VMStorageAliasDataPrefix)
+			disks[name] = disk
+		}
+	}
+
+	return disks, domcfg, nil
+}
+
+// VMDataDisksGetVolumes returns data disks volumes of the VM (by disk name)
+func VMDataDisksGetVolumes(vmName *VMName, app *App) (map[string]string, error) {
+	dom, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return nil, err
+	}
+	if dom == nil {
+		return nil, fmt.Errorf("can't find domain for %s", vmName)
+	}
+	defer dom.Free()
+
+	disks, _, err := vmDataDisksGet(dom, libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for name, disk := range disks {
+		if disk.Source == nil || disk.Source.File == nil {
+			return nil, fmt.Errorf("data disk '%s' has no source file", name)
+		}
+		res[name] = disk.Source.File.File
+	}
+	return res, nil
+}
+
+// vmDataDisksCreate creates all data disks and add them to the domain
+// description (before its definition). Returns volume paths.
+func vmDataDisksCreate(vmName *VMName, conf *VMConfig, domcfg *libvirtxml.Domain, app *App, log *Log) ([]string, error) {
+	var volPaths []string
+	commit := false
+
+	defer func() {
+		if !commit {
+			for _, volPath := range volPaths {
+				vmDataDiskDeleteVolume(volPath, app)
+			}
+		}
+	}()
+
+	for _, disk := range conf.Disks {
+		volPath, err := vmDataDiskCreate(vmGenDataDiskName(vmName, disk), disk, app, log)
+		if err != nil {
+			return nil, err
+		}
+		volPaths = append(volPaths, volPath)
+
+		target, err := vmDataDiskNextTarget(domcfg)
+		if err != nil {
+			return nil, err
+		}
+
+		diskcfg, err := vmDataDiskDomainDisk(volPath, disk, target, app)
+		if err != nil {
+			return nil, err
+		}
+		domcfg.Devices.Disks = append(domcfg.Devices.Disks, *diskcfg)
+	}
+
+	commit = true
+	return volPaths, nil
+}
+
+// vmDataDiskAttach attaches a disk to the domain (live, if running)
+func vmDataDiskAttach(dom *libvirt.Domain, diskcfg *libvirtxml.DomainDisk) error {
+	_, domcfg, err := vmDataDisksGet(dom, 0)
+	if err != nil {
+		return err
+	}
+
+	diskcfg.Target.Dev, err = vmDataDiskNextTarget(domcfg)
+	if err != nil {
+		return err
+	}
+	diskcfg.Address = nil // let libvirt choose
+
+	xml, err := diskcfg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+
+	return dom.AttachDeviceFlags(xml, flags)
+}
+
+// VMDataDisksMount mounts data disks inside the VM, formatting
+// them if needed, and adds them to fstab
+func VMDataDisksMount(vm *VM, disks []*VMDataDisk, app *App, log *Log) error {
+	if len(disks) == 0 {
+		return nil
+	}
+
+	script, err := os.ReadFile(app.Config.GetTemplateFilepath("mount-disk.sh"))
+	if err != nil {
+		return err
+	}
+
+	SSHSuperUserAuth, err := app.SSHPairDB.GetPublicKeyAuth(vm.MulchSuperUserSSHKey)
+	if err != nil {
+		return err
+	}
+
+	tasks := []*RunTask{}
+	for _, disk := range disks {
+		tasks = append(tasks, &RunTask{
+			ScriptName:   "mount-disk.sh",
+			ScriptReader: bytes.NewReader(script),
+			As:           app.Config.MulchSuperUser,
+			Arguments:    disk.Name + " " + disk.Mount,
+		})
+	}
+
+	run := &Run{
+		Caption: "data-disks",
+		SSHConn: &SSHConnection{
+			User: app.Config.MulchSuperUser,
+			Host: vm.LastIP,
+			Port: 22,
+			Auths: []ssh.AuthMethod{
+				SSHSuperUserAuth,
+			},
+			Log: log,
+		},
+		Tasks: tasks,
+		Log:   log,
+	}
+
+	return run.Go(context.Background())
+}
+
+// VMDataDisksMove moves data disks from a stopped VM to another VM (using
+// destination VM config). Missing disks are created. Source disks that are
+// no more in the config are detached, but their volumes are kept.
+func VMDataDisksMove(srcName *VMName, dstVM *VM, dstName *VMName, app *App, log *Log) error {
+	srcDom, err := app.Libvirt.GetDomainByName(srcName.LibvirtDomainName(app))
+	if err != nil {
+		return err
+	}
+	if srcDom == nil {
+		return fmt.Errorf("can't find domain for %s", srcName)
+	}
+	defer srcDom.Free()
+
+	dstDom, err := app.Libvirt.GetDomainByName(dstName.LibvirtDomainName(app))
+	if err != nil {
+		return err
+	}
+	if dstDom == nil {
+		return fmt.Errorf("can't find domain for %s", dstName)
+	}
+	defer dstDom.Free()
+
+	srcActive, err := srcDom.IsActive()
+	if err != nil {
+		return err
+	}
+	if srcActive {
+		return fmt.Errorf("VM %s must be stopped to move its data disks", srcName)
+	}
+
+	srcDisks, _, err := vmDataDisksGet(srcDom, libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+
+	dstDisks := make(map[string]bool)
+	for _, disk := range dstVM.Config.Disks {
+		dstDisks[disk.Name] = true
+	}
+
+	for name, diskcfg := range srcDisks {
+		if dstDisks[name] {
+			continue
+		}
+		xml, err := diskcfg.Marshal()
+		if err != nil {
+			return err
+		}
+		err = srcDom.DetachDeviceFlags(xml, libvirt.DOMAIN_DEVICE_MODIFY_CONFIG)
+		if err != nil {
+			return err
+		}
+		log.Warningf("data disk '%s' is no more in config, volume '%s' is kept (delete it by hand)", name, diskcfg.Source.File.File)
+	}
+
+	for _, disk := range dstVM.Config.Disks {
+		diskcfg, exists := srcDisks[disk.Name]
+		if exists {
+			log.Infof("moving data disk '%s' from %s to %s", disk.Name, srcName, dstName)
+			xml, err := diskcfg.Marshal()
+			if err != nil {
+				return err
+			}
+			err = srcDom.DetachDeviceFlags(xml, libvirt.DOMAIN_DEVICE_MODIFY_CONFIG)
+			if err != nil {
+				return err
+			}
+			err = vmDataDiskGrow(diskcfg.Source.File.File, disk.Size, app, log)
+			if err != nil {
+				return err
+			}
+		} else {
+			volPath, err := vmDataDiskCreate(vmGenDataDiskName(dstName, disk), disk, app, log)
+			if err != nil {
+				return err
+			}
+			newcfg, err := vmDataDiskDomainDisk(volPath, disk, "", app)
+			if err != nil {
+				return err
+			}
+			diskcfg = *newcfg
+		}
+
+		err = vmDataDiskAttach(dstDom, &diskcfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	dstActive, err := dstDom.IsActive()
+	if err != nil {
+		return err
+	}
+	if !dstActive {
+		// already in fstab
+		return nil
+	}
+
+	return VMDataDisksMount(dstVM, dstVM.Config.Disks, app, log)
+}
+
+// VMDataDiskImport creates a data disk from a backup volume (see VM
+// migration) and attaches it to the VM
+func VMDataDiskImport(vm *VM, vmName *VMName, diskName string, backupName string, app *App, log *Log) error {
+	var disk *VMDataDisk
+	for _, d := range vm.Config.Disks {
+		if d.Name == diskName {
+			disk = d
+		}
+	}
+	if disk == nil {
+		return fmt.Errorf("data disk '%s' not found in VM config", diskName)
+	}
+
+	if app.BackupsDB.GetByName(backupName) == nil {
+		return fmt.Errorf("backup '%s' not found in database", backupName)
+	}
+
+	dom, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return err
+	}
+	if dom == nil {
+		return fmt.Errorf("can't find domain for %s", vmName)
+	}
+	defer dom.Free()
+
+	disks, _, err := vmDataDisksGet(dom, libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+	if _, exists := disks[diskName]; exists {
+		return fmt.Errorf("data disk '%s' is already attached", diskName)
+	}
+
+	pool, poolXML, err := app.Libvirt.GetStoragePool(disk.Pool)
+	if err != nil {
+		return err
+	}
+	defer app.Libvirt.ReleaseStoragePool(pool)
+
+	volName := vmGenDataDiskName(vmName, disk)
+	volPath := poolXML.Target.Path + "/" + volName
+
+	err = app.Libvirt.CloneVolume(
+		backupName,
+		app.Libvirt.Pools.Backups,
+		volName,
+		pool,
+		poolXML,
+		app.Config.GetTemplateFilepath("volume.xml"),
+		log,
+	)
+	if err != nil {
+		return err
+	}
+
+	commit := false
+	defer func() {
+		if !commit {
+			log.Infof("rollback, deleting data disk '%s'", volName)
+			vmDataDiskDeleteVolume(volPath, app)
+		}
+	}()
+
+	err = vmDataDiskGrow(volPath, disk.Size, app, log)
+	if err != nil {
+		return err
+	}
+
+	diskcfg, err := vmDataDiskDomainDisk(volPath, disk, "", app)
+	if err != nil {
+		return err
+	}
+
+	err = vmDataDiskAttach(dom, diskcfg)
+	if err != nil {
+		return err
+	}
+	commit = true
+
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+	if !active {
+		return nil
+	}
+
+	return VMDataDisksMount(vm, []*VMDataDisk{disk}, app, log)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// VMHistoryMaxEvents is the number of events kept for each VM
+const VMHistoryMaxEvents = 500
+
+// VM history event types
+const (
+	VMEventCreate      = "create"
+	VMEventDelete      = "delete"
+	VMEventRebuild     = "rebuild"
+	VMEventBackup      = "backup"
+	VMEventRestore     = "restore"
+	VMEventRedefine    = "redefine"
+	VMEventMigrate     = "migrate"
+	VMEventClone       = "clone"
+	VMEventLock        = "lock"
+	VMEventUnlock      = "unlock"
+	VMEventMaintenance = "maintenance"
+)
+
+// VMHistoryEvent is a lifecycle event of a VM
+type VMHistoryEvent struct {
+	Time     time.Time
+	Revision int
+	Type     string
+	Author   string // API key comment, "[auto-rebuilder]", …
+	Message  string
+	Error    string // empty if the event was a success
+	Duration time.Duration
+	Downtime time.Duration
+}
+
+// VMHistoryDatabase describes a persistent DataBase of VM lifecycle events,
+// by VM name (all revisions). History is kept when the VM is deleted.
+type VMHistoryDatabase struct {
+	filename string
+	db       map[string][]*VMHistoryEvent
+	mutex    sync.Mutex
+	app      *App
+}
+
+// NewVMHistoryDatabase instanciates a new VMHistoryDatabase
+func NewVMHistoryDatabase(filename string, app *App) (*VMHistoryDatabase, error) {
+	vmhdb := &VMHistoryDatabase{
+		filename: filename,
+		db:       make(map[string][]*VMHistoryEvent),
+		app:      app,
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(vmhdb.filename); err == nil {
+		err = vmhdb.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// save the file to check if it's writable
+	err := vmhdb.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return vmhdb, nil
+}
+
+// This is done internaly, because it must be done with the mutex locked,
+// but we can't lock it here, since save() is called by functions that
+// are already locking the mutex.
+func (vmhdb *VMHistoryDatabase) save() error {
+	f, err := os.Create(vmhdb.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&vmhdb.db)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (vmhdb *VMHistoryDatabase) load() error {
+	f, err := os.Open(vmhdb.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&vmhdb.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewVMHistoryEvent creates a new event, failed if err is not nil
+func NewVMHistoryEvent(eventType string, author string, err error, format string, args ...interface{}) *VMHistoryEvent {
+	event := &VMHistoryEvent{
+		Type:    eventType,
+		Author:  author,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// Add records an event for the VM. Since history is not critical,
+// errors are only logged.
+func (vmhdb *VMHistoryDatabase) Add(vmName *VMName, event *VMHistoryEvent) {
+	vmhdb.mutex.Lock()
+	defer vmhdb.mutex.Unlock()
+
+	event.Time = time.Now()
+	event.Revision = vmName.Revision
+
+	events := append(vmhdb.db[vmName.Name], event)
+	if len(events) > VMHistoryMaxEvents {
+		events = events[len(events)-VMHistoryMaxEvents:]
+	}
+	vmhdb.db[vmName.Name] = events
+
+	err := vmhdb.save()
+	if err != nil {
+		vmhdb.app.Log.Errorf("unable to save VM history: %s", err)
+	}
+}
+
+// AddRebuild records a rebuild event, with the duration and downtime of
+// the new revision on success (see VMRebuild)
+func (vmhdb *VMHistoryDatabase) AddRebuild(vmName *VMName, author string, err error) {
+	if err != nil {
+		vmhdb.Add(vmName, NewVMHistoryEvent(VMEventRebuild, author, err, "rebuild failed"))
+		return
+	}
+
+	newVMName := NewVMName(vmName.Name, vmhdb.app.VMDB.GetNextRevisionForName(vmName.Name)-1)
+	event := NewVMHistoryEvent(VMEventRebuild, author, nil, "rebuilt from revision %d", vmName.Revision)
+
+	newVM, errG := vmhdb.app.VMDB.GetByName(newVMName)
+	if errG == nil {
+		event.Duration = newVM.LastRebuildDuration
+		event.Downtime = newVM.LastRebuildDowntime
+	}
+
+	vmhdb.Add(newVMName, event)
+}
+
+// Get returns events of a VM, oldest first
+func (vmhdb *VMHistoryDatabase) Get(name string) []VMHistoryEvent {
+	vmhdb.mutex.Lock()
+	defer vmhdb.mutex.Unlock()
+
+	res := make([]VMHistoryEvent, 0, len(vmhdb.db[name]))
+	for _, event := range vmhdb.db[name] {
+		res = append(res, *event)
+	}
+	return res
+}
+
+// ToAPI converts the event to its API counterpart
+func (event *VMHistoryEvent) ToAPI() common.APIVMHistoryEvent {
+	return common.APIVMHistoryEvent{
+		Time:     event.Time,
+		Revision: event.Revision,
+		Type:     event.Type,
+		Author:   event.Author,
+		Message:  event.Message,
+		Error:    event.Error,
+		Duration: event.Duration,
+		Downtime: event.Downtime,
+	}
+}
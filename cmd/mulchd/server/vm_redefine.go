@@ -0,0 +1,334 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// VMChangeReport lists VM config changes (redefine, resources) by how
+// they are applied
+type VMChangeReport struct {
+	Applied []string // applied now (live if the VM is running)
+	Restart []string // saved in the domain, applied on next VM start
+	Rebuild []string // not applied, will be applied on next rebuild
+}
+
+// VMConfigDiff lists changes between the current config of a VM and a new
+// one, classified by how they are applied by a redefine:
+// - domains, ports, backup settings, scripts, actions, healthcheck, error_pages: applied now
+// - env and secrets: applied on next VM start (env is fetched during boot)
+// - seed, prepare, install scripts, etc: applied on next rebuild
+// Resources (CPU, RAM, disks) are not part of this diff, since they
+// depend on the domain state (see VMApplyResources and VMConfigDiffResources)
+func VMConfigDiff(oldConf *VMConfig, newConf *VMConfig) *VMChangeReport {
+	report := &VMChangeReport{}
+
+	applied := func(setting string, change string) {
+		if change != "" {
+			report.Applied = append(report.Applied, setting+": "+change)
+		}
+	}
+	restart := func(setting string, change string) {
+		if change != "" {
+			report.Restart = append(report.Restart, setting+": "+change)
+		}
+	}
+	rebuild := func(setting string, change string) {
+		if change != "" {
+			report.Rebuild = append(report.Rebuild, setting+": "+change)
+		}
+	}
+
+	applied("domains", vmDiffLists(vmDiffDomains(oldConf), vmDiffDomains(newConf)))
+	applied("ports", vmDiffLists(vmDiffPorts(oldConf), vmDiffPorts(newConf)))
+	applied("tags", vmDiffLists(vmDiffTags(oldConf), vmDiffTags(newConf)))
+	applied("do-actions", vmDiffLists(vmDiffDoActions(oldConf), vmDiffDoActions(newConf)))
+	applied("backup", vmDiffLists(vmDiffScripts(oldConf.Backup), vmDiffScripts(newConf.Backup)))
+	applied("restore", vmDiffLists(vmDiffScripts(oldConf.Restore), vmDiffScripts(newConf.Restore)))
+	applied("backup_disk_size", vmDiffString(
+		(datasize.ByteSize(oldConf.BackupDiskSize)*datasize.B).HR(),
+		(datasize.ByteSize(newConf.BackupDiskSize)*datasize.B).HR(),
+	))
+	applied("backup_compress", vmDiffString(fmt.Sprint(oldConf.BackupCompress), fmt.Sprint(newConf.BackupCompress)))
+	applied("auto_rebuild", vmDiffString(oldConf.AutoRebuild, newConf.AutoRebuild))
+	applied("auto_backup", vmDiffString(oldConf.AutoBackup, newConf.AutoBackup))
+	applied("backup_retention", vmDiffString(vmDiffRetention(oldConf), vmDiffRetention(newConf)))
+	applied("build_timeout", vmDiffString(oldConf.BuildTimeout.String(), newConf.BuildTimeout.String()))
+	applied("healthcheck", vmDiffString(vmDiffHealthcheck(oldConf), vmDiffHealthcheck(newConf)))
+	applied("error_pages", vmDiffLists(vmDiffErrorPages(oldConf), vmDiffErrorPages(newConf)))
+
+	restart("env", vmDiffEnv(oldConf.Env, newConf.Env))
+	restart("secrets", vmDiffLists(oldConf.Secrets, newConf.Secrets))
+
+	rebuild("seed", vmDiffString(oldConf.Seed, newConf.Seed))
+	rebuild("hostname", vmDiffString(oldConf.Hostname, newConf.Hostname))
+	rebuild("timezone", vmDiffString(oldConf.Timezone, newConf.Timezone))
+	rebuild("app_user", vmDiffString(oldConf.AppUser, newConf.AppUser))
+	rebuild("init_upgrade", vmDiffString(fmt.Sprint(oldConf.InitUpgrade), fmt.Sprint(newConf.InitUpgrade)))
+	rebuild("prepare", vmDiffLists(vmDiffScripts(oldConf.Prepare), vmDiffScripts(newConf.Prepare)))
+	rebuild("install", vmDiffLists(vmDiffScripts(oldConf.Install), vmDiffScripts(newConf.Install)))
+
+	return report
+}
+
+// VMConfigDiffResources guesses how CPU, RAM and disks changes will be
+// applied by VMApplyResources, without touching the domain. It's based on
+// the current config, so it may differ from the domain reality.
+func VMConfigDiffResources(oldConf *VMConfig, newConf *VMConfig, running bool) *VMChangeReport {
+	report := &VMChangeReport{}
+
+	add := func(live bool, msg string) {
+		if !running || live {
+			report.Applied = append(report.Applied, msg)
+		} else {
+			report.Restart = append(report.Restart, msg)
+		}
+	}
+
+	if oldConf.CPUCount != newConf.CPUCount {
+		add(newConf.CPUCount <= oldConf.CPUCountMax, fmt.Sprintf("cpu_count: %d -> %d", oldConf.CPUCount, newConf.CPUCount))
+	}
+	if oldConf.CPUCountMax != newConf.CPUCountMax {
+		add(false, fmt.Sprintf("cpu_count_max: %d -> %d", oldConf.CPUCountMax, newConf.CPUCountMax))
+	}
+	if oldConf.RAMSize != newConf.RAMSize {
+		add(newConf.RAMSize <= oldConf.RAMSizeMax, fmt.Sprintf("ram_size: %s -> %s",
+			(datasize.ByteSize(oldConf.RAMSize)*datasize.B).HR(),
+			(datasize.ByteSize(newConf.RAMSize)*datasize.B).HR(),
+		))
+	}
+	if oldConf.RAMSizeMax != newConf.RAMSizeMax {
+		add(false, fmt.Sprintf("ram_size_max: %s -> %s",
+			(datasize.ByteSize(oldConf.RAMSizeMax)*datasize.B).HR(),
+			(datasize.ByteSize(newConf.RAMSizeMax)*datasize.B).HR(),
+		))
+	}
+
+	if oldConf.DiskSize != newConf.DiskSize {
+		msg := fmt.Sprintf("disk_size: %s -> %s",
+			(datasize.ByteSize(oldConf.DiskSize) * datasize.B).HR(),
+			(datasize.ByteSize(newConf.DiskSize) * datasize.B).HR(),
+		)
+		if newConf.DiskSize < oldConf.DiskSize {
+			report.Rebuild = append(report.Rebuild, msg)
+		} else {
+			report.Applied = append(report.Applied, msg)
+		}
+	}
+
+	oldDisks := make(map[string]*VMDataDisk)
+	for _, disk := range oldConf.Disks {
+		oldDisks[disk.Name] = disk
+	}
+
+	inConfig := make(map[string]bool)
+	for _, disk := range newConf.Disks {
+		inConfig[disk.Name] = true
+
+		oldDisk, exists := oldDisks[disk.Name]
+		if !exists {
+			report.Rebuild = append(report.Rebuild, fmt.Sprintf("disks: '%s' will be created", disk.Name))
+			continue
+		}
+
+		if oldDisk.Mount != disk.Mount || oldDisk.Pool != disk.Pool {
+			report.Rebuild = append(report.Rebuild, fmt.Sprintf("disks: '%s' mount or pool changed", disk.Name))
+		}
+
+		if oldDisk.Size == disk.Size {
+			continue
+		}
+
+		msg := fmt.Sprintf("disks: '%s' size %s -> %s",
+			disk.Name,
+			(datasize.ByteSize(oldDisk.Size) * datasize.B).HR(),
+			(datasize.ByteSize(disk.Size) * datasize.B).HR(),
+		)
+		if disk.Size < oldDisk.Size {
+			report.Rebuild = append(report.Rebuild, msg+" (shrink is not supported, will be ignored)")
+			continue
+		}
+		report.Applied = append(report.Applied, msg)
+	}
+
+	for _, disk := range oldConf.Disks {
+		if !inConfig[disk.Name] {
+			report.Rebuild = append(report.Rebuild, fmt.Sprintf("disks: '%s' will be detached (volume is kept)", disk.Name))
+		}
+	}
+
+	return report
+}
+
+// Append adds all changes of another report
+func (report *VMChangeReport) Append(other *VMChangeReport) {
+	report.Applied = append(report.Applied, other.Applied...)
+	report.Restart = append(report.Restart, other.Restart...)
+	report.Rebuild = append(report.Rebuild, other.Rebuild...)
+}
+
+// IsEmpty returns true if the report has no change
+func (report *VMChangeReport) IsEmpty() bool {
+	return len(report.Applied)+len(report.Restart)+len(report.Rebuild) == 0
+}
+
+func vmDiffString(oldVal string, newVal string) string {
+	if oldVal == newVal {
+		return ""
+	}
+	if oldVal == "" {
+		oldVal = "(none)"
+	}
+	if newVal == "" {
+		newVal = "(none)"
+	}
+	return fmt.Sprintf("%s -> %s", oldVal, newVal)
+}
+
+// returns "+added -removed" items, "order changed" if only the order
+// differs, or "" if lists are the same
+func vmDiffLists(oldList []string, newList []string) string {
+	oldItems := make(map[string]bool)
+	for _, item := range oldList {
+		oldItems[item] = true
+	}
+	newItems := make(map[string]bool)
+	for _, item := range newList {
+		newItems[item] = true
+	}
+
+	var changes []string
+	for _, item := range newList {
+		if !oldItems[item] {
+			changes = append(changes, "+"+item)
+		}
+	}
+	for _, item := range oldList {
+		if !newItems[item] {
+			changes = append(changes, "-"+item)
+		}
+	}
+
+	// same items in another order (scripts)
+	if len(changes) == 0 && strings.Join(oldList, "\n") != strings.Join(newList, "\n") {
+		return "order changed"
+	}
+
+	return strings.Join(changes, " ")
+}
+
+// values are not shown, they may be sensitive
+func vmDiffEnv(oldEnv map[string]string, newEnv map[string]string) string {
+	var changes []string
+	for key, val := range newEnv {
+		oldVal, exists := oldEnv[key]
+		if !exists {
+			changes = append(changes, "+"+key)
+		} else if oldVal != val {
+			changes = append(changes, "~"+key)
+		}
+	}
+	for key := range oldEnv {
+		if _, exists := newEnv[key]; !exists {
+			changes = append(changes, "-"+key)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][1:] < changes[j][1:]
+	})
+	return strings.Join(changes, " ")
+}
+
+func vmDiffDomains(conf *VMConfig) []string {
+	var res []string
+	for _, domain := range conf.Domains {
+		str := fmt.Sprintf("%s->%d", domain.Name, domain.DestinationPort)
+		if domain.RedirectTo != "" {
+			str = fmt.Sprintf("%s->%s(%d)", domain.Name, domain.RedirectTo, domain.RedirectCode)
+		}
+		if domain.RedirectToHTTPS {
+			str += "(https)"
+		}
+		if domain.RateProfile != "" {
+			str += "(" + domain.RateProfile + ")"
+		}
+		res = append(res, str)
+	}
+	return res
+}
+
+func vmDiffPorts(conf *VMConfig) []string {
+	var res []string
+	for _, port := range conf.Ports {
+		res = append(res, port.String())
+	}
+	return res
+}
+
+// only tags from config (script tags are kept during redefine)
+func vmDiffTags(conf *VMConfig) []string {
+	var res []string
+	for tag, from := range conf.Tags {
+		if from == VMTagFromConfig {
+			res = append(res, tag)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// only actions from config (prepare actions are kept during redefine)
+func vmDiffDoActions(conf *VMConfig) []string {
+	var res []string
+	for name, action := range conf.DoActions {
+		if action.FromConfig {
+			res = append(res, name+"="+action.ScriptURL)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func vmDiffScripts(scripts []*VMConfigScript) []string {
+	var res []string
+	for _, script := range scripts {
+		res = append(res, script.As+"@"+script.ScriptURL)
+	}
+	return res
+}
+
+func vmDiffHealthcheck(conf *VMConfig) string {
+	check := conf.Healthcheck
+	if check == nil {
+		return ""
+	}
+	return fmt.Sprintf("url=%s port=%d expect_status=%d interval=%s",
+		check.URL,
+		check.Port,
+		check.ExpectStatus,
+		check.Interval,
+	)
+}
+
+func vmDiffErrorPages(conf *VMConfig) []string {
+	var res []string
+	for status, pageURL := range conf.ErrorPages {
+		res = append(res, fmt.Sprintf("%d=%s", status, pageURL))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func vmDiffRetention(conf *VMConfig) string {
+	if conf.BackupRetention == nil {
+		return ""
+	}
+	return fmt.Sprintf("daily=%d weekly=%d monthly=%d",
+		conf.BackupRetention.Daily,
+		conf.BackupRetention.Weekly,
+		conf.BackupRetention.Monthly,
+	)
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/c2h5oh/datasize"
+	"golang.org/x/crypto/ssh"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// VMApplyResources applies CPU, RAM and disk size settings of conf to
+// the libvirt domain of the VM, live when possible. A change that can't
+// be applied is not an error: the config will be used on next rebuild anyway.
+func VMApplyResources(vm *VM, vmName *VMName, conf *VMConfig, app *App, log *Log) (*VMChangeReport, error) {
+	report := &VMChangeReport{}
+
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return nil, err
+	}
+	if domain == nil {
+		return nil, fmt.Errorf("VM %s: does not exists in libvirt", vmName)
+	}
+	defer domain.Free()
+
+	state, _, err := domain.GetState()
+	if err != nil {
+		return nil, err
+	}
+	running := (state == libvirt.DOMAIN_RUNNING)
+
+	err = vmApplyCPU(domain, conf, running, report, log)
+	if err != nil {
+		return nil, fmt.Errorf("cpu_count: %s", err)
+	}
+
+	err = vmApplyRAM(domain, conf, running, report, log)
+	if err != nil {
+		return nil, fmt.Errorf("ram_size: %s", err)
+	}
+
+	err = vmApplyDisk(vm, vmName, domain, conf, running, report, app, log)
+	if err != nil {
+		return nil, fmt.Errorf("disk_size: %s", err)
+	}
+
+	err = vmApplyDataDisks(vm, domain, conf, running, report, app, log)
+	if err != nil {
+		return nil, fmt.Errorf("disks: %s", err)
+	}
+
+	return report, nil
+}
+
+func vmApplyCPU(domain *libvirt.Domain, conf *VMConfig, running bool, report *VMChangeReport, log *Log) error {
+	confMax, err := domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_CONFIG | libvirt.DOMAIN_VCPU_MAXIMUM)
+	if err != nil {
+		return err
+	}
+	confCount, err := domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_CONFIG)
+	if err != nil {
+		return err
+	}
+
+	newMax := int32(conf.CPUCountMax)
+	newCount := int32(conf.CPUCount)
+
+	if confMax == newMax && confCount == newCount {
+		return nil
+	}
+
+	// try to hotplug/unplug first
+	live := false
+	if running && newCount != confCount {
+		liveMax, err := domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_LIVE | libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return err
+		}
+		if newCount <= liveMax {
+			err = domain.SetVcpusFlags(uint(newCount), libvirt.DOMAIN_VCPU_LIVE)
+			if err != nil {
+				log.Warningf("unable to change vCPU count live: %s", err)
+			} else {
+				live = true
+			}
+		}
+	}
+
+	// update domain definition (order matters: count must stay <= max)
+	if newMax > confMax {
+		err = domain.SetVcpusFlags(uint(newMax), libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return err
+		}
+	}
+	if newCount != confCount {
+		err = domain.SetVcpusFlags(uint(newCount), libvirt.DOMAIN_VCPU_CONFIG)
+		if err != nil {
+			return err
+		}
+	}
+	if newMax < confMax {
+		err = domain.SetVcpusFlags(uint(newMax), libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return err
+		}
+	}
+
+	if newCount != confCount {
+		msg := fmt.Sprintf("cpu_count: %d -> %d", confCount, newCount)
+		if !running || live {
+			report.Applied = append(report.Applied, msg)
+		} else {
+			report.Restart = append(report.Restart, msg)
+		}
+	}
+
+	if newMax != confMax {
+		msg := fmt.Sprintf("cpu_count_max: %d -> %d", confMax, newMax)
+		if !running {
+			report.Applied = append(report.Applied, msg)
+		} else {
+			report.Restart = append(report.Restart, msg)
+		}
+	}
+
+	return nil
+}
+
+func vmApplyRAM(domain *libvirt.Domain, conf *VMConfig, running bool, report *VMChangeReport, log *Log) error {
+	xmlFlags := libvirt.DomainXMLFlags(0)
+	if running {
+		xmlFlags = libvirt.DOMAIN_XML_INACTIVE
+	}
+
+	xmldoc, err := domain.GetXMLDesc(xmlFlags)
+	if err != nil {
+		return err
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	err = domcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return err
+	}
+
+	// libvirt memory API uses KiB
+	confMax, err := vmMemoryToKiB(domcfg.Memory.Value, domcfg.Memory.Unit)
+	if err != nil {
+		return err
+	}
+	confCurrent := confMax
+	if domcfg.CurrentMemory != nil {
+		confCurrent, err = vmMemoryToKiB(domcfg.CurrentMemory.Value, domcfg.CurrentMemory.Unit)
+		if err != nil {
+			return err
+		}
+	}
+
+	newMax := conf.RAMSizeMax / 1024
+	newCurrent := conf.RAMSize / 1024
+
+	if confMax == newMax && confCurrent == newCurrent {
+		return nil
+	}
+
+	// balloon first
+	live := false
+	if running && newCurrent != confCurrent {
+		liveMax, err := domain.GetMaxMemory()
+		if err != nil {
+			return err
+		}
+		if newCurrent <= liveMax {
+			err = domain.SetMemoryFlags(newCurrent, libvirt.DOMAIN_MEM_LIVE)
+			if err != nil {
+				log.Warningf("unable to change memory live: %s", err)
+			} else {
+				live = true
+			}
+		}
+	}
+
+	// update domain definition (order matters: current must stay <= max)
+	if newMax > confMax {
+		err = domain.SetMemoryFlags(newMax, libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_MAXIMUM)
+		if err != nil {
+			return err
+		}
+	}
+	if newCurrent != confCurrent {
+		err = domain.SetMemoryFlags(newCurrent, libvirt.DOMAIN_MEM_CONFIG)
+		if err != nil {
+			return err
+		}
+	}
+	if newMax < confMax {
+		err = domain.SetMemoryFlags(newMax, libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_MAXIMUM)
+		if err != nil {
+			return err
+		}
+	}
+
+	if newCurrent != confCurrent {
+		msg := fmt.Sprintf("ram_size: %s -> %s", kibToHR(confCurrent), kibToHR(newCurrent))
+		if !running || live {
+			report.Applied = append(report.Applied, msg)
+		} else {
+			report.Restart = append(report.Restart, msg)
+		}
+	}
+
+	if newMax != confMax {
+		msg := fmt.Sprintf("ram_size_max: %s -> %s", kibToHR(confMax), kibToHR(newMax))
+		if !running {
+			report.Applied = append(report.Applied, msg)
+		} else {
+			report.Restart = append(report.Restart, msg)
+		}
+	}
+
+	return nil
+}
+
+func vmApplyDisk(vm *VM, vmName *VMName, domain *libvirt.Domain, conf *VMConfig, running bool, report *VMChangeReport, app *App, log *Log) error {
+	diskName, err := VMGetDiskName(vmName, app)
+	if err != nil {
+		return err
+	}
+
+	infos, err := app.Libvirt.VolumeInfos(diskName, app.Libvirt.Pools.Disks)
+	if err != nil {
+		return err
+	}
+
+	if infos.Capacity == conf.DiskSize {
+		return nil
+	}
+
+	msg := fmt.Sprintf("disk_size: %s -> %s",
+		(datasize.ByteSize(infos.Capacity) * datasize.B).HR(),
+		(datasize.ByteSize(conf.DiskSize) * datasize.B).HR(),
+	)
+
+	if conf.DiskSize < infos.Capacity {
+		// shrinking is only possible with a new disk
+		report.Rebuild = append(report.Rebuild, msg)
+		return nil
+	}
+
+	if !running {
+		// guest partition and filesystem will be grown by cloud-init on next boot
+		err = app.Libvirt.ResizeDisk(diskName, conf.DiskSize, app.Libvirt.Pools.Disks, log)
+		if err != nil {
+			return err
+		}
+		report.Applied = append(report.Applied, msg)
+		return nil
+	}
+
+	// the disk is in use by QEMU, so we ask it to resize the image
+	diskPath := app.Libvirt.Pools.DisksXML.Target.Path + "/" + diskName
+	err = domain.BlockResize(diskPath, conf.DiskSize, libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+	if err != nil {
+		return err
+	}
+	log.Infof("disk '%s' resized to %s", diskName, (datasize.ByteSize(conf.DiskSize) * datasize.B).HR())
+
+	err = vmGrowGuestDisk(vm, app, log)
+	if err != nil {
+		log.Warningf("unable to grow guest filesystem: %s", err)
+		report.Restart = append(report.Restart, msg+" (filesystem)")
+		return nil
+	}
+
+	report.Applied = append(report.Applied, msg)
+	return nil
+}
+
+func vmApplyDataDisks(vm *VM, domain *libvirt.Domain, conf *VMConfig, running bool, report *VMChangeReport, app *App, log *Log) error {
+	attached, _, err := vmDataDisksGet(domain, libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+
+	inConfig := make(map[string]bool)
+	for _, disk := range conf.Disks {
+		inConfig[disk.Name] = true
+
+		diskcfg, exists := attached[disk.Name]
+		if !exists {
+			report.Rebuild = append(report.Rebuild, fmt.Sprintf("disks: '%s' will be created", disk.Name))
+			continue
+		}
+
+		volPath := diskcfg.Source.File.File
+		conn, err := app.Libvirt.GetConnection()
+		if err != nil {
+			return err
+		}
+		vol, err := conn.LookupStorageVolByPath(volPath)
+		if err != nil {
+			return err
+		}
+		infos, err := vol.GetInfo()
+		vol.Free()
+		if err != nil {
+			return err
+		}
+
+		if infos.Capacity == disk.Size {
+			continue
+		}
+
+		msg := fmt.Sprintf("disks: '%s' size %s -> %s",
+			disk.Name,
+			(datasize.ByteSize(infos.Capacity) * datasize.B).HR(),
+			(datasize.ByteSize(disk.Size) * datasize.B).HR(),
+		)
+
+		if disk.Size < infos.Capacity {
+			report.Rebuild = append(report.Rebuild, msg+" (shrink is not supported, will be ignored)")
+			continue
+		}
+
+		if !running {
+			err = vmDataDiskGrow(volPath, disk.Size, app, log)
+			if err != nil {
+				return err
+			}
+			report.Applied = append(report.Applied, msg)
+			continue
+		}
+
+		err = domain.BlockResize(volPath, disk.Size, libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+		if err != nil {
+			return err
+		}
+
+		// will also grow the filesystem
+		err = VMDataDisksMount(vm, []*VMDataDisk{disk}, app, log)
+		if err != nil {
+			log.Warningf("unable to grow data disk filesystem: %s", err)
+			report.Rebuild = append(report.Rebuild, msg+" (filesystem)")
+			continue
+		}
+		report.Applied = append(report.Applied, msg)
+	}
+
+	for name := range attached {
+		if !inConfig[name] {
+			report.Rebuild = append(report.Rebuild, fmt.Sprintf("disks: '%s' will be detached (volume is kept)", name))
+		}
+	}
+
+	return nil
+}
+
+// grow root partition and filesystem inside the VM
+func vmGrowGuestDisk(vm *VM, app *App, log *Log) error {
+	if vm.LastIP == "" {
+		return errors.New("unknown VM IP")
+	}
+
+	script, err := os.Open(app.Config.GetTemplateFilepath("grow-disk.sh"))
+	if err != nil {
+		return err
+	}
+	defer script.Close()
+
+	SSHSuperUserAuth, err := app.SSHPairDB.GetPublicKeyAuth(vm.MulchSuperUserSSHKey)
+	if err != nil {
+		return err
+	}
+
+	run := &Run{
+		Caption: "grow-disk",
+		SSHConn: &SSHConnection{
+			User: app.Config.MulchSuperUser,
+			Host: vm.LastIP,
+			Port: 22,
+			Auths: []ssh.AuthMethod{
+				SSHSuperUserAuth,
+			},
+			Log: log,
+		},
+		Tasks: []*RunTask{
+			{
+				ScriptName:   "grow-disk.sh",
+				ScriptReader: script,
+				As:           app.Config.MulchSuperUser,
+			},
+		},
+		Log: log,
+	}
+
+	return run.Go(context.Background())
+}
+
+// libvirt always returns KiB in domain XML, but let's be careful
+func vmMemoryToKiB(value uint, unit string) (uint64, error) {
+	switch unit {
+	case "", "k", "KiB":
+		return uint64(value), nil
+	case "b", "bytes":
+		return uint64(value) / 1024, nil
+	case "M", "MiB":
+		return uint64(value) * 1024, nil
+	case "G", "GiB":
+		return uint64(value) * 1024 * 1024, nil
+	}
+	return 0, fmt.Errorf("unsupported memory unit '%s'", unit)
+}
+
+func kibToHR(kib uint64) string {
+	return (datasize.ByteSize(kib) * datasize.KB).HR()
+}
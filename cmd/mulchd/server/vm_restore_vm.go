@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// VMRestoreFromVMPrefix is the restore_backup prefix used to restore data
+// from another VM instead of an existing backup (ex: "vm:prod-shop")
+const VMRestoreFromVMPrefix = "vm:"
+
+// VMRestoreSourceVM returns the source VM name if restore is a "vm:name"
+// restore_backup value
+func VMRestoreSourceVM(restore string) (string, bool) {
+	if !strings.HasPrefix(restore, VMRestoreFromVMPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(restore, VMRestoreFromVMPrefix), true
+}
+
+// VMGetRestoreSource returns the active revision of the source VM of a
+// "vm:name" restore, and checks it's ready to be backuped.
+func VMGetRestoreSource(srcName string, app *App) (*VMName, error) {
+	entry, err := app.VMDB.GetActiveEntryByName(srcName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find VM to backup: %s", err)
+	}
+
+	if len(entry.VM.Config.Backup) == 0 {
+		return nil, fmt.Errorf("VM %s has no backup script", entry.Name)
+	}
+
+	return entry.Name, nil
+}
+
+// VMTransientBackup creates an uncompressed backup of the active revision
+// of a VM, to be restored right away in another VM (targetName). The source
+// VM is locked during the backup (unless it's the target VM itself, already
+// locked by the caller). The caller must delete the backup (see BackupDelete)
+// when the restore is done.
+func VMTransientBackup(ctx context.Context, srcName string, targetName string, authorKey string, app *App, log *Log) (string, error) {
+	vmName, err := VMGetRestoreSource(srcName, app)
+	if err != nil {
+		return "", err
+	}
+
+	if srcName != targetName {
+		op := &Operation{
+			Origin:        authorKey,
+			Action:        "backup",
+			Ressource:     "vm",
+			RessourceName: vmName.ID(),
+		}
+		operation, err := app.Operations.AddVM(op, vmName.Name)
+		if err != nil {
+			return "", fmt.Errorf("cannot backup %s: %s", vmName, err)
+		}
+		defer app.Operations.Remove(operation)
+	}
+
+	log.Infof("creating transient backup of %s", vmName)
+	backup, err := VMBackup(ctx, vmName, authorKey, app, log, BackupCompressDisable, BackupNoExpiration)
+	if err != nil {
+		return "", fmt.Errorf("cannot backup %s: %s", vmName, err)
+	}
+
+	return backup, nil
+}
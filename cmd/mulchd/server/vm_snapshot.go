@@ -0,0 +1,238 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// VMSnapshot describes a libvirt snapshot of a VM
+type VMSnapshot struct {
+	Name        string
+	Description string
+	Created     time.Time
+	State       string
+	Parent      string
+	Current     bool
+}
+
+var vmSnapshotNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// vmSnapshotGetDomain returns libvirt domain of the VM, after checking
+// that no other heavy operation is running on it
+func vmSnapshotGetDomain(vmName *VMName, app *App) (*VM, *libvirt.Domain, error) {
+	vm, err := app.VMDB.GetByName(vmName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if vm.WIP != VMOperationNone {
+		return nil, nil, fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+	}
+
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return nil, nil, err
+	}
+	if domain == nil {
+		return nil, nil, fmt.Errorf("VM %s: does not exists in libvirt", vmName)
+	}
+
+	return vm, domain, nil
+}
+
+// VMSnapshotCreate creates an internal snapshot of the VM (disk and,
+// if the VM is running, memory). The snapshot is crash-consistent.
+// If snapName is empty, a name is generated. Returns snapshot name.
+func VMSnapshotCreate(vmName *VMName, snapName string, authorKey string, app *App, log *Log) (string, error) {
+	vm, domain, err := vmSnapshotGetDomain(vmName, app)
+	if err != nil {
+		return "", err
+	}
+	defer domain.Free()
+
+	if snapName == "" {
+		snapName = "snap-" + time.Now().Format("20060102-150405")
+	}
+
+	if !vmSnapshotNameRegexp.MatchString(snapName) {
+		return "", fmt.Errorf("invalid snapshot name '%s'", snapName)
+	}
+
+	vm.SetOperation(VMOperationSnapshot)
+	defer vm.SetOperation(VMOperationNone)
+
+	snapcfg := &libvirtxml.DomainSnapshot{
+		Name:        snapName,
+		Description: "created by " + authorKey,
+	}
+
+	xml, err := snapcfg.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("creating snapshot '%s' of %s", snapName, vmName)
+	before := time.Now()
+
+	snap, err := domain.CreateSnapshotXML(xml, libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC)
+	if err != nil {
+		return "", err
+	}
+	defer snap.Free()
+
+	log.Infof("snapshot created (%s)", time.Since(before))
+
+	return snapName, nil
+}
+
+// VMSnapshotList returns all snapshots of the VM (sorted by creation date)
+func VMSnapshotList(vmName *VMName, app *App) ([]*VMSnapshot, error) {
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return nil, err
+	}
+	if domain == nil {
+		return nil, fmt.Errorf("VM %s: does not exists in libvirt", vmName)
+	}
+	defer domain.Free()
+
+	snaps, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*VMSnapshot
+	for _, snap := range snaps {
+		entry, err := vmSnapshotInfos(&snap)
+		snap.Free()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+
+	return res, nil
+}
+
+func vmSnapshotInfos(snap *libvirt.DomainSnapshot) (*VMSnapshot, error) {
+	xmldoc, err := snap.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	snapcfg := &libvirtxml.DomainSnapshot{}
+	err = snapcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := snap.IsCurrent(0)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &VMSnapshot{
+		Name:        snapcfg.Name,
+		Description: snapcfg.Description,
+		State:       snapcfg.State,
+		Current:     current,
+	}
+
+	if snapcfg.Parent != nil {
+		res.Parent = snapcfg.Parent.Name
+	}
+
+	if snapcfg.CreationTime != "" {
+		ts, err := strconv.ParseInt(snapcfg.CreationTime, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time for snapshot %s: %s", snapcfg.Name, err)
+		}
+		res.Created = time.Unix(ts, 0)
+	}
+
+	return res, nil
+}
+
+// VMSnapshotRevert reverts the VM to a snapshot. The VM will be in the
+// state it was during the snapshot (running or not).
+func VMSnapshotRevert(vmName *VMName, snapName string, app *App, log *Log) error {
+	vm, domain, err := vmSnapshotGetDomain(vmName, app)
+	if err != nil {
+		return err
+	}
+	defer domain.Free()
+
+	if snapName == "" {
+		return errors.New("missing snapshot name")
+	}
+
+	snap, err := domain.SnapshotLookupByName(snapName, 0)
+	if err != nil {
+		return fmt.Errorf("snapshot '%s' not found: %s", snapName, err)
+	}
+	defer snap.Free()
+
+	infos, err := vmSnapshotInfos(snap)
+	if err != nil {
+		return err
+	}
+
+	vm.SetOperation(VMOperationSnapshot)
+	defer vm.SetOperation(VMOperationNone)
+
+	log.Infof("reverting %s to snapshot '%s'", vmName, snapName)
+	before := time.Now()
+
+	// the domain is started or stopped by the revert
+	targetState := VMStateDown
+	if infos.State == "running" || infos.State == "paused" {
+		targetState = VMStateUp
+	}
+	app.VMStateDB.ExpectRevert(vmName, targetState)
+
+	err = snap.RevertToSnapshot(0)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("reverted (%s)", time.Since(before))
+
+	return nil
+}
+
+// VMSnapshotDelete deletes a snapshot of the VM
+func VMSnapshotDelete(vmName *VMName, snapName string, app *App, log *Log) error {
+	vm, domain, err := vmSnapshotGetDomain(vmName, app)
+	if err != nil {
+		return err
+	}
+	defer domain.Free()
+
+	if snapName == "" {
+		return errors.New("missing snapshot name")
+	}
+
+	snap, err := domain.SnapshotLookupByName(snapName, 0)
+	if err != nil {
+		return fmt.Errorf("snapshot '%s' not found: %s", snapName, err)
+	}
+	defer snap.Free()
+
+	vm.SetOperation(VMOperationSnapshot)
+	defer vm.SetOperation(VMOperationNone)
+
+	log.Infof("deleting snapshot '%s' of %s", snapName, vmName)
+
+	return snap.Delete(0)
+}
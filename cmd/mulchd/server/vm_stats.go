@@ -0,0 +1,519 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+	"libvirt.org/go/libvirt"
+)
+
+// VMStatsSampleInterval is the interval between two resource usage samples
+const VMStatsSampleInterval = 1 * time.Minute
+
+// VMStatsRetention is the duration samples are kept on disk
+const VMStatsRetention = 31 * 24 * time.Hour
+
+// VMStatsMaxPoints is the maximum number of points for a query
+const VMStatsMaxPoints = 1000
+
+const vmStatsFileSuffix = ".stats"
+
+// memory balloon stats period, set on running domains if needed
+const vmStatsBalloonPeriod = 10
+
+// VMStatsSample is a resource usage sample of a VM. It's stored as a
+// fixed-size binary record (see vmStatsRecordSize), one file per VM name.
+// Only the active revision is sampled, so a rebuild does not mix the
+// old VM with the new one.
+type VMStatsSample struct {
+	Time      int64 // unix timestamp
+	Revision  int32
+	CPU       float32 // percent of allocated CPUs
+	MemUsed   uint64  // bytes
+	MemTotal  uint64
+	DiskRead  float32 // bytes per second
+	DiskWrite float32
+	NetRx     float32
+	NetTx     float32
+}
+
+var vmStatsRecordSize = binary.Size(VMStatsSample{})
+
+// counters of the previous sample of a domain, used to compute rates
+type vmStatsCounters struct {
+	time      time.Time
+	cpuTime   uint64
+	diskRead  uint64
+	diskWrite uint64
+	netRx     uint64
+	netTx     uint64
+}
+
+// VMStatsDatabase samples resource usage of running VMs and stores it
+// on disk (time-series)
+type VMStatsDatabase struct {
+	dir      string
+	previous map[string]*vmStatsCounters // by libvirt domain name
+	balloon  map[string]bool             // balloon period set (by libvirt domain name)
+	mutex    sync.Mutex
+	app      *App
+}
+
+// NewVMStatsDatabase creates a new VMStatsDatabase in the given
+// directory (created if needed)
+func NewVMStatsDatabase(dir string, app *App) (*VMStatsDatabase, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VMStatsDatabase{
+		dir:      dir,
+		previous: make(map[string]*vmStatsCounters),
+		balloon:  make(map[string]bool),
+		app:      app,
+	}, nil
+}
+
+func (vsdb *VMStatsDatabase) filename(vmName string) string {
+	return path.Clean(vsdb.dir + "/" + vmName + vmStatsFileSuffix)
+}
+
+// Sample gets resource usage of all running (active) VMs and stores it
+func (vsdb *VMStatsDatabase) Sample() error {
+	conn, err := vsdb.app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	// libvirt domain name -> VM name (active revisions only)
+	names := make(map[string]*VMName)
+	for _, vmName := range vsdb.app.VMDB.GetNames() {
+		active, err := vsdb.app.VMDB.IsVMActive(vmName)
+		if err != nil || !active {
+			continue
+		}
+		names[vmName.LibvirtDomainName(vsdb.app)] = vmName
+	}
+
+	statsTypes := libvirt.DOMAIN_STATS_CPU_TOTAL |
+		libvirt.DOMAIN_STATS_BALLOON |
+		libvirt.DOMAIN_STATS_VCPU |
+		libvirt.DOMAIN_STATS_INTERFACE |
+		libvirt.DOMAIN_STATS_BLOCK
+
+	allStats, err := conn.GetAllDomainStats(nil, statsTypes, libvirt.CONNECT_GET_ALL_DOMAINS_STATS_ACTIVE)
+	if err != nil {
+		return err
+	}
+
+	vsdb.mutex.Lock()
+	defer vsdb.mutex.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, stats := range allStats {
+		domainName, err := stats.Domain.GetName()
+		if err != nil {
+			stats.Domain.Free()
+			continue
+		}
+		vmName, exists := names[domainName]
+		if !exists {
+			stats.Domain.Free()
+			continue
+		}
+		seen[domainName] = true
+
+		if !vsdb.balloon[domainName] {
+			// needed to get guest memory usage (not fatal)
+			stats.Domain.SetMemoryStatsPeriod(vmStatsBalloonPeriod, libvirt.DOMAIN_MEM_LIVE)
+			vsdb.balloon[domainName] = true
+		}
+		stats.Domain.Free()
+
+		counters, sample := vmStatsFromLibvirt(&stats, now)
+		sample.Revision = int32(vmName.Revision)
+
+		prev, exists := vsdb.previous[domainName]
+		vsdb.previous[domainName] = counters
+		if !exists {
+			continue
+		}
+
+		elapsed := now.Sub(prev.time)
+		if elapsed <= 0 {
+			continue
+		}
+
+		numCPU := len(stats.Vcpu)
+		if numCPU == 0 {
+			numCPU = 1
+		}
+
+		seconds := elapsed.Seconds()
+		sample.CPU = float32(float64(vmStatsDelta(counters.cpuTime, prev.cpuTime)) / float64(elapsed.Nanoseconds()) / float64(numCPU) * 100)
+		sample.DiskRead = float32(float64(vmStatsDelta(counters.diskRead, prev.diskRead)) / seconds)
+		sample.DiskWrite = float32(float64(vmStatsDelta(counters.diskWrite, prev.diskWrite)) / seconds)
+		sample.NetRx = float32(float64(vmStatsDelta(counters.netRx, prev.netRx)) / seconds)
+		sample.NetTx = float32(float64(vmStatsDelta(counters.netTx, prev.netTx)) / seconds)
+
+		err = vsdb.append(vmName.Name, sample)
+		if err != nil {
+			vsdb.app.Log.Errorf("VM stats: %s: %s", vmName, err)
+		}
+	}
+
+	// forget stopped domains
+	for domainName := range vsdb.previous {
+		if !seen[domainName] {
+			delete(vsdb.previous, domainName)
+			delete(vsdb.balloon, domainName)
+		}
+	}
+
+	return nil
+}
+
+// counters are reset when a domain is restarted
+func vmStatsDelta(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return 0
+	}
+	return current - previous
+}
+
+func vmStatsFromLibvirt(stats *libvirt.DomainStats, now time.Time) (*vmStatsCounters, *VMStatsSample) {
+	counters := &vmStatsCounters{
+		time: now,
+	}
+	sample := &VMStatsSample{
+		Time: now.Unix(),
+	}
+
+	if stats.Cpu != nil {
+		counters.cpuTime = stats.Cpu.Time
+	}
+
+	for _, block := range stats.Block {
+		counters.diskRead += block.RdBytes
+		counters.diskWrite += block.WrBytes
+	}
+
+	for _, net := range stats.Net {
+		counters.netRx += net.RxBytes
+		counters.netTx += net.TxBytes
+	}
+
+	// balloon values are in KiB
+	if b := stats.Balloon; b != nil {
+		switch {
+		case b.AvailableSet && b.UsableSet && b.Usable <= b.Available:
+			sample.MemTotal = b.Available * 1024
+			sample.MemUsed = (b.Available - b.Usable) * 1024
+		case b.AvailableSet && b.UnusedSet && b.Unused <= b.Available:
+			sample.MemTotal = b.Available * 1024
+			sample.MemUsed = (b.Available - b.Unused) * 1024
+		default:
+			// no guest stats, use host side values
+			sample.MemTotal = b.Current * 1024
+			sample.MemUsed = b.Rss * 1024
+		}
+	}
+
+	return counters, sample
+}
+
+// must be called with the mutex locked
+func (vsdb *VMStatsDatabase) append(vmName string, sample *VMStatsSample) error {
+	f, err := os.OpenFile(vsdb.filename(vmName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// remove any truncated record (crash?) to keep records aligned
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if rem := stat.Size() % int64(vmStatsRecordSize); rem != 0 {
+		err = f.Truncate(stat.Size() - rem)
+		if err != nil {
+			return err
+		}
+	}
+
+	return binary.Write(f, binary.LittleEndian, sample)
+}
+
+// read all samples of a VM more recent than since, calling cb for each
+func (vsdb *VMStatsDatabase) read(vmName string, since time.Time, cb func(*VMStatsSample)) error {
+	f, err := os.Open(vsdb.filename(vmName))
+	if os.IsNotExist(err) {
+		// no sample (yet)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	sinceUnix := since.Unix()
+	for {
+		var sample VMStatsSample
+		err := binary.Read(reader, binary.LittleEndian, &sample)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// a truncated last record (crash?) is ignored
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sample.Time < sinceUnix {
+			continue
+		}
+		cb(&sample)
+	}
+}
+
+// Cleanup removes samples older than VMStatsRetention (and files
+// without any remaining sample)
+func (vsdb *VMStatsDatabase) Cleanup() error {
+	vsdb.mutex.Lock()
+	defer vsdb.mutex.Unlock()
+
+	entries, err := os.ReadDir(vsdb.dir)
+	if err != nil {
+		return err
+	}
+
+	since := time.Now().Add(-VMStatsRetention)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), vmStatsFileSuffix) {
+			continue
+		}
+		vmName := strings.TrimSuffix(entry.Name(), vmStatsFileSuffix)
+
+		var samples []*VMStatsSample
+		count := 0
+		err := vsdb.read(vmName, time.Time{}, func(sample *VMStatsSample) {
+			count++
+			if sample.Time >= since.Unix() {
+				samples = append(samples, sample)
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(samples) == count {
+			continue
+		}
+
+		filename := vsdb.filename(vmName)
+		if len(samples) == 0 {
+			err = os.Remove(filename)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = vsdb.rewrite(filename, samples)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (vsdb *VMStatsDatabase) rewrite(filename string, samples []*VMStatsSample) error {
+	tmpFilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(f)
+	for _, sample := range samples {
+		err = binary.Write(writer, binary.LittleEndian, sample)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	errC := f.Close()
+	if err == nil {
+		err = errC
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	return os.Rename(tmpFilename, filename)
+}
+
+// Run the sampling loop (and the daily cleanup)
+func (vsdb *VMStatsDatabase) Run() {
+	vsdb.app.VMStateDB.WaitRestore()
+
+	lastCleanup := time.Time{}
+	for {
+		err := vsdb.Sample()
+		if err != nil {
+			vsdb.app.Log.Errorf("VM stats: %s", err)
+		}
+
+		if time.Since(lastCleanup) > 24*time.Hour {
+			err = vsdb.Cleanup()
+			if err != nil {
+				vsdb.app.Log.Errorf("VM stats cleanup: %s", err)
+			}
+			lastCleanup = time.Now()
+		}
+
+		time.Sleep(VMStatsSampleInterval)
+	}
+}
+
+// Get returns resource usage of a VM since the given time, with at
+// most maxPoints detailed points (0 for summary only)
+func (vsdb *VMStatsDatabase) Get(vmName string, since time.Time, maxPoints int) (*common.APIVMStats, error) {
+	vsdb.mutex.Lock()
+	defer vsdb.mutex.Unlock()
+
+	if maxPoints > VMStatsMaxPoints {
+		maxPoints = VMStatsMaxPoints
+	}
+
+	summary := newVMStatsAggregator(since)
+	var points []*vmStatsAggregator
+	var step int64
+	if maxPoints > 0 {
+		step = (time.Now().Unix() - since.Unix()) / int64(maxPoints)
+		if step < int64(VMStatsSampleInterval.Seconds()) {
+			step = int64(VMStatsSampleInterval.Seconds())
+		}
+	}
+
+	err := vsdb.read(vmName, since, func(sample *VMStatsSample) {
+		summary.add(sample)
+		if step == 0 {
+			return
+		}
+		start := since.Unix() + (sample.Time-since.Unix())/step*step
+		if len(points) == 0 || points[len(points)-1].start.Unix() != start {
+			points = append(points, newVMStatsAggregator(time.Unix(start, 0)))
+		}
+		points[len(points)-1].add(sample)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &common.APIVMStats{
+		VMName:  vmName,
+		Summary: summary.toAPI(),
+		Points:  []common.APIVMStatsPoint{},
+	}
+	for _, point := range points {
+		res.Points = append(res.Points, point.toAPI())
+	}
+
+	return res, nil
+}
+
+// GetAll returns a summary of resource usage since the given time for
+// all VMs with samples
+func (vsdb *VMStatsDatabase) GetAll(since time.Time) ([]*common.APIVMStats, error) {
+	entries, err := os.ReadDir(vsdb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*common.APIVMStats{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), vmStatsFileSuffix) {
+			continue
+		}
+		vmName := strings.TrimSuffix(entry.Name(), vmStatsFileSuffix)
+
+		stats, err := vsdb.Get(vmName, since, 0)
+		if err != nil {
+			return nil, err
+		}
+		if stats.Summary.Samples == 0 {
+			continue
+		}
+		res = append(res, stats)
+	}
+
+	return res, nil
+}
+
+type vmStatsAggregator struct {
+	start     time.Time
+	samples   int
+	cpuSum    float64
+	cpuMax    float64
+	memSum    uint64
+	memMax    uint64
+	memTotal  uint64
+	diskRead  float64
+	diskWrite float64
+	netRx     float64
+	netTx     float64
+}
+
+func newVMStatsAggregator(start time.Time) *vmStatsAggregator {
+	return &vmStatsAggregator{start: start}
+}
+
+func (agg *vmStatsAggregator) add(sample *VMStatsSample) {
+	agg.samples++
+	agg.cpuSum += float64(sample.CPU)
+	agg.cpuMax = max(agg.cpuMax, float64(sample.CPU))
+	agg.memSum += sample.MemUsed
+	agg.memMax = max(agg.memMax, sample.MemUsed)
+	agg.memTotal = sample.MemTotal // latest one
+	agg.diskRead += float64(sample.DiskRead)
+	agg.diskWrite += float64(sample.DiskWrite)
+	agg.netRx += float64(sample.NetRx)
+	agg.netTx += float64(sample.NetTx)
+}
+
+func (agg *vmStatsAggregator) toAPI() common.APIVMStatsPoint {
+	point := common.APIVMStatsPoint{
+		Time:       agg.start,
+		Samples:    agg.samples,
+		CPUMax:     agg.cpuMax,
+		MemUsedMax: agg.memMax,
+		MemTotal:   agg.memTotal,
+	}
+	if agg.samples == 0 {
+		return point
+	}
+
+	n := float64(agg.samples)
+	point.CPUAvg = agg.cpuSum / n
+	point.MemUsedAvg = agg.memSum / uint64(agg.samples)
+	point.DiskReadAvg = agg.diskRead / n
+	point.DiskWriteAvg = agg.diskWrite / n
+	point.NetRxAvg = agg.netRx / n
+	point.NetTxAvg = agg.netTx / n
+	return point
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+)
+
+// VMConfigProblem is a problem found during a VM config validation
+type VMConfigProblem struct {
+	Setting string // may be empty
+	Message string
+	Warning bool // not blocking
+}
+
+// VMConfigProblems is a list of problems
+type VMConfigProblems []*VMConfigProblem
+
+// Add a new (blocking) problem
+func (problems *VMConfigProblems) Add(setting string, message string) {
+	problems.add(setting, message, false)
+}
+
+// AddWarning adds a new non-blocking problem
+func (problems *VMConfigProblems) AddWarning(setting string, message string) {
+	problems.add(setting, message, true)
+}
+
+func (problems *VMConfigProblems) add(setting string, message string, warning bool) {
+	for _, problem := range *problems {
+		if problem.Setting == setting && problem.Message == message {
+			return
+		}
+	}
+	*problems = append(*problems, &VMConfigProblem{
+		Setting: setting,
+		Message: message,
+		Warning: warning,
+	})
+}
+
+// HasErrors returns true if at least one problem is blocking
+func (problems VMConfigProblems) HasErrors() bool {
+	for _, problem := range problems {
+		if !problem.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// VMConfigValidate checks a VM config (see NewVMConfigFromTomlReader)
+// without creating anything, and returns all problems found. The
+// returned config is nil if the content can't be decoded.
+func VMConfigValidate(content string, authorKey string, vars map[string]string, allowNewRevision bool, app *App) (*VMConfig, VMConfigProblems) {
+	problems := VMConfigProblems{}
+
+	conf, err := newVMConfigFromTomlReader(strings.NewReader(content), authorKey, vars, app, &problems)
+	if err != nil {
+		problems.Add("", err.Error())
+		return nil, problems
+	}
+
+	if app.VMDB.GetCountForName(conf.Name) > 0 && !allowNewRevision {
+		problems.Add("name", fmt.Sprintf("VM '%s' already exists (see --new-revision CLI option?)", conf.Name))
+	}
+
+	seed, err := app.Seeder.GetByName(conf.Seed)
+	if err != nil {
+		problems.Add("seed", err.Error())
+	} else if !seed.Ready {
+		problems.AddWarning("seed", fmt.Sprintf("seed %s is not ready", conf.Seed))
+	}
+
+	for _, domain := range conf.Domains {
+		err = CheckDomainsConflicts(app.VMDB, []*common.Domain{domain}, conf.Name, app.Config)
+		if err != nil {
+			problems.Add("domains", err.Error())
+		}
+	}
+
+	for _, port := range conf.Ports {
+		err = CheckPortsConflicts(app.VMDB, []*VMPort{port}, conf.Name, nil)
+		if err != nil {
+			problems.Add("ports", err.Error())
+		}
+	}
+	err = CheckPortsConflicts(app.VMDB, conf.Ports, conf.Name, nil)
+	if err != nil {
+		problems.Add("ports", err.Error())
+	}
+
+	if conf.RestoreBackup != "" {
+		if srcName, ok := VMRestoreSourceVM(conf.RestoreBackup); ok {
+			srcVMName, err := VMGetRestoreSource(srcName, app)
+			if err != nil {
+				problems.Add("restore_backup", err.Error())
+			} else if running, _ := VMIsRunning(srcVMName, app); !running {
+				problems.AddWarning("restore_backup", fmt.Sprintf("source VM %s is not running", srcVMName))
+			}
+		} else if app.BackupsDB.GetByName(conf.RestoreBackup) == nil && conf.RestoreBackup != BackupBlankRestore {
+			problems.Add("restore_backup", fmt.Sprintf("backup '%s' not found in database", conf.RestoreBackup))
+		}
+		if len(conf.Restore) == 0 {
+			problems.Add("restore_backup", "no restore script defined for this VM, can't restore")
+		}
+	}
+
+	if len(conf.Restore) > 0 && len(conf.Backup) == 0 {
+		problems.AddWarning("backup", "restore script(s) defined but no backup script found (no rebuild possible)")
+	}
+	if len(conf.Backup) > 0 && len(conf.Restore) == 0 {
+		problems.AddWarning("restore", "backup script(s) defined but no restore script found (no rebuild possible)")
+	}
+
+	vmValidateStorage(conf, app, &problems)
+
+	return conf, problems
+}
+
+// check that storage pools have enough space for the VM disks (qcow2
+// volumes are allocated on demand, so it's only a warning)
+func vmValidateStorage(conf *VMConfig, app *App, problems *VMConfigProblems) {
+	needed := make(map[string]uint64)
+	needed[""] = conf.DiskSize
+	for _, disk := range conf.Disks {
+		needed[disk.Pool] += disk.Size
+	}
+
+	for poolName, size := range needed {
+		pool, _, err := app.Libvirt.GetStoragePool(poolName)
+		if err != nil {
+			problems.Add("disks", err.Error())
+			continue
+		}
+
+		info, err := pool.GetInfo()
+		app.Libvirt.ReleaseStoragePool(pool)
+		if err != nil {
+			problems.AddWarning("disks", fmt.Sprintf("can't get storage pool info: %s", err))
+			continue
+		}
+
+		if size > info.Available {
+			label := poolName
+			if label == "" {
+				label = AppStorageDisks
+			}
+			problems.AddWarning("disks", fmt.Sprintf("storage pool '%s' may be too small: %s needed, %s available",
+				label,
+				(datasize.ByteSize(size)*datasize.B).HR(),
+				(datasize.ByteSize(info.Available)*datasize.B).HR(),
+			))
+		}
+	}
+}
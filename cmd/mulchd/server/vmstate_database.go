@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	"sync"
@@ -14,14 +16,41 @@ const (
 	VMStateDown = "down"
 )
 
+// VMStateUpdateInterval is the delay between two VM state updates
+const VMStateUpdateInterval = 10 * time.Second
+
+// a state expected by Mulch (VM start or stop) is forgotten after this delay
+const vmStateExpectationTTL = 15 * time.Minute
+
 // VMStateDatabase describes a persistent DataBase of VM state (up or down)
+// ---
+// Each update compares observed states with the previous ones and with
+// the states expected by Mulch (see Expect), and sends alerts when an
+// active VM goes down by itself, does not phone home after a boot, or
+// when its libvirt domain disappears.
 type VMStateDatabase struct {
 	filename string
 	db       map[string]string
-	mutex    sync.Mutex
+	mutex    sync.Mutex   // serializes updates
+	dbMutex  sync.RWMutex // protects db (see Get)
 	app      *App
 	restored bool
 	cycles   uint64
+
+	lastUpdate   time.Time
+	down         map[string]bool      // VMs that went down unexpectedly (alerted)
+	missing      map[string]bool      // VMs without libvirt domain (alerted)
+	waitingPhone map[string]time.Time // VMs up since this date, waiting for a phone call
+
+	expected    map[string]vmStateExpectation // see Expect
+	phonedAt    map[string]time.Time          // see PhoneCall
+	eventsMutex sync.Mutex                    // protects expected and phonedAt
+}
+
+type vmStateExpectation struct {
+	state   string
+	at      time.Time
+	noPhone bool // the VM will not phone home (snapshot revert)
 }
 
 // NewVMStateDatabase instanciates a new VMStateDatabase
@@ -32,6 +61,12 @@ func NewVMStateDatabase(filename string, app *App) (*VMStateDatabase, error) {
 		app:      app,
 		restored: false,
 		cycles:   0,
+
+		down:         make(map[string]bool),
+		missing:      make(map[string]bool),
+		waitingPhone: make(map[string]time.Time),
+		expected:     make(map[string]vmStateExpectation),
+		phonedAt:     make(map[string]time.Time),
 	}
 
 	// if the file exists, load it
@@ -85,43 +120,273 @@ func (vmsdb *VMStateDatabase) load() error {
 	return nil
 }
 
-// Update saves the DB with current VM states
+// Update saves the DB with current VM states, and sends alerts about
+// unexpected state changes
 func (vmsdb *VMStateDatabase) Update() error {
+	alerts, err := vmsdb.update()
+
+	// sent without the mutex, alert channels may be slow
+	vmsdb.sendAlerts(alerts)
+
+	return err
+}
+
+func (vmsdb *VMStateDatabase) sendAlerts(alerts []*Alert) {
+	for _, alert := range alerts {
+		vmsdb.app.Log.Warning(alert.Content)
+		vmsdb.app.AlertSender.Send(alert)
+	}
+}
+
+func (vmsdb *VMStateDatabase) update() ([]*Alert, error) {
 	vmsdb.mutex.Lock()
 	defer vmsdb.mutex.Unlock()
 
 	vmsdb.cycles++
 
+	var alerts []*Alert
+
 	// loop over VM and get state
 	newStates := make(map[string]string)
 	for _, vmName := range vmsdb.app.VMDB.GetNames() {
+		entry, err := vmsdb.app.VMDB.GetEntryByName(vmName)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+
+		id := vmName.ID()
+		prevState, known := vmsdb.db[id]
+
 		state, err := VMIsRunning(vmName, vmsdb.app)
+		if errors.Is(err, ErrVMDomainNotFound) {
+			alerts = vmsdb.checkMissing(entry, alerts)
+			// keep the last known state, so we don't try to "restore" it
+			if known {
+				newStates[id] = prevState
+			}
+			continue
+		}
 		if err != nil {
-			return err
+			return alerts, err
+		}
+
+		if vmsdb.missing[id] {
+			vmsdb.app.Log.Infof("domain of %s is back in libvirt", vmName)
+			delete(vmsdb.missing, id)
 		}
+
 		sState := VMStateDown
 		if state {
 			sState = VMStateUp
 		}
-		newStates[vmName.ID()] = sState
+		newStates[id] = sState
+
+		if known {
+			alerts = vmsdb.checkTransition(entry, prevState, sState, alerts)
+		}
 	}
 
+	alerts = vmsdb.checkPhoneCalls(newStates, alerts)
+	vmsdb.cleanup(newStates)
+	vmsdb.lastUpdate = time.Now()
+
 	// compare states with previous ones
 	eq := reflect.DeepEqual(vmsdb.db, newStates)
 	if eq {
-		return nil
+		return alerts, nil
 	}
 
 	// something changed, let's update
 	vmsdb.app.Log.Info("updating VM state database")
+	vmsdb.dbMutex.Lock()
 	vmsdb.db = newStates
-	return vmsdb.save()
+	vmsdb.dbMutex.Unlock()
+
+	err := vmsdb.save()
+	if err != nil {
+		return alerts, err
+	}
+
+	// domains of stopped VMs are in maintenance mode (see genDomainsDB)
+	return alerts, vmsdb.app.VMDB.Update()
+}
+
+// compare an observed state with the previous one and with the expected one
+func (vmsdb *VMStateDatabase) checkTransition(entry *VMDatabaseEntry, prevState string, state string, alerts []*Alert) []*Alert {
+	vmName := entry.Name
+	id := vmName.ID()
+	expectation, expected := vmsdb.isExpected(vmName, state)
+
+	if prevState == VMStateUp && state == VMStateDown {
+		delete(vmsdb.waitingPhone, id)
+
+		if !expected && entry.Active && !vmsdb.app.Operations.IsVMLocked(vmName.Name) {
+			vmsdb.down[id] = true
+			alerts = append(alerts, &Alert{
+				Type:    AlertTypeBad,
+				Subject: fmt.Sprintf("VM %s is down", vmName.Name),
+				Content: fmt.Sprintf("VM %s went down without a Mulch stop (crash, OOM, host-side destroy or shutdown from the VM?)", vmName),
+				VMName:  vmName.Name,
+			})
+		}
+	}
+
+	if prevState == VMStateDown && state == VMStateUp {
+		// any phone call since the last update is for this boot
+		if !expectation.noPhone {
+			vmsdb.waitingPhone[id] = vmsdb.lastUpdate
+		}
+
+		if vmsdb.down[id] {
+			delete(vmsdb.down, id)
+			alerts = append(alerts, &Alert{
+				Type:    AlertTypeGood,
+				Subject: fmt.Sprintf("VM %s is up", vmName.Name),
+				Content: fmt.Sprintf("VM %s is up again", vmName),
+				VMName:  vmName.Name,
+			})
+		}
+	}
+
+	return alerts
+}
+
+// alert (once) when the libvirt domain of a VM disappears
+func (vmsdb *VMStateDatabase) checkMissing(entry *VMDatabaseEntry, alerts []*Alert) []*Alert {
+	vmName := entry.Name
+	id := vmName.ID()
+
+	// domains are undefined or renamed during delete, migrate, …
+	if vmsdb.missing[id] || vmsdb.app.Operations.IsVMLocked(vmName.Name) {
+		return alerts
+	}
+
+	vmsdb.missing[id] = true
+	delete(vmsdb.waitingPhone, id)
+
+	severity := AlertSeverityWarning
+	if entry.Active {
+		severity = AlertSeverityCritical
+	}
+
+	return append(alerts, &Alert{
+		Type:     AlertTypeBad,
+		Severity: severity,
+		Subject:  fmt.Sprintf("VM %s domain is missing", vmName.Name),
+		Content:  fmt.Sprintf("VM %s: libvirt domain %s disappeared", vmName, vmName.LibvirtDomainName(vmsdb.app)),
+		VMName:   vmName.Name,
+	})
+}
+
+// alert when a booted VM does not phone home
+func (vmsdb *VMStateDatabase) checkPhoneCalls(states map[string]string, alerts []*Alert) []*Alert {
+	vmsdb.eventsMutex.Lock()
+	defer vmsdb.eventsMutex.Unlock()
+
+	for id, since := range vmsdb.waitingPhone {
+		if states[id] != VMStateUp || vmsdb.phonedAt[id].After(since) {
+			delete(vmsdb.waitingPhone, id)
+			continue
+		}
+
+		if time.Since(since) < VMStartTimeout {
+			continue
+		}
+
+		delete(vmsdb.waitingPhone, id)
+
+		entry, err := vmsdb.app.VMDB.getEntryByID(id)
+		if err != nil || !entry.Active {
+			continue
+		}
+
+		alerts = append(alerts, &Alert{
+			Type:    AlertTypeBad,
+			Subject: fmt.Sprintf("VM %s did not phone home", entry.Name.Name),
+			Content: fmt.Sprintf("VM %s is up since %s but did not phone home (stuck during boot?)", entry.Name, time.Since(since).Truncate(time.Second)),
+			VMName:  entry.Name.Name,
+		})
+	}
+
+	return alerts
+}
+
+// forget deleted VMs and old expectations
+func (vmsdb *VMStateDatabase) cleanup(states map[string]string) {
+	for _, m := range []map[string]bool{vmsdb.down, vmsdb.missing} {
+		for id := range m {
+			if _, exists := states[id]; !exists {
+				delete(m, id)
+			}
+		}
+	}
+
+	vmsdb.eventsMutex.Lock()
+	defer vmsdb.eventsMutex.Unlock()
+
+	for id, expectation := range vmsdb.expected {
+		if time.Since(expectation.at) > vmStateExpectationTTL {
+			delete(vmsdb.expected, id)
+		}
+	}
+
+	for id := range vmsdb.phonedAt {
+		if _, exists := states[id]; !exists {
+			delete(vmsdb.phonedAt, id)
+		}
+	}
+}
+
+// returns true if Mulch expected this state (the expectation is then forgotten)
+func (vmsdb *VMStateDatabase) isExpected(vmName *VMName, state string) (vmStateExpectation, bool) {
+	vmsdb.eventsMutex.Lock()
+	defer vmsdb.eventsMutex.Unlock()
+
+	expectation, exists := vmsdb.expected[vmName.ID()]
+	if !exists || expectation.state != state {
+		return vmStateExpectation{}, false
+	}
+	delete(vmsdb.expected, vmName.ID())
+	return expectation, true
+}
+
+// Expect tells the database that Mulch is changing the state of
+// this VM (start, stop), so no alert will be sent for this change
+func (vmsdb *VMStateDatabase) Expect(vmName *VMName, state string) {
+	vmsdb.expect(vmName, state, false)
+}
+
+// ExpectRevert is like Expect, for a snapshot revert: a VM resumed
+// from a snapshot does not boot, so it will not phone home
+func (vmsdb *VMStateDatabase) ExpectRevert(vmName *VMName, state string) {
+	vmsdb.expect(vmName, state, true)
+}
+
+func (vmsdb *VMStateDatabase) expect(vmName *VMName, state string, noPhone bool) {
+	vmsdb.eventsMutex.Lock()
+	defer vmsdb.eventsMutex.Unlock()
+
+	vmsdb.expected[vmName.ID()] = vmStateExpectation{
+		state:   state,
+		at:      time.Now(),
+		noPhone: noPhone,
+	}
+}
+
+// PhoneCall records a phone call from a VM
+func (vmsdb *VMStateDatabase) PhoneCall(vmName *VMName) {
+	vmsdb.eventsMutex.Lock()
+	defer vmsdb.eventsMutex.Unlock()
+
+	vmsdb.phonedAt[vmName.ID()] = time.Now()
 }
 
 // Get returns the state of all VMs
+// (this function does not wait for a running Update, so the VM database
+// can call it with its own mutex locked)
 func (vmsdb *VMStateDatabase) Get() map[string]string {
-	vmsdb.mutex.Lock()
-	defer vmsdb.mutex.Unlock()
+	vmsdb.dbMutex.RLock()
+	defer vmsdb.dbMutex.RUnlock()
 
 	res := make(map[string]string, len(vmsdb.db))
 	for k, v := range vmsdb.db {
@@ -151,7 +416,7 @@ func (vmsdb *VMStateDatabase) Run() error {
 
 	for {
 		vmsdb.Update()
-		time.Sleep(10 * time.Second)
+		time.Sleep(VMStateUpdateInterval)
 	}
 }
 
@@ -175,6 +440,13 @@ func (vmsdb *VMStateDatabase) restoreStates() {
 		}
 
 		hotState, err := VMIsRunning(entry.Name, vmsdb.app)
+		if errors.Is(err, ErrVMDomainNotFound) {
+			vmsdb.mutex.Lock()
+			alerts := vmsdb.checkMissing(entry, nil)
+			vmsdb.mutex.Unlock()
+			vmsdb.sendAlerts(alerts)
+			continue
+		}
 		if err != nil {
 			vmsdb.app.Log.Error(err.Error())
 			continue
@@ -184,9 +456,21 @@ func (vmsdb *VMStateDatabase) restoreStates() {
 			vmsdb.app.Log.Infof("restore state: starting %s", entry.Name)
 			wg.Add(1)
 			go func() {
+				alert := &Alert{
+					Type:     AlertTypeBad,
+					Severity: AlertSeverityWarning,
+					Subject:  fmt.Sprintf("VM %s was down", entry.Name.Name),
+					Content:  fmt.Sprintf("VM %s was found down at startup (crash or host reboot?), it was restarted", entry.Name),
+					VMName:   entry.Name.Name,
+				}
 				err := VMStartByName(entry.Name, entry.VM.SecretUUID, vmsdb.app, vmsdb.app.Log)
 				if err != nil {
 					vmsdb.app.Log.Error(err.Error())
+					alert.Severity = AlertSeverityCritical
+					alert.Content = fmt.Sprintf("VM %s was found down at startup (crash or host reboot?), and failed to restart: %s", entry.Name, err)
+				}
+				if entry.Active {
+					vmsdb.sendAlerts([]*Alert{alert})
 				}
 				wg.Done()
 			}()
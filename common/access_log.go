@@ -0,0 +1,51 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// Access log formats (mulch-proxy)
+const (
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJSON     = "json"
+)
+
+// Access log file rotation: when the current file of a VM exceeds
+// AccessLogMaxSize, it's renamed to .1 (.1 to .2, etc) and the oldest one
+// is deleted.
+const (
+	AccessLogMaxSize  = 50 * 1024 * 1024
+	AccessLogMaxFiles = 5
+)
+
+// AccessLogDir is the access log directory, in the data path shared by
+// mulchd and mulch-proxy
+const AccessLogDir = "access-logs"
+
+// AccessLogEntry is a request handled by mulch-proxy (JSON format)
+type AccessLogEntry struct {
+	Time      time.Time
+	IP        string
+	Host      string
+	Method    string
+	Path      string
+	Proto     string
+	Status    int
+	Size      uint64
+	Duration  float64 // seconds
+	Upstream  string
+	Referer   string
+	UserAgent string
+}
+
+// AccessLogFilename returns the access log file of a VM, rotated file
+// number n (0 being the current file)
+func AccessLogFilename(dataPath string, vmName string, n int) string {
+	filename := path.Clean(dataPath + "/" + AccessLogDir + "/" + vmName + ".log")
+	if n == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s.%d", filename, n)
+}
@@ -0,0 +1,16 @@
+package common
+
+import "time"
+
+// APIAuditEntry describes an authenticated API call
+type APIAuditEntry struct {
+	Time     time.Time
+	Key      string
+	IP       string
+	Method   string
+	Path     string
+	Params   map[string]string
+	Success  bool
+	Status   int
+	Duration time.Duration
+}
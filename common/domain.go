@@ -12,6 +12,8 @@ type Domain struct {
 	DestinationPort int
 	RedirectToHTTPS bool
 	RateProfile     string
+	Maintenance     bool           // VM is down, rebuilding or in manual maintenance mode
+	ErrorPages      map[int]string // custom error page filenames, by status
 
 	// used internaly by Mulch reverse proxy server
 	ReverseProxy *httputil.ReverseProxy `json:"-"`
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// ErrorPagesDir is the directory (in mulchd/mulch-proxy data path) where
+// custom error pages of VMs are stored, one sub-directory per VM revision
+const ErrorPagesDir = "error-pages"
+
+// ErrorPageMaxSize is the maximum size of a custom error page
+const ErrorPageMaxSize = 1024 * 1024
+
+// ErrorPageStatuses are the statuses generated by mulch-proxy, so the only
+// ones allowed for custom error pages
+var ErrorPageStatuses = []int{429, 502, 503}
+
+// IsValidErrorPageStatus returns true if status can have a custom error page
+func IsValidErrorPageStatus(status int) bool {
+	for _, s := range ErrorPageStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorPageFilename returns the filename of a custom error page
+// (vmID is the VM name with its revision, see Domain.VMName)
+func ErrorPageFilename(dataPath string, vmID string, status int) string {
+	return path.Clean(fmt.Sprintf("%s/%s/%s/%s.html", dataPath, ErrorPagesDir, vmID, strconv.Itoa(status)))
+}
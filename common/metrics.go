@@ -0,0 +1,117 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Metric types
+const (
+	MetricGauge     = "gauge"
+	MetricCounter   = "counter"
+	MetricHistogram = "histogram"
+)
+
+// MetricsWriter writes metrics using the Prometheus text format.
+// All samples of a metric must be written consecutively.
+type MetricsWriter struct {
+	w        io.Writer
+	declared map[string]bool
+	err      error
+}
+
+// NewMetricsWriter creates a new MetricsWriter
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{
+		w:        w,
+		declared: make(map[string]bool),
+	}
+}
+
+// Gauge writes a gauge sample, labels are key/value pairs
+func (mw *MetricsWriter) Gauge(name string, help string, value float64, labels ...string) {
+	mw.write(name, MetricGauge, help, value, labels)
+}
+
+// Counter writes a counter sample, labels are key/value pairs
+func (mw *MetricsWriter) Counter(name string, help string, value float64, labels ...string) {
+	mw.write(name, MetricCounter, help, value, labels)
+}
+
+// Histogram writes a histogram, with non-cumulative counts for each
+// bucket upper bound (the last count is for +Inf)
+func (mw *MetricsWriter) Histogram(name string, help string, buckets []float64, counts []uint64, sum float64, labels ...string) {
+	if !mw.declare(name, MetricHistogram, help) {
+		return
+	}
+
+	var cumul uint64
+	for i, count := range counts {
+		cumul += count
+		le := "+Inf"
+		if i < len(buckets) {
+			le = strconv.FormatFloat(buckets[i], 'g', -1, 64)
+		}
+		mw.sample(name+"_bucket", float64(cumul), append(labels[:len(labels):len(labels)], "le", le))
+	}
+	mw.sample(name+"_sum", sum, labels)
+	mw.sample(name+"_count", float64(cumul), labels)
+}
+
+// Err returns the first write error, if any
+func (mw *MetricsWriter) Err() error {
+	return mw.err
+}
+
+func (mw *MetricsWriter) write(name string, mtype string, help string, value float64, labels []string) {
+	if !mw.declare(name, mtype, help) {
+		return
+	}
+	mw.sample(name, value, labels)
+}
+
+// writes HELP and TYPE lines, if needed, and returns false on error
+func (mw *MetricsWriter) declare(name string, mtype string, help string) bool {
+	if mw.err != nil {
+		return false
+	}
+
+	if !mw.declared[name] {
+		mw.declared[name] = true
+		_, mw.err = fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+	}
+	return mw.err == nil
+}
+
+func (mw *MetricsWriter) sample(name string, value float64, labels []string) {
+	if mw.err != nil {
+		return
+	}
+
+	var labelStr string
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"=\""+metricsEscapeLabel(labels[i+1])+"\"")
+		}
+		labelStr = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	_, mw.err = fmt.Fprintf(mw.w, "%s%s %s\n", name, labelStr, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func metricsEscapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+// MetricBool converts a boolean to a metric value
+func MetricBool(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
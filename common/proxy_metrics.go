@@ -0,0 +1,26 @@
+package common
+
+// ProxyLatencyBuckets are the upper bounds (seconds) of mulch-proxy
+// request latency histograms
+var ProxyLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// ProxyDomainMetrics are traffic counters of a proxied domain
+type ProxyDomainMetrics struct {
+	Domain         string
+	VMName         string
+	Requests       uint64
+	StatusClasses  map[string]uint64 // "2xx", "5xx", …
+	BytesIn        uint64
+	BytesOut       uint64
+	UpstreamErrors uint64
+	RateLimited    uint64
+	LatencyCounts  []uint64 // see ProxyLatencyBuckets, last one is +Inf
+	LatencySum     float64
+}
+
+// ProxyChainMetrics is sent by a child proxy to its parent, so the parent
+// can expose metrics of the whole chain
+type ProxyChainMetrics struct {
+	Domains   []*ProxyDomainMetrics
+	ForwardTo string
+}
@@ -0,0 +1,19 @@
+package common
+
+import "time"
+
+// APISchedule describes VM auto-rebuild scheduling
+type APISchedule struct {
+	PausedUntil   time.Time
+	MaxConcurrent int
+	Entries       []APIScheduleEntry
+}
+
+// APIScheduleEntry is the auto-rebuild schedule of a VM
+type APIScheduleEntry struct {
+	VMName      string
+	Schedule    string
+	LastRebuild time.Time
+	Next        time.Time
+	Status      string
+}
@@ -13,11 +13,14 @@ type APISSHConnection struct {
 
 // APIOperation is currently exactly matching Operation struct
 type APIOperation struct {
+	ID            string
 	Origin        string
 	Action        string
 	Ressource     string
 	RessourceName string
 	StartTime     time.Time
+	Cancellable   bool
+	CanceledBy    string
 }
 
 type APIOrigin struct {
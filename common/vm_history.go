@@ -0,0 +1,15 @@
+package common
+
+import "time"
+
+// APIVMHistoryEvent describes a lifecycle event of a VM
+type APIVMHistoryEvent struct {
+	Time     time.Time
+	Revision int
+	Type     string
+	Author   string
+	Message  string
+	Error    string
+	Duration time.Duration
+	Downtime time.Duration
+}
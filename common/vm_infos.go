@@ -14,6 +14,7 @@ type APIVMInfos struct {
 	DiskSizeMB          uint64
 	AllocatedDiskSizeMB uint64
 	BackupDiskSizeMB    uint64
+	DataDisks           []string
 	Hostname            string
 	Domains             []string
 	SuperUser           string
@@ -23,8 +24,11 @@ type APIVMInfos struct {
 	LastRebuildDowntime time.Duration
 	AuthorKey           string
 	Locked              bool
+	Maintenance         bool
 	AssignedIPv4        string
 	AssignedMAC         string
 	DoActions           []string
 	Tags                []string
+	Health              string
+	HealthError         string
 }
@@ -14,6 +14,7 @@ type APIVMListEntry struct {
 	WIP       string
 	SuperUser string
 	AppUser   string
+	Health    string // empty if the VM has no healthcheck
 }
 
 // APIVMBasicListEntries is a light variant of APIVMListEntries
@@ -0,0 +1,16 @@
+package common
+
+import "time"
+
+// APIVMSnapshotListEntries is a list of entries for "vm snapshot list" command
+type APIVMSnapshotListEntries []APIVMSnapshotListEntry
+
+// APIVMSnapshotListEntry is an entry for a VM snapshot
+type APIVMSnapshotListEntry struct {
+	Name        string
+	Description string
+	Created     time.Time
+	State       string
+	Parent      string
+	Current     bool
+}
@@ -0,0 +1,27 @@
+package common
+
+import "time"
+
+// APIVMStatsPoint aggregates resource usage samples of a VM over a
+// period of time (rates are in bytes per second)
+type APIVMStatsPoint struct {
+	Time         time.Time // start of the period
+	Samples      int
+	CPUAvg       float64 // percent of allocated CPUs
+	CPUMax       float64
+	MemUsedAvg   uint64 // bytes
+	MemUsedMax   uint64
+	MemTotal     uint64
+	DiskReadAvg  float64
+	DiskWriteAvg float64
+	NetRxAvg     float64
+	NetTxAvg     float64
+}
+
+// APIVMStats is the resource usage of a VM: a summary of the whole period
+// and (optionally) detailed points
+type APIVMStats struct {
+	VMName  string
+	Summary APIVMStatsPoint
+	Points  []APIVMStatsPoint
+}
@@ -0,0 +1,22 @@
+package common
+
+// APIVMValidation severities
+const (
+	APIVMValidationError   = "error"
+	APIVMValidationWarning = "warning"
+)
+
+// APIVMValidation is the result of a VM config validation
+type APIVMValidation struct {
+	Filename string
+	Name     string
+	Valid    bool
+	Problems []APIVMValidationProblem
+}
+
+// APIVMValidationProblem is a problem found in a VM config
+type APIVMValidationProblem struct {
+	Setting  string
+	Message  string
+	Severity string
+}
@@ -2,8 +2,10 @@
 
 # Alert parameters are stored in environment:
 # TYPE ("GOOD" / "BAD")
+# SEVERITY ("info" / "warning" / "critical")
 # SUBJECT
 # CONTENT
+# VM (VM name, if any)
 # Variables content is as harmless as possible: no (single/double) quotes, $, …
 
 hook_url="https://hooks.slack.com/services/xxx"
@@ -0,0 +1,49 @@
+#!/bin/bash
+
+# grow root partition and filesystem after a live disk resize
+
+part=$(findmnt -n -o SOURCE /)
+fstype=$(findmnt -n -o FSTYPE /)
+disk=$(lsblk -n -d -o PKNAME "$part")
+num=$(cat "/sys/class/block/$(basename "$part")/partition")
+
+if [ -z "$disk" -o -z "$num" ]; then
+    >&2 echo "unable to find root partition ($part)"
+    exit 10
+fi
+
+# create temporary handle
+tmpfile=$(mktemp)
+
+echo "growing partition $num of /dev/$disk…"
+sudo growpart "/dev/$disk" "$num" > "$tmpfile" 2>&1
+ret=$?
+# 1 = NOCHANGE
+if [ $ret -ne 0 -a $ret -ne 1 ]; then
+    cat "$tmpfile"
+    rm "$tmpfile"
+    exit 20
+fi
+
+echo "resizing FS on $part… ($fstype)"
+case "$fstype" in
+    ext2|ext3|ext4)
+        sudo resize2fs "$part" > "$tmpfile" 2>&1
+        ;;
+    xfs)
+        sudo xfs_growfs / > "$tmpfile" 2>&1
+        ;;
+    *)
+        >&2 echo "unsupported filesystem $fstype"
+        rm "$tmpfile"
+        exit 30
+        ;;
+esac
+
+if [ $? -ne 0 ]; then
+    cat "$tmpfile"
+    rm "$tmpfile"
+    exit 99
+fi
+
+rm "$tmpfile"
@@ -0,0 +1,80 @@
+#!/bin/bash
+
+# mount a data disk (formating it if needed) and add it to fstab
+# usage: mount-disk.sh <disk-name> <mount-point>
+
+. /etc/mulch.env
+
+part="/dev/disk/by-id/virtio-$1"
+mnt="$2"
+
+tests=0
+while [ ! -e "$part" ]; do
+    echo "waiting data disk $1…"
+    tests=$[$tests+1]
+    sleep 1
+
+    if [ $tests -eq 10 ]; then
+        >&2 echo "can't find data disk $part"
+        exit 10
+    fi
+done
+
+# create temporary handle
+tmpfile=$(mktemp)
+
+new=0
+sudo blkid "$part" > /dev/null
+if [ $? -ne 0 ]; then
+    echo "creating FS on $part… (ext4)"
+    sudo mkfs.ext4 -q "$part" > "$tmpfile" 2>&1
+    if [ $? -ne 0 ]; then
+        cat "$tmpfile"
+        rm "$tmpfile"
+        exit 20
+    fi
+    new=1
+fi
+
+uuid=$(sudo blkid -s UUID -o value "$part")
+if [ -z "$uuid" ]; then
+    >&2 echo "can't get UUID of $part"
+    rm "$tmpfile"
+    exit 30
+fi
+
+sudo mkdir -p "$mnt" || exit $?
+
+grep -q "^UUID=$uuid " /etc/fstab
+if [ $? -ne 0 ]; then
+    echo "UUID=$uuid $mnt auto defaults,nofail 0 2" | sudo tee -a /etc/fstab > /dev/null || exit $?
+fi
+
+mountpoint -q "$mnt"
+if [ $? -ne 0 ]; then
+    sudo mount "$mnt" || exit $?
+fi
+
+if [ $new -eq 1 ]; then
+    sudo chown "$_APP_USER:$_APP_USER" "$mnt" || exit $?
+fi
+
+# the volume may have been resized
+fstype=$(findmnt -n -o FSTYPE "$mnt")
+case "$fstype" in
+    ext2|ext3|ext4)
+        sudo resize2fs "$part" > "$tmpfile" 2>&1
+        ;;
+    xfs)
+        sudo xfs_growfs "$mnt" > "$tmpfile" 2>&1
+        ;;
+esac
+
+if [ $? -ne 0 ]; then
+    cat "$tmpfile"
+    rm "$tmpfile"
+    exit 99
+fi
+
+rm "$tmpfile"
+echo "data disk $1 mounted on $mnt"